@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	_ "net/http/pprof"
 
@@ -17,28 +18,33 @@ func main() {
 		listen = flag.String("listen", ":8000", "listen address")
 		dbPath = flag.String("db", "badger://.db", "db path e.g. badger://.db or memory://")
 		debug  = flag.Bool("debug", false, "Enable debug endpoints")
+
+		queryTimeout = flag.Duration("query-timeout", 0, "longest a query can run e.g. 30s, 0 is unlimited")
 	)
 	flag.Parse()
 
 	db, err := db.New(*dbPath)
 	if err != nil {
-		return
+		log.Fatalf("Failed to open db: %s", err)
 	}
 	defer db.Close()
 
 	s, err := store.New(db)
 	if err != nil {
-		return
+		// log.Fatalf skips the deferred close
+		db.Close()
+		log.Fatalf("Failed to open store: %s", err)
 	}
 
 	api := &store.API{
-		Store: s,
-		Debug: *debug,
+		Store:        s,
+		Debug:        *debug,
+		QueryTimeout: *queryTimeout,
 	}
 
 	http.Handle("/", api)
 	http.Handle("/metrics", promhttp.Handler())
 
 	fmt.Printf("Listening on %s\n", *listen)
-	http.ListenAndServe(*listen, nil)
+	log.Fatal(http.ListenAndServe(*listen, nil))
 }
@@ -120,7 +120,11 @@ class TestBasic:
             }
         )
 
-        assert result["data"][0]["meta"] == {"count": 2}
+        assert result["data"][0]["meta"] == {
+            "count": 2,
+            "countSamples": 2,
+            "countError": 0,
+        }
 
     def test_count_one(self):
         result = helpers.execute_query(
@@ -141,7 +145,11 @@ class TestBasic:
             }
         )
 
-        assert result["data"][0]["meta"] == {"count": 1}
+        assert result["data"][0]["meta"] == {
+            "count": 1,
+            "countSamples": 1,
+            "countError": 0,
+        }
 
     def test_unique_count(self):
         result = helpers.execute_query(
@@ -159,7 +167,41 @@ class TestBasic:
             }
         )
 
-        assert result["data"][0]["meta"] == {"uniqueCount": 1}
+        assert result["data"][0]["meta"] == {
+            "uniqueCount": 1,
+            "uniqueCountSamples": 1,
+            "uniqueCountError": 0,
+        }
+
+
+class TestSamplerate:
+    def setup_class(self):
+        helpers.wipe_database()
+        events = [
+            helpers.create_event("tag1", ts=1001, samplerate=10, data={"dim1": "foo"}),
+            helpers.create_event("tag1", ts=1002, samplerate=1, data={"dim1": "foo"}),
+        ]
+        helpers.send_events(events)
+
+    def test_weighted_count(self):
+        result = helpers.execute_query(
+            {
+                "data": [
+                    {
+                        "name": "test",
+                        "tag": "tag1",
+                        "keys": [],
+                        "filters": [{"type": "eq", "key": "dim1", "value": "foo"}],
+                        "operations": [{"type": "count"}],
+                        "hideData": True,
+                    }
+                ]
+            }
+        )
+
+        assert result["data"][0]["meta"]["count"] == 11
+        assert result["data"][0]["meta"]["countSamples"] == 2
+        assert result["data"][0]["meta"]["countError"] == mock.ANY
 
 
 class TestRegex:
@@ -1,11 +1,11 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"log"
 
 	badger "github.com/dgraph-io/badger"
-	"github.com/dgraph-io/badger/pb"
 )
 
 // BadgerDB implements DB
@@ -31,19 +31,16 @@ func (b *BadgerDB) LookupValue(key []byte) (value []byte, exists bool, err error
 		if err != nil {
 			return err
 		}
-		err = item.Value(func(val []byte) error {
-			copy(value, val)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-		return nil
+		value, err = item.ValueCopy(nil)
+		return err
 	})
 	if err == badger.ErrKeyNotFound {
 		return nil, false, nil
 	}
-	return
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
 }
 
 // SetKeyValues implements DB
@@ -65,36 +62,48 @@ func (b *BadgerDB) GetSequence(key []byte, bandwidth uint64) (Sequence, error) {
 }
 
 // RangeKeys implements DB
-func (b *BadgerDB) RangeKeys(prefix []byte, keyItr func([]byte) error) error {
-	b.db.View(func(txn *badger.Txn) error {
+func (b *BadgerDB) RangeKeys(ctx context.Context, prefix []byte, keyItr func([]byte) error) error {
+	err := b.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			item := it.Item()
-			keyItr(item.Key())
+			err := keyItr(item.Key())
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	return nil
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
 }
 
-// Stream implements DB
-func (b *BadgerDB) Stream(prefix []byte, keyToList func(key []byte, itr *badger.Iterator) (list *pb.KVList, err error), send func(list *pb.KVList) error) error {
-	stream := b.db.NewStream()
-	stream.NumGo = 16                     // Set number of goroutines to use for iteration.
-	stream.Prefix = prefix                // Leave nil for iteration over the whole DB.
-	stream.LogPrefix = "Badger.Streaming" // For identifying stream logs. Outputs to Logger.
-	stream.KeyToList = keyToList
-	stream.Send = send
-
-	if err := stream.Orchestrate(context.Background()); err != nil {
-		return err
+// NewIterator implements DB
+func (b *BadgerDB) NewIterator(opts IteratorOptions) Iterator {
+	txn := b.db.NewTransaction(false)
+	badgerOpts := badger.DefaultIteratorOptions
+	badgerOpts.PrefetchValues = !opts.KeysOnly
+	badgerOpts.Reverse = opts.Reverse
+	badgerOpts.Prefix = opts.Prefix
+	return &badgerIterator{
+		txn:  txn,
+		it:   txn.NewIterator(badgerOpts),
+		opts: opts,
 	}
+}
 
-	return nil
+// Stream implements DB
+func (b *BadgerDB) Stream(ctx context.Context, prefix []byte, parts int, send func(part int, kv KeyValuePair) error) error {
+	return streamRanges(ctx, b, prefix, parts, send)
 }
 
 // DropAll implements DB
@@ -106,3 +115,70 @@ func (b *BadgerDB) DropAll() error {
 func (b *BadgerDB) Close() error {
 	return b.db.Close()
 }
+
+type badgerIterator struct {
+	txn  *badger.Txn
+	it   *badger.Iterator
+	opts IteratorOptions
+}
+
+func (it *badgerIterator) Rewind() {
+	if !it.opts.Reverse {
+		it.seek(it.opts.start())
+		return
+	}
+
+	end := it.opts.end()
+	if end == nil {
+		it.it.Rewind()
+		return
+	}
+	// Seeking in reverse finds the last key <= end, but end is exclusive
+	it.it.Seek(end)
+	if it.it.Valid() && bytes.Equal(it.it.Item().Key(), end) {
+		it.it.Next()
+	}
+}
+
+func (it *badgerIterator) Seek(key []byte) {
+	if it.opts.Reverse {
+		if end := it.opts.end(); end != nil && bytes.Compare(key, end) >= 0 {
+			it.Rewind()
+			return
+		}
+	} else if start := it.opts.start(); bytes.Compare(key, start) < 0 {
+		key = start
+	}
+	it.seek(key)
+}
+
+// seek seeks to the key. An empty key would make badger seek to the prefix, so it rewinds
+// instead.
+func (it *badgerIterator) seek(key []byte) {
+	if len(key) == 0 {
+		it.it.Rewind()
+		return
+	}
+	it.it.Seek(key)
+}
+
+func (it *badgerIterator) Valid() bool {
+	return it.it.Valid() && it.opts.contains(it.it.Item().Key())
+}
+
+func (it *badgerIterator) Next() {
+	it.it.Next()
+}
+
+func (it *badgerIterator) Key() []byte {
+	return it.it.Item().Key()
+}
+
+func (it *badgerIterator) Value() ([]byte, error) {
+	return it.it.Item().ValueCopy(nil)
+}
+
+func (it *badgerIterator) Close() {
+	it.it.Close()
+	it.txn.Discard()
+}
@@ -1,26 +1,33 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net/url"
-
-	badger "github.com/dgraph-io/badger"
-	"github.com/dgraph-io/badger/pb"
+	"sync"
+	"sync/atomic"
 )
 
+// ErrStopIteration can be returned by a callback to stop a scan early without an error
+var ErrStopIteration = errors.New("stop iteration")
+
 // KeyValuePair describes a key and a value
 type KeyValuePair struct {
 	Key   []byte
 	Value []byte
 }
 
-// DB is the interface for the database
+// DB is the interface for the database. Scans which take a context stop with the error of
+// the context once it is done.
 type DB interface {
 	LookupValue(key []byte) (value []byte, exists bool, err error)
 	SetKeyValues([]KeyValuePair) error
 	GetSequence(key []byte, bandwidth uint64) (Sequence, error)
-	RangeKeys(prefix []byte, keyItr func([]byte) error) error
-	Stream(prefix []byte, keyToList func(key []byte, itr *badger.Iterator) (list *pb.KVList, err error), send func(list *pb.KVList) error) error
+	RangeKeys(ctx context.Context, prefix []byte, keyItr func([]byte) error) error
+	NewIterator(opts IteratorOptions) Iterator
+	Stream(ctx context.Context, prefix []byte, parts int, send func(part int, kv KeyValuePair) error) error
 	DropAll() error
 	Close() error
 }
@@ -30,6 +37,30 @@ type Sequence interface {
 	Next() (uint64, error)
 }
 
+// IteratorOptions describes the keys visited by an Iterator
+type IteratorOptions struct {
+	Prefix     []byte // Only keys with the prefix are visited
+	LowerBound []byte // Inclusive, nil is unbounded
+	UpperBound []byte // Exclusive, nil is unbounded
+	Reverse    bool   // Visit keys in descending order
+	KeysOnly   bool   // Values are not prefetched
+}
+
+// Iterator visits keys in order. It must be closed after use.
+type Iterator interface {
+	// Rewind moves to the first key, or the last key when iterating in reverse
+	Rewind()
+	// Seek moves to the first key >= key, or the last key <= key when iterating in reverse
+	Seek(key []byte)
+	Valid() bool
+	Next()
+	// Key returns the current key. It is only valid until the iterator is moved.
+	Key() []byte
+	// Value returns a copy of the value of the current key
+	Value() ([]byte, error)
+	Close()
+}
+
 // New creates a new database
 func New(uri string) (DB, error) {
 	u, err := url.Parse(uri)
@@ -50,3 +81,118 @@ func New(uri string) (DB, error) {
 	}
 	return d, nil
 }
+
+// start returns the first key that can be visited, or nil if there is no lower bound
+func (o IteratorOptions) start() []byte {
+	if bytes.Compare(o.LowerBound, o.Prefix) > 0 {
+		return o.LowerBound
+	}
+	return o.Prefix
+}
+
+// end returns the exclusive end of the keys that can be visited, or nil if there is no
+// upper bound
+func (o IteratorOptions) end() []byte {
+	end := prefixEnd(o.Prefix)
+	if o.UpperBound != nil && (end == nil || bytes.Compare(o.UpperBound, end) < 0) {
+		return o.UpperBound
+	}
+	return end
+}
+
+// contains returns whether the key can be visited
+func (o IteratorOptions) contains(key []byte) bool {
+	if !bytes.HasPrefix(key, o.Prefix) {
+		return false
+	}
+	if o.LowerBound != nil && bytes.Compare(key, o.LowerBound) < 0 {
+		return false
+	}
+	return o.UpperBound == nil || bytes.Compare(key, o.UpperBound) < 0
+}
+
+// prefixEnd returns the smallest key greater than every key with the prefix, or nil if
+// there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// splitPrefix splits the keys with the prefix into parts sub-ranges by the byte after the
+// prefix
+func splitPrefix(prefix []byte, parts int) []IteratorOptions {
+	if parts < 1 {
+		parts = 1
+	}
+	if parts > 256 {
+		parts = 256
+	}
+	ranges := make([]IteratorOptions, parts)
+	for i := range ranges {
+		ranges[i].Prefix = prefix
+		if i > 0 {
+			ranges[i].LowerBound = append(append([]byte{}, prefix...), byte(i*256/parts))
+		}
+		if i < parts-1 {
+			ranges[i].UpperBound = append(append([]byte{}, prefix...), byte((i+1)*256/parts))
+		}
+	}
+	return ranges
+}
+
+// streamRanges iterates over the sub-ranges of the prefix concurrently and calls send for
+// every key. send is called concurrently for different parts, but in key order within a
+// part. The key is only valid until send returns. The first error returned by send or the
+// context stops every part, and ErrStopIteration stops every part without an error.
+func streamRanges(ctx context.Context, d DB, prefix []byte, parts int, send func(part int, kv KeyValuePair) error) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		failed   int32
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			atomic.StoreInt32(&failed, 1)
+		})
+	}
+
+	for part, opts := range splitPrefix(prefix, parts) {
+		wg.Add(1)
+		go func(part int, opts IteratorOptions) {
+			defer wg.Done()
+			it := d.NewIterator(opts)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid() && atomic.LoadInt32(&failed) == 0; it.Next() {
+				if err := ctx.Err(); err != nil {
+					fail(err)
+					return
+				}
+				value, err := it.Value()
+				if err != nil {
+					fail(err)
+					return
+				}
+				err = send(part, KeyValuePair{Key: it.Key(), Value: value})
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(part, opts)
+	}
+	wg.Wait()
+
+	if firstErr == ErrStopIteration {
+		return nil
+	}
+	return firstErr
+}
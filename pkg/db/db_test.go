@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// testDBs runs the test against every database implementation
+func testDBs(t *testing.T, test func(t *testing.T, d DB)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryDB())
+	})
+	t.Run("badger", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "eventstore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		d := newBadgerDB(dir)
+		defer d.Close()
+		test(t, d)
+	})
+}
+
+func TestDB_NewIterator(t *testing.T) {
+	testDBs(t, func(t *testing.T, d DB) {
+		err := d.SetKeyValues([]KeyValuePair{
+			{Key: []byte("a"), Value: []byte("0")},
+			{Key: []byte("b:1"), Value: []byte("1")},
+			{Key: []byte("b:2"), Value: []byte("2")},
+			{Key: []byte("b:3"), Value: []byte("3")},
+			{Key: []byte("b:4"), Value: []byte("4")},
+			{Key: []byte("c"), Value: []byte("5")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name string
+			opts IteratorOptions
+			seek []byte
+			want []string
+		}{
+			{"All", IteratorOptions{}, nil, []string{"a", "b:1", "b:2", "b:3", "b:4", "c"}},
+			{"Prefix", IteratorOptions{Prefix: []byte("b:")}, nil, []string{"b:1", "b:2", "b:3", "b:4"}},
+			{"Bounds", IteratorOptions{Prefix: []byte("b:"), LowerBound: []byte("b:2"), UpperBound: []byte("b:4")}, nil, []string{"b:2", "b:3"}},
+			{"Reverse", IteratorOptions{Reverse: true}, nil, []string{"c", "b:4", "b:3", "b:2", "b:1", "a"}},
+			{"Reverse prefix", IteratorOptions{Prefix: []byte("b:"), Reverse: true}, nil, []string{"b:4", "b:3", "b:2", "b:1"}},
+			{"Reverse bounds", IteratorOptions{Prefix: []byte("b:"), LowerBound: []byte("b:2"), UpperBound: []byte("b:4"), Reverse: true}, nil, []string{"b:3", "b:2"}},
+			{"Seek", IteratorOptions{Prefix: []byte("b:")}, []byte("b:25"), []string{"b:3", "b:4"}},
+			{"Seek before prefix", IteratorOptions{Prefix: []byte("b:")}, []byte("a"), []string{"b:1", "b:2", "b:3", "b:4"}},
+			{"Reverse seek", IteratorOptions{Prefix: []byte("b:"), Reverse: true}, []byte("b:25"), []string{"b:2", "b:1"}},
+			{"Reverse seek after prefix", IteratorOptions{Prefix: []byte("b:"), Reverse: true}, []byte("z"), []string{"b:4", "b:3", "b:2", "b:1"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				it := d.NewIterator(tt.opts)
+				defer it.Close()
+
+				var got []string
+				if tt.seek != nil {
+					it.Seek(tt.seek)
+				} else {
+					it.Rewind()
+				}
+				for ; it.Valid(); it.Next() {
+					value, err := it.Value()
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, string(it.Key()))
+					if value == nil {
+						t.Errorf("Value() of %s = nil", it.Key())
+					}
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("iterated %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestDB_Stream(t *testing.T) {
+	testDBs(t, func(t *testing.T, d DB) {
+		var kvs []KeyValuePair
+		for i := 0; i < 1000; i++ {
+			kvs = append(kvs, KeyValuePair{Key: []byte(fmt.Sprintf("k%c%d", byte(i%256), i)), Value: []byte{byte(i)}})
+		}
+		kvs = append(kvs, KeyValuePair{Key: []byte("k"), Value: []byte("prefix")}, KeyValuePair{Key: []byte("z"), Value: []byte("other")})
+		if err := d.SetKeyValues(kvs); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			mu  sync.Mutex
+			got []string
+		)
+		err := d.Stream(context.Background(), []byte("k"), 7, func(part int, kv KeyValuePair) error {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, string(kv.Key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var want []string
+		for _, kv := range kvs[:len(kvs)-1] {
+			want = append(want, string(kv.Key))
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Stream() returned %d keys, want %d", len(got), len(want))
+		}
+
+		stop := fmt.Errorf("stop")
+		err = d.Stream(context.Background(), []byte("k"), 4, func(part int, kv KeyValuePair) error {
+			return stop
+		})
+		if err != stop {
+			t.Errorf("Stream() error = %v, want %v", err, stop)
+		}
+	})
+}
+
+func TestDB_RangeKeys_stop(t *testing.T) {
+	testDBs(t, func(t *testing.T, d DB) {
+		err := d.SetKeyValues([]KeyValuePair{{Key: []byte("a")}, {Key: []byte("b")}, {Key: []byte("c")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		err = d.RangeKeys(context.Background(), nil, func(key []byte) error {
+			got = append(got, string(key))
+			if len(got) == 2 {
+				return ErrStopIteration
+			}
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("RangeKeys() = %v, %v", got, err)
+		}
+
+		fail := fmt.Errorf("fail")
+		err = d.RangeKeys(context.Background(), nil, func(key []byte) error {
+			return fail
+		})
+		if err != fail {
+			t.Errorf("RangeKeys() error = %v, want %v", err, fail)
+		}
+	})
+}
+
+func TestDB_contextCancelled(t *testing.T) {
+	testDBs(t, func(t *testing.T, d DB) {
+		err := d.SetKeyValues([]KeyValuePair{{Key: []byte("a")}, {Key: []byte("b")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = d.RangeKeys(ctx, nil, func(key []byte) error { return nil })
+		if err != context.Canceled {
+			t.Errorf("RangeKeys() error = %v, want %v", err, context.Canceled)
+		}
+		err = d.Stream(ctx, nil, 2, func(part int, kv KeyValuePair) error { return nil })
+		if err != context.Canceled {
+			t.Errorf("Stream() error = %v, want %v", err, context.Canceled)
+		}
+	})
+}
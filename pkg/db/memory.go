@@ -1,45 +1,55 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"sync"
 	"sync/atomic"
-
-	badger "github.com/dgraph-io/badger"
-	"github.com/dgraph-io/badger/pb"
 )
 
-// MemoryDB implements DB
+// MemoryDB implements DB. Keys are kept in an ordered skiplist and it is safe for
+// concurrent use.
 type MemoryDB struct {
-	db        sync.Map
+	mu        sync.RWMutex
+	db        *skiplist
 	sequences map[string]*memorySequence
 }
 
 func newMemoryDB() *MemoryDB {
 	return &MemoryDB{
-		db:        sync.Map{},
+		db:        newSkiplist(),
 		sequences: make(map[string]*memorySequence),
 	}
 }
 
 // LookupValue implements DB
 func (m *MemoryDB) LookupValue(key []byte) (value []byte, exists bool, err error) {
-	val, ok := m.db.Load(string(key))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	val, ok := m.db.get(key)
 	if !ok {
 		return nil, false, nil
 	}
-	return val.([]byte), true, nil
+	return copyBytes(val), true, nil
 }
 
 // SetKeyValues implements DB
 func (m *MemoryDB) SetKeyValues(kvs []KeyValuePair) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for _, kv := range kvs {
-		m.db.Store(string(kv.Key), kv.Value)
+		m.db.set(copyBytes(kv.Key), copyBytes(kv.Value))
 	}
 	return nil
 }
 
 // GetSequence implements DB
 func (m *MemoryDB) GetSequence(key []byte, bandwidth uint64) (Sequence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	_, ok := m.sequences[string(key)]
 	if !ok {
 		initial := uint64(0)
@@ -58,22 +68,125 @@ func (ms *memorySequence) Next() (uint64, error) {
 }
 
 // RangeKeys implements DB
-func (m *MemoryDB) RangeKeys(prefix []byte, keyItr func([]byte) error) error {
+func (m *MemoryDB) RangeKeys(ctx context.Context, prefix []byte, keyItr func([]byte) error) error {
+	it := m.NewIterator(IteratorOptions{Prefix: prefix, KeysOnly: true})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := keyItr(it.Key())
+		if err == ErrStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Close implements DB
-func (m *MemoryDB) Close() error {
-	return nil
+// NewIterator implements DB. The lock is only held while the iterator moves, so the
+// database can be written to during iteration.
+func (m *MemoryDB) NewIterator(opts IteratorOptions) Iterator {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return &memoryIterator{m: m, list: m.db, opts: opts}
 }
 
 // Stream implements DB
-func (m *MemoryDB) Stream(prefix []byte, keyToList func(key []byte, itr *badger.Iterator) (list *pb.KVList, err error), send func(list *pb.KVList) error) error {
+func (m *MemoryDB) Stream(ctx context.Context, prefix []byte, parts int, send func(part int, kv KeyValuePair) error) error {
+	return streamRanges(ctx, m, prefix, parts, send)
+}
+
+// Close implements DB
+func (m *MemoryDB) Close() error {
 	return nil
 }
 
 // DropAll implements DB
 func (m *MemoryDB) DropAll() error {
-	m.db = sync.Map{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.db = newSkiplist()
 	return nil
 }
+
+type memoryIterator struct {
+	m    *MemoryDB
+	list *skiplist
+	opts IteratorOptions
+	node *skiplistNode
+}
+
+func (it *memoryIterator) Rewind() {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+
+	if it.opts.Reverse {
+		it.node = it.list.findLessThan(it.opts.end())
+	} else {
+		it.node = it.list.findGreaterOrEqual(it.opts.start(), nil)
+	}
+}
+
+func (it *memoryIterator) Seek(key []byte) {
+	if it.opts.Reverse {
+		if end := it.opts.end(); end != nil && bytes.Compare(key, end) >= 0 {
+			it.Rewind()
+			return
+		}
+		it.m.mu.RLock()
+		defer it.m.mu.RUnlock()
+		it.node = it.list.findLessOrEqual(key)
+		return
+	}
+
+	if start := it.opts.start(); bytes.Compare(key, start) < 0 {
+		key = start
+	}
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.node = it.list.findGreaterOrEqual(key, nil)
+}
+
+func (it *memoryIterator) Valid() bool {
+	return it.node != nil && it.opts.contains(it.node.key)
+}
+
+func (it *memoryIterator) Next() {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+
+	if it.opts.Reverse {
+		it.node = it.list.findLessThan(it.node.key)
+	} else {
+		it.node = it.node.next[0]
+	}
+}
+
+func (it *memoryIterator) Key() []byte {
+	return it.node.key
+}
+
+// Value copies the value under the read lock, since setting an existing key replaces the
+// value of its node in place
+func (it *memoryIterator) Value() ([]byte, error) {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	return copyBytes(it.node.value), nil
+}
+
+func (it *memoryIterator) Close() {}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDB_RangeKeys(t *testing.T) {
+	m := newMemoryDB()
+	err := m.SetKeyValues([]KeyValuePair{
+		{Key: []byte("b:2"), Value: []byte("4")},
+		{Key: []byte("a:1"), Value: []byte("1")},
+		{Key: []byte("b:1"), Value: []byte("3")},
+		{Key: []byte("a:2"), Value: []byte("2")},
+		{Key: []byte("b"), Value: nil},
+		{Key: []byte("b:1"), Value: []byte("5")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix []byte
+		want   []string
+	}{
+		{nil, []string{"a:1", "a:2", "b", "b:1", "b:2"}},
+		{[]byte("b"), []string{"b", "b:1", "b:2"}},
+		{[]byte("b:"), []string{"b:1", "b:2"}},
+		{[]byte("c"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.prefix), func(t *testing.T) {
+			var got []string
+			err := m.RangeKeys(context.Background(), tt.prefix, func(key []byte) error {
+				got = append(got, string(key))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RangeKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	value, exists, err := m.LookupValue([]byte("b:1"))
+	if err != nil || !exists || string(value) != "5" {
+		t.Errorf("LookupValue() = %q, %v, %v", value, exists, err)
+	}
+
+	if err := m.DropAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, _ := m.LookupValue([]byte("b:1")); exists {
+		t.Errorf("LookupValue() after DropAll() exists")
+	}
+}
+
+func TestMemoryDB_concurrent(t *testing.T) {
+	m := newMemoryDB()
+	seq, err := m.GetSequence([]byte("seq"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				next, _ := seq.Next()
+				m.SetKeyValues([]KeyValuePair{{Key: uint64Key(next)}})
+				m.RangeKeys(context.Background(), nil, func(key []byte) error { return nil })
+			}
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	m.RangeKeys(context.Background(), nil, func(key []byte) error {
+		count++
+		return nil
+	})
+	if count != 800 {
+		t.Errorf("RangeKeys() found %d keys, want %d", count, 800)
+	}
+}
+
+func TestMemoryDB_concurrentOverwrite(t *testing.T) {
+	m := newMemoryDB()
+	key := []byte("a")
+	m.SetKeyValues([]KeyValuePair{{Key: key, Value: []byte("0")}})
+
+	// Setting an existing key replaces its value while iterators read it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			m.SetKeyValues([]KeyValuePair{{Key: key, Value: []byte(fmt.Sprint(i))}})
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		it := m.NewIterator(IteratorOptions{Prefix: key})
+		for it.Rewind(); it.Valid(); it.Next() {
+			if _, err := it.Value(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		it.Close()
+	}
+}
+
+func uint64Key(i uint64) []byte {
+	return []byte(fmt.Sprintf("%020d", i))
+}
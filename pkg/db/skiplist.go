@@ -0,0 +1,111 @@
+package db
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel = 24
+	skiplistP        = 0.25
+)
+
+// skiplist is an ordered map of byte keys to byte values. It is not safe for concurrent
+// use.
+type skiplist struct {
+	head  *skiplistNode
+	level int
+	rand  *rand.Rand
+}
+
+type skiplistNode struct {
+	key   []byte
+	value []byte
+	next  []*skiplistNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{next: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(1)),
+	}
+}
+
+func (l *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && l.rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual returns the first node with a key >= key, filling prev with the last
+// node before it on every level when prev is not nil
+func (l *skiplist) findGreaterOrEqual(key []byte, prev []*skiplistNode) *skiplistNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// findLessThan returns the last node with a key < key, or the last node if key is nil. It
+// returns nil if there is no such node.
+func (l *skiplist) findLessThan(key []byte) *skiplistNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && (key == nil || bytes.Compare(x.next[i].key, key) < 0) {
+			x = x.next[i]
+		}
+	}
+	if x == l.head {
+		return nil
+	}
+	return x
+}
+
+// findLessOrEqual returns the last node with a key <= key, or nil if there is none
+func (l *skiplist) findLessOrEqual(key []byte) *skiplistNode {
+	x := l.findGreaterOrEqual(key, nil)
+	if x != nil && bytes.Equal(x.key, key) {
+		return x
+	}
+	return l.findLessThan(key)
+}
+
+func (l *skiplist) get(key []byte) ([]byte, bool) {
+	x := l.findGreaterOrEqual(key, nil)
+	if x != nil && bytes.Equal(x.key, key) {
+		return x.value, true
+	}
+	return nil, false
+}
+
+func (l *skiplist) set(key, value []byte) {
+	prev := make([]*skiplistNode, skiplistMaxLevel)
+	x := l.findGreaterOrEqual(key, prev)
+	if x != nil && bytes.Equal(x.key, key) {
+		x.value = value
+		return
+	}
+
+	level := l.randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			prev[i] = l.head
+		}
+		l.level = level
+	}
+
+	x = &skiplistNode{key: key, value: value, next: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+}
@@ -0,0 +1,263 @@
+package sketch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// HyperLogLog precisions. A sketch with precision p has 2^p registers of one byte and a
+// relative standard error of 1.04 / sqrt(2^p).
+const (
+	MinPrecision     = 4
+	MaxPrecision     = 18
+	DefaultPrecision = 14
+
+	// sparsePrecision is the precision of the sparse representation used while a sketch
+	// has few values
+	sparsePrecision = 25
+)
+
+// ErrPrecisionMismatch is returned when merging sketches with different precisions
+var ErrPrecisionMismatch = errors.New("sketch precisions do not match")
+
+// errInvalidSketch is returned when an encoded sketch can not be decoded
+var errInvalidSketch = errors.New("invalid sketch")
+
+// HyperLogLog estimates the number of distinct values added to it, following
+// HyperLogLog++ (Heule, Nunkesser and Hall): values are hashed to 64 bits and small
+// cardinalities are kept in a sparse representation at a higher precision, which is
+// counted exactly enough with linear counting. Once the sparse representation is larger
+// than the registers it is converted to them. Register estimates use the improved
+// estimator of Ertl, New cardinality estimation algorithms for HyperLogLog sketches, which
+// needs no empirical bias correction. Sketches can be merged.
+type HyperLogLog struct {
+	p         uint8
+	sparse    map[uint32]uint8 // sparse index => rho, nil once the registers are used
+	registers []uint8
+}
+
+// NewHyperLogLog creates an empty sketch with the precision
+func NewHyperLogLog(precision int) (*HyperLogLog, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision %d is not between %d and %d", precision, MinPrecision, MaxPrecision)
+	}
+	return &HyperLogLog{p: uint8(precision), sparse: make(map[uint32]uint8)}, nil
+}
+
+// Precision returns the precision of the sketch
+func (h *HyperLogLog) Precision() int {
+	return int(h.p)
+}
+
+// RelativeError returns the relative standard error of the estimate
+func (h *HyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(uint64(1)<<h.p))
+}
+
+// AddString adds a value to the sketch
+func (h *HyperLogLog) AddString(s string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(s))
+	h.AddHash(mix64(hash.Sum64()))
+}
+
+// AddHash adds a value by its 64 bit hash, which must be spread evenly over all bits
+func (h *HyperLogLog) AddHash(x uint64) {
+	if h.sparse != nil {
+		index := uint32(x >> (64 - sparsePrecision))
+		rho := uint8(bits.LeadingZeros64(x<<sparsePrecision|1<<(sparsePrecision-1))) + 1
+		if rho > h.sparse[index] {
+			h.sparse[index] = rho
+		}
+		if len(h.sparse) > h.maxSparse() {
+			h.toDense()
+		}
+		return
+	}
+
+	index := x >> (64 - h.p)
+	rho := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1))) + 1
+	if rho > h.registers[index] {
+		h.registers[index] = rho
+	}
+}
+
+// Merge adds every value of o to the sketch. Both sketches must have the same precision.
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	if h.p != o.p {
+		return ErrPrecisionMismatch
+	}
+	if h.sparse != nil && o.sparse != nil {
+		for index, rho := range o.sparse {
+			if rho > h.sparse[index] {
+				h.sparse[index] = rho
+			}
+		}
+		if len(h.sparse) > h.maxSparse() {
+			h.toDense()
+		}
+		return nil
+	}
+
+	h.toDense()
+	if o.sparse != nil {
+		for index, rho := range o.sparse {
+			h.addSparseToRegisters(index, rho)
+		}
+		return nil
+	}
+	for i, rho := range o.registers {
+		if rho > h.registers[i] {
+			h.registers[i] = rho
+		}
+	}
+	return nil
+}
+
+// Count returns the estimated number of distinct values
+func (h *HyperLogLog) Count() uint64 {
+	if h.sparse != nil {
+		// Linear counting over the sparse registers, almost all of which are empty
+		m := float64(uint64(1) << sparsePrecision)
+		return uint64(math.Round(m * math.Log(m/(m-float64(len(h.sparse))))))
+	}
+
+	m := float64(len(h.registers))
+	q := 64 - int(h.p)
+	histogram := make([]float64, q+2)
+	for _, rho := range h.registers {
+		histogram[rho]++
+	}
+
+	z := m * tau(1-histogram[q+1]/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + histogram[k])
+	}
+	z += m * sigma(histogram[0]/m)
+	return uint64(math.Round(m * m / (2 * math.Ln2) / z))
+}
+
+// MarshalBinary encodes the sketch so that it can be stored and merged later
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	if h.sparse == nil {
+		return append([]byte{h.p, 1}, h.registers...), nil
+	}
+
+	indexes := make([]uint32, 0, len(h.sparse))
+	for index := range h.sparse {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	b := make([]byte, 2+5*len(indexes))
+	b[0], b[1] = h.p, 0
+	for i, index := range indexes {
+		binary.BigEndian.PutUint32(b[2+5*i:], index)
+		b[2+5*i+4] = h.sparse[index]
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a sketch encoded by MarshalBinary
+func (h *HyperLogLog) UnmarshalBinary(b []byte) error {
+	if len(b) < 2 || b[0] < MinPrecision || b[0] > MaxPrecision {
+		return errInvalidSketch
+	}
+	p, dense, b := b[0], b[1], b[2:]
+	switch dense {
+	case 0:
+		if len(b)%5 != 0 {
+			return errInvalidSketch
+		}
+		sparse := make(map[uint32]uint8, len(b)/5)
+		for ; len(b) > 0; b = b[5:] {
+			sparse[binary.BigEndian.Uint32(b)] = b[4]
+		}
+		*h = HyperLogLog{p: p, sparse: sparse}
+	case 1:
+		if len(b) != 1<<p {
+			return errInvalidSketch
+		}
+		*h = HyperLogLog{p: p, registers: append([]uint8{}, b...)}
+	default:
+		return errInvalidSketch
+	}
+	return nil
+}
+
+// maxSparse is the number of sparse entries after which the registers use less memory
+func (h *HyperLogLog) maxSparse() int {
+	return (1 << h.p) / 4
+}
+
+func (h *HyperLogLog) toDense() {
+	if h.sparse == nil {
+		return
+	}
+	h.registers = make([]uint8, 1<<h.p)
+	for index, rho := range h.sparse {
+		h.addSparseToRegisters(index, rho)
+	}
+	h.sparse = nil
+}
+
+// addSparseToRegisters adds an entry of the sparse representation to the registers. The
+// bits of the sparse index after the first p bits come before the bits rho was counted in.
+func (h *HyperLogLog) addSparseToRegisters(sparseIndex uint32, sparseRho uint8) {
+	extraBits := uint(sparsePrecision - h.p)
+	index := sparseIndex >> extraBits
+	rho := sparseRho + uint8(extraBits)
+	if extra := sparseIndex & (1<<extraBits - 1); extra != 0 {
+		rho = uint8(extraBits) - uint8(bits.Len32(extra)) + 1
+	}
+	if rho > h.registers[index] {
+		h.registers[index] = rho
+	}
+}
+
+// mix64 is the finalizer of MurmurHash3, which spreads the bits of an FNV hash
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		previous := z
+		z += x * y
+		y += y
+		if z == previous {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		previous := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == previous {
+			return z / 3
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package sketch
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog_Count(t *testing.T) {
+	tests := []struct {
+		precision int
+		n         int
+	}{
+		{4, 10},
+		{10, 100},
+		{10, 100000},
+		{14, 1000},
+		{14, 50000},
+		{14, 1000000},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.precision)+"/"+strconv.Itoa(tt.n), func(t *testing.T) {
+			h, err := NewHyperLogLog(tt.precision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.n; i++ {
+				h.AddString(strconv.Itoa(i))
+				h.AddString(strconv.Itoa(i))
+			}
+			got := float64(h.Count())
+			if relErr := math.Abs(got-float64(tt.n)) / float64(tt.n); relErr > 4*h.RelativeError() {
+				t.Errorf("Count() = %v, want %v within %v", got, tt.n, 4*h.RelativeError())
+			}
+		})
+	}
+}
+
+func TestHyperLogLog_Merge(t *testing.T) {
+	a, _ := NewHyperLogLog(12)
+	b, _ := NewHyperLogLog(12)
+	all, _ := NewHyperLogLog(12)
+	for i := 0; i < 20000; i++ {
+		value := strconv.Itoa(i)
+		all.AddString(value)
+		if i%3 == 0 {
+			a.AddString(value)
+		} else {
+			b.AddString(value)
+		}
+	}
+
+	// A sparse sketch merged into a dense one gives the same registers as adding its values
+	small, _ := NewHyperLogLog(12)
+	for i := 0; i < 10; i++ {
+		small.AddString(strconv.Itoa(i))
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(small); err != nil {
+		t.Fatal(err)
+	}
+	if a.Count() != all.Count() {
+		t.Errorf("Count() of merged sketch = %v, want %v", a.Count(), all.Count())
+	}
+
+	other, _ := NewHyperLogLog(13)
+	if err := a.Merge(other); err != ErrPrecisionMismatch {
+		t.Errorf("Merge() error = %v, want %v", err, ErrPrecisionMismatch)
+	}
+}
+
+func TestHyperLogLog_MarshalBinary(t *testing.T) {
+	for _, n := range []int{0, 10, 10000} {
+		h, _ := NewHyperLogLog(10)
+		for i := 0; i < n; i++ {
+			h.AddString(strconv.Itoa(i))
+		}
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got HyperLogLog
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&got, h) {
+			t.Errorf("UnmarshalBinary(MarshalBinary()) of %d values = %v, want %v", n, got, h)
+		}
+	}
+
+	var h HyperLogLog
+	if err := h.UnmarshalBinary([]byte{10, 1, 0}); err != errInvalidSketch {
+		t.Errorf("UnmarshalBinary() error = %v, want %v", err, errInvalidSketch)
+	}
+}
+
+func TestNewHyperLogLog_precision(t *testing.T) {
+	for _, precision := range []int{MinPrecision - 1, MaxPrecision + 1} {
+		if _, err := NewHyperLogLog(precision); err == nil {
+			t.Errorf("NewHyperLogLog(%d) error = nil", precision)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package sketch implements mergeable summaries of large streams of values
+package sketch
+
+import (
+	"math"
+	"sort"
+)
+
+// DefaultCompression gives quantiles within about 1% of the rank in the middle of the
+// distribution and much closer at the tails
+const DefaultCompression = 100
+
+// Centroid is the mean of Weight values
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest estimates quantiles of weighted values. Values are kept in centroids which are
+// small at the tails and larger in the middle of the distribution, so that the tails are
+// accurate with little memory. Digests can be merged.
+//
+// See Dunning and Ertl, Computing Extremely Accurate Quantiles Using t-Digests.
+type TDigest struct {
+	compression float64
+	centroids   []Centroid // merged centroids sorted by mean
+	unmerged    []Centroid
+	count       float64
+	min, max    float64
+}
+
+// NewTDigest creates an empty digest. A larger compression keeps more centroids and gives
+// more accurate quantiles.
+func NewTDigest(compression float64) *TDigest {
+	if compression < 1 {
+		compression = DefaultCompression
+	}
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// Add adds the value with the weight. Values with a weight which is not positive are
+// ignored.
+func (t *TDigest) Add(x, weight float64) {
+	if weight <= 0 || math.IsNaN(x) {
+		return
+	}
+	t.unmerged = append(t.unmerged, Centroid{Mean: x, Weight: weight})
+	t.count += weight
+	t.min = math.Min(t.min, x)
+	t.max = math.Max(t.max, x)
+	if len(t.unmerged) > 8*int(t.compression) {
+		t.compress()
+	}
+}
+
+// Merge adds every value of o to the digest
+func (t *TDigest) Merge(o *TDigest) {
+	o.compress()
+	if len(o.centroids) == 0 {
+		return
+	}
+	t.unmerged = append(t.unmerged, o.centroids...)
+	t.count += o.count
+	t.min = math.Min(t.min, o.min)
+	t.max = math.Max(t.max, o.max)
+	t.compress()
+}
+
+// Count returns the total weight of the values
+func (t *TDigest) Count() float64 {
+	return t.count
+}
+
+// Centroids returns the centroids of the digest sorted by mean
+func (t *TDigest) Centroids() []Centroid {
+	t.compress()
+	return append([]Centroid{}, t.centroids...)
+}
+
+// Quantile returns the estimated value at the quantile q between 0 and 1. NaN is returned
+// for an empty digest.
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+
+	// Values are assumed to be spread evenly around the mean of each centroid, so the
+	// quantile is interpolated between the means of the centroids either side of it.
+	index := q * t.count
+	first := t.centroids[0]
+	if index < first.Weight/2 {
+		return t.min + index/(first.Weight/2)*(first.Mean-t.min)
+	}
+
+	cumulative := 0.0
+	for i := 0; i < len(t.centroids)-1; i++ {
+		left, right := t.centroids[i], t.centroids[i+1]
+		leftCenter := cumulative + left.Weight/2
+		rightCenter := cumulative + left.Weight + right.Weight/2
+		if index <= rightCenter {
+			return left.Mean + (index-leftCenter)/(rightCenter-leftCenter)*(right.Mean-left.Mean)
+		}
+		cumulative += left.Weight
+	}
+
+	last := t.centroids[len(t.centroids)-1]
+	lastCenter := t.count - last.Weight/2
+	return last.Mean + (index-lastCenter)/(t.count-lastCenter)*(t.max-last.Mean)
+}
+
+// compress merges the unmerged values into the centroids. Neighbouring centroids are
+// combined while the combined centroid spans less than one unit of the scale function.
+func (t *TDigest) compress() {
+	if len(t.unmerged) == 0 {
+		return
+	}
+	all := append(t.centroids, t.unmerged...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Mean < all[j].Mean
+	})
+
+	merged := make([]Centroid, 0, len(t.centroids)+1)
+	current := all[0]
+	weightSoFar := 0.0
+	weightLimit := t.count * t.scaleInverse(t.scale(0)+1)
+	for _, c := range all[1:] {
+		if weightSoFar+current.Weight+c.Weight <= weightLimit {
+			current.Weight += c.Weight
+			current.Mean += (c.Mean - current.Mean) * c.Weight / current.Weight
+			continue
+		}
+		weightSoFar += current.Weight
+		merged = append(merged, current)
+		weightLimit = t.count * t.scaleInverse(t.scale(weightSoFar/t.count)+1)
+		current = c
+	}
+	t.centroids = append(merged, current)
+	t.unmerged = nil
+}
+
+// scale is the k1 scale function, which keeps centroids small near q = 0 and q = 1
+func (t *TDigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (t *TDigest) scaleInverse(k float64) float64 {
+	if k >= t.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/t.compression) + 1) / 2
+}
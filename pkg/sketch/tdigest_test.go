@@ -0,0 +1,94 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestTDigest_Quantile_small(t *testing.T) {
+	td := NewTDigest(DefaultCompression)
+	if got := td.Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("Quantile() of empty digest = %v, want NaN", got)
+	}
+
+	for _, x := range []float64{3, 1, 2} {
+		td.Add(x, 1)
+	}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 1},
+		{0.5, 2},
+		{1, 3},
+	}
+	for _, tt := range tests {
+		if got := td.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	if td.Count() != 3 {
+		t.Errorf("Count() = %v, want 3", td.Count())
+	}
+}
+
+func TestTDigest_Quantile_weighted(t *testing.T) {
+	td := NewTDigest(DefaultCompression)
+	td.Add(1, 1)
+	td.Add(10, 9)
+	if got := td.Quantile(0.05); got != 1 {
+		t.Errorf("Quantile(0.05) = %v, want 1", got)
+	}
+	if got := td.Quantile(0.9); got != 10 {
+		t.Errorf("Quantile(0.9) = %v, want 10", got)
+	}
+}
+
+func TestTDigest_Quantile_accuracy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	values := make([]float64, 100000)
+	td := NewTDigest(DefaultCompression)
+	for i := range values {
+		values[i] = rnd.ExpFloat64()
+		td.Add(values[i], 1)
+	}
+	sort.Float64s(values)
+
+	if n := len(td.Centroids()); n > 2*DefaultCompression {
+		t.Errorf("len(Centroids()) = %d, want at most %d", n, 2*DefaultCompression)
+	}
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		got := td.Quantile(q)
+		// Compare ranks, since the error of a t-digest is bounded in quantile space
+		rank := float64(sort.SearchFloat64s(values, got)) / float64(len(values))
+		if math.Abs(rank-q) > 0.01*math.Max(math.Min(q, 1-q)*4, 0.1) {
+			t.Errorf("Quantile(%v) = %v has rank %v", q, got, rank)
+		}
+	}
+}
+
+func TestTDigest_Merge(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	all := NewTDigest(DefaultCompression)
+	parts := []*TDigest{NewTDigest(DefaultCompression), NewTDigest(DefaultCompression), NewTDigest(DefaultCompression)}
+	for i := 0; i < 30000; i++ {
+		x := rnd.NormFloat64()
+		all.Add(x, 1)
+		parts[i%len(parts)].Add(x, 1)
+	}
+
+	merged := NewTDigest(DefaultCompression)
+	for _, part := range parts {
+		merged.Merge(part)
+	}
+	if merged.Count() != all.Count() {
+		t.Errorf("Count() = %v, want %v", merged.Count(), all.Count())
+	}
+	for _, q := range []float64{0, 0.01, 0.5, 0.99, 1} {
+		if got, want := merged.Quantile(q), all.Quantile(q); math.Abs(got-want) > 0.02 {
+			t.Errorf("Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+}
@@ -1,9 +1,19 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
+	"regexp"
+	"regexp/syntax"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -29,8 +39,9 @@ func init() {
 
 // API serves the store API
 type API struct {
-	Store *Store
-	Debug bool
+	Store        *Store
+	Debug        bool
+	QueryTimeout time.Duration // the longest a query can run, zero is unlimited
 }
 
 func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -48,6 +59,10 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case method == "POST" && path == APIPathEvents:
 		a.handlePostEvents(w, r)
+	case method == "GET" && path == APIPathEvents:
+		a.handleGetEvents(w, r)
+	case method == "GET" && strings.HasPrefix(path, APIPathEvents+"/"):
+		a.handleGetEvent(w, r)
 	case method == "POST" && path == APIPathQuery:
 		a.handleQuery(w, r)
 	case method == "POST" && path == APIDebug:
@@ -79,76 +94,761 @@ type Events struct {
 	Events []Event `json:"events"`
 }
 
-// Event is one sampled event
+// Event is one sampled event. String and numeric values are both given in the data object
+// of the JSON form, e.g. {"path": "/home", "duration_ms": 512}. A number is in Numbers and
+// its JSON form is also kept in Data, so it is stored and returned as it was written. A
+// null value is missing.
 type Event struct {
-	Tag        string            `json:"tag"`
-	TS         uint64            `json:"ts"`
-	Samplerate int               `json:"samplerate"`
-	Data       map[string]string `json:"data"`
+	Tag        string
+	TS         uint64
+	Samplerate int
+	Data       map[string]string
+	Numbers    map[string]float64
+}
+
+// eventJSON is the JSON form of an event
+type eventJSON struct {
+	Tag        string                     `json:"tag"`
+	TS         uint64                     `json:"ts"`
+	Samplerate int                        `json:"samplerate"`
+	Data       map[string]json.RawMessage `json:"data"`
+}
+
+// UnmarshalJSON reads an event, putting string values in Data and numbers in Numbers and
+// Data
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var aux eventJSON
+	err := json.Unmarshal(b, &aux)
+	if err != nil {
+		return err
+	}
+
+	*e = Event{Tag: aux.Tag, TS: aux.TS, Samplerate: aux.Samplerate}
+	for dimension, raw := range aux.Data {
+		if bytes.Equal(raw, []byte("null")) {
+			continue
+		}
+		value, number, isNumber, err := decodeScalar(raw)
+		if err != nil {
+			return fmt.Errorf("event data %q: %w", dimension, err)
+		}
+		if isNumber {
+			if e.Numbers == nil {
+				e.Numbers = make(map[string]float64)
+			}
+			e.Numbers[dimension] = number
+		}
+		if e.Data == nil {
+			e.Data = make(map[string]string)
+		}
+		e.Data[dimension] = value
+	}
+	return nil
+}
+
+// MarshalJSON writes the event with its string and numeric values in one data object
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.toJSON())
+}
+
+func (e Event) toJSON() eventJSON {
+	data := make(map[string]json.RawMessage, len(e.Data)+len(e.Numbers))
+	for dimension, value := range e.Data {
+		data[dimension], _ = json.Marshal(value)
+	}
+	for dimension, number := range e.Numbers {
+		if text, ok := e.Data[dimension]; ok {
+			data[dimension] = json.RawMessage(text)
+			continue
+		}
+		data[dimension] = json.RawMessage(formatNumber(number))
+	}
+	return eventJSON{Tag: e.Tag, TS: e.TS, Samplerate: e.Samplerate, Data: data}
+}
+
+// values returns every value of the event as a string, with numbers in their JSON form or
+// their decimal form when it is not kept
+func (e Event) values() map[string]string {
+	values := make(map[string]string, len(e.Data)+len(e.Numbers))
+	for dimension, number := range e.Numbers {
+		values[dimension] = formatNumber(number)
+	}
+	for dimension, value := range e.Data {
+		values[dimension] = value
+	}
+	return values
+}
+
+// formatNumber returns the decimal form of a number, which is also its JSON form
+func formatNumber(number float64) string {
+	b, err := json.Marshal(number)
+	if err != nil {
+		return strconv.FormatFloat(number, 'g', -1, 64)
+	}
+	return string(b)
+}
+
+// decodeScalar decodes a JSON string or number. A number is also returned in its JSON form
+// and null is returned as an empty string.
+func decodeScalar(raw json.RawMessage) (value string, number float64, isNumber bool, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var v interface{}
+	err = decoder.Decode(&v)
+	if err != nil {
+		return "", 0, false, err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", 0, false, nil
+	case string:
+		return v, 0, false, nil
+	case json.Number:
+		number, err = strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return "", 0, false, err
+		}
+		return string(v), number, true, nil
+	default:
+		return "", 0, false, errors.New("must be a string or a number")
+	}
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error    ErrorResponseData `json:"error"`
+	Progress *QueryProgress    `json:"progress,omitempty"` // how far a query got before it timed out
+}
+
+// statusClientClosedRequest is recorded for requests whose client went away
+const statusClientClosedRequest = 499
+
+// ErrorResponseData describes an error
+type ErrorResponseData struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorResponseData{Code: code, Message: err.Error()}})
+}
+
+// writeStoreError writes an error returned by the store with the status code for its type.
+// A timed out query also returns its progress.
+func writeStoreError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(storeErrorCode(err))
+	json.NewEncoder(w).Encode(storeErrorResponse(err))
+}
+
+func storeErrorResponse(err error) ErrorResponse {
+	response := ErrorResponse{Error: ErrorResponseData{Code: storeErrorCode(err), Message: err.Error()}}
+	var timeoutErr *QueryTimeoutError
+	if errors.As(err, &timeoutErr) {
+		response.Progress = &timeoutErr.Progress
+	}
+	return response
+}
+
+// storeErrorCode returns the status code for an error returned by the store
+func storeErrorCode(err error) int {
+	var invalidQueryErr *InvalidQueryError
+	switch {
+	case errors.As(err, &invalidQueryErr):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	}
+	return http.StatusInternalServerError
 }
 
 func (a *API) handlePostEvents(w http.ResponseWriter, r *http.Request) {
 	var payload Events
 	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	a.Store.IngestEvents(payload.Events)
+	err = a.Store.IngestEvents(r.Context(), payload.Events)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+}
+
+// handleGetEvent returns the event with the ID in the path, e.g. /events/123
+func (a *API) handleGetEvent(w http.ResponseWriter, r *http.Request) {
+	eventID, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, APIPathEvents+"/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid event id: %s", err))
+		return
+	}
+
+	event, exists, err := a.Store.LookupEvent(eventID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Errorf("event %d not found", eventID))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+// handleGetEvents returns the events with the comma separated IDs, e.g. /events?ids=1,2,3.
+// IDs which do not exist are left out.
+func (a *API) handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	var eventIDs []uint64
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id == "" {
+			continue
+		}
+		eventID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid event id: %s", err))
+			return
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+
+	events, err := a.Store.LookupEvents(r.Context(), eventIDs)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StoredEvents{Events: events})
 }
 
 // Query is a query to the store
 type Query struct {
-	Data []Data `json:"data"`
+	Start   uint64  `json:"start"` // ts in ms, inclusive
+	End     uint64  `json:"end"`   // ts in ms, exclusive. Zero is unbounded
+	Data    []Data  `json:"data"`
+	Funnel  *Funnel `json:"funnel"`
+	Timeout string  `json:"timeout"` // e.g. 10s, the server timeout still applies when it is shorter
+
+	// Explain returns the steps each data block would be executed with in its meta under
+	// plan, without running the query. Profile runs the query and returns the steps with
+	// what each of them did in the meta under profile.
+	Explain bool `json:"explain"`
+	Profile bool `json:"profile"`
+
+	// Formulas are evaluated over the meta of the data blocks once every block is done
+	Formulas []Formula `json:"formulas"`
 }
 
 // Data is ...
 type Data struct {
 	Name       string      `json:"name"`
-	Tag        string      `json:"tag"` // e.g. page_view
-	Keys       []string    `json:"keys"`
+	Tag        string      `json:"tag"`   // e.g. page_view
+	Start      uint64      `json:"start"` // overrides the query start when set
+	End        uint64      `json:"end"`   // overrides the query end when set
+	Keys       []string    `json:"keys"`  // ["*"] returns every dimension
 	Filters    []Filter    `json:"filters"`
 	Operations []Operation `json:"operations"`
 	HideData   bool        `json:"hideData"`
+
+	// Granularity returns the operations as a time series of buckets, e.g. 1m, 1h or 1d
+	Granularity string `json:"granularity"`
+
+	// Pagination of the events. Operations are applied to every event, not only the page.
+	Limit  int    `json:"limit"`  // max events in the result, zero is unlimited
+	Order  string `json:"order"`  // asc | desc by ts, defaults to ID order
+	Cursor string `json:"cursor"` // the cursor of the previous page, for the next page
+}
+
+// requiredKeys returns the keys to fetch for the events, which are the data keys followed by
+// the keys read by the operations
+func (d Data) requiredKeys() []string {
+	keys := append([]string{}, d.Keys...)
+	for _, operation := range d.Operations {
+		keys = append(keys, operation.keys()...)
+	}
+	return keys
+}
+
+// resultEvents returns the events without the data fetched only for the operations, the
+// funnel or the in_result filters of other blocks. The data keys and the keys of the
+// filters which add their key are returned, or every key with *.
+func (d Data) resultEvents(events []DecodedEvent, keys []string) []DecodedEvent {
+	if d.allKeys() {
+		return events
+	}
+	returned := make(map[string]struct{})
+	for _, key := range d.Keys {
+		returned[key] = struct{}{}
+	}
+	for _, filter := range d.Filters {
+		if filter.addsKey() {
+			returned[filter.Key] = struct{}{}
+		}
+	}
+	extra := false
+	for _, key := range keys {
+		if _, ok := returned[key]; !ok {
+			extra = true
+		}
+	}
+	if !extra {
+		return events
+	}
+
+	stripped := make([]DecodedEvent, len(events))
+	for i, event := range events {
+		eventData := make([]DecodedEventData, 0, len(event.Data))
+		for _, data := range event.Data {
+			if _, ok := returned[data.Key]; ok {
+				eventData = append(eventData, data)
+			}
+		}
+		event.Data = eventData
+		stripped[i] = event
+	}
+	return stripped
+}
+
+// allKeys is the data key which returns every dimension of the events
+const allKeys = "*"
+
+// allKeys returns whether every dimension of the events should be returned
+func (d Data) allKeys() bool {
+	for _, key := range d.Keys {
+		if key == allKeys {
+			return true
+		}
+	}
+	return false
+}
+
+// timeRange returns the time range of the data, falling back to the query time range
+func (d Data) timeRange(query Query) timeRange {
+	r := timeRange{start: query.Start, end: query.End}
+	if d.Start != 0 {
+		r.start = d.Start
+	}
+	if d.End != 0 {
+		r.end = d.End
+	}
+	return r
 }
 
-// Filter is a filter on a dimension
+// Filter is a filter on a dimension or a boolean combination of filters. Events missing the
+// dimension match the negated filters neq, not_in and not_exists.
 type Filter struct {
-	Type  string `json:"type"`  // eq | regex
-	Key   string `json:"key"`   // e.g. path
-	Value string `json:"value"` // e.g. /home
+	Type    string   `json:"type"`    // eq | neq | in | not_in | prefix | contains | regex | exists | not_exists | gt | gte | lt | lte | between | in_result | and | or | not
+	Key     string   `json:"key"`     // e.g. path
+	Value   string   `json:"value"`   // e.g. /home or 500
+	Values  []string `json:"values"`  // for in, not_in and between (inclusive lower and upper bound)
+	Filters []Filter `json:"filters"` // for and, or and not (exactly one)
+
+	// in_result matches the events whose key is a value of DataKey, which defaults to Key,
+	// in the events of the data block named Data
+	Data    string `json:"data,omitempty"`
+	DataKey string `json:"dataKey,omitempty"`
+
+	// The regex of a regex filter and the literal prefix of the values it can match, set
+	// when the filter is compiled
+	regex       *regexp.Regexp
+	regexPrefix string
+
+	// The values of an in filter resolved from an in_result filter with many values, which
+	// are matched while scanning the dimension, and the number of events they were read from
+	valueSet     map[string]struct{}
+	resultEvents int
+}
+
+// UnmarshalJSON reads a filter, accepting numbers as well as strings for the values
+func (f *Filter) UnmarshalJSON(b []byte) error {
+	type filter Filter
+	var aux struct {
+		filter
+		Value  json.RawMessage   `json:"value"`
+		Values []json.RawMessage `json:"values"`
+	}
+	err := json.Unmarshal(b, &aux)
+	if err != nil {
+		return err
+	}
+
+	*f = Filter(aux.filter)
+	if aux.Value != nil {
+		f.Value, _, _, err = decodeScalar(aux.Value)
+		if err != nil {
+			return fmt.Errorf("filter value: %w", err)
+		}
+	}
+	for _, raw := range aux.Values {
+		value, _, _, err := decodeScalar(raw)
+		if err != nil {
+			return fmt.Errorf("filter values: %w", err)
+		}
+		f.Values = append(f.Values, value)
+	}
+	return nil
+}
+
+// compile checks the type and values of the filter and its children, and returns a copy
+// of the filter with every regex compiled so that it is only compiled once per query
+func (f Filter) compile(dataName string) (Filter, error) {
+	switch f.Type {
+	case "and", "or", "not":
+		if len(f.Filters) == 0 {
+			return Filter{}, invalidQueryf("%s filter in %q has no filters", f.Type, dataName)
+		}
+		if f.Type == "not" && len(f.Filters) != 1 {
+			return Filter{}, invalidQueryf("not filter in %q must have exactly one filter", dataName)
+		}
+		filters := make([]Filter, len(f.Filters))
+		for i, filter := range f.Filters {
+			var err error
+			filters[i], err = filter.compile(dataName)
+			if err != nil {
+				return Filter{}, err
+			}
+		}
+		f.Filters = filters
+	case "gt", "gte", "lt", "lte", "between":
+		_, err := f.numberRange(dataName)
+		if err != nil {
+			return Filter{}, err
+		}
+	case "regex":
+		regex, err := regexp.Compile(f.Value)
+		if err != nil {
+			return Filter{}, invalidQueryf("regex filter on %q in %q has invalid regex: %s", f.Key, dataName, err)
+		}
+		f.regex, f.regexPrefix = regex, anchoredLiteralPrefix(f.Value)
+	case "eq", "neq", "in", "not_in", "prefix", "contains", "exists", "not_exists", "in_result":
+	default:
+		return Filter{}, invalidQueryf("unsupported filter type %q in %q", f.Type, dataName)
+	}
+	return f, nil
+}
+
+// anchoredLiteralPrefix returns the literal every match of a regex anchored to the start of
+// the text begins with, e.g. /api/ for ^/api/.*, so that only the values with the prefix
+// have to be read
+func anchoredLiteralPrefix(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var prefix strings.Builder
+	for _, sub := range re.Sub[1:] {
+		if !appendLiteralPrefix(&prefix, sub) {
+			break
+		}
+	}
+	return prefix.String()
+}
+
+// appendLiteralPrefix appends the literal text every match of re starts with, and reports
+// whether that is all of re so that the text of the next expression can follow it
+func appendLiteralPrefix(prefix *strings.Builder, re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return false
+		}
+		prefix.WriteString(string(re.Rune))
+		return true
+	case syntax.OpCapture:
+		return appendLiteralPrefix(prefix, re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !appendLiteralPrefix(prefix, sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpEmptyMatch:
+		return true
+	}
+	return false
+}
+
+// addsKey reports whether the filter adds the value of its key to the events it matches
+func (f Filter) addsKey() bool {
+	switch f.Type {
+	case "and", "or", "not", "neq", "not_in", "not_exists":
+		return false
+	}
+	return true
+}
+
+// numberRange returns the numbers matched by a gt, gte, lt, lte or between filter
+func (f Filter) numberRange(dataName string) (numberRange, error) {
+	parse := func(value string) (float64, error) {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) {
+			return 0, invalidQueryf("%s filter on %q in %q has invalid number %q", f.Type, f.Key, dataName, value)
+		}
+		return number, nil
+	}
+
+	n := numberRange{start: math.Inf(-1), end: math.Inf(1)}
+	if f.Type == "between" {
+		if len(f.Values) != 2 {
+			return numberRange{}, invalidQueryf("between filter on %q in %q must have two values", f.Key, dataName)
+		}
+		start, err := parse(f.Values[0])
+		if err != nil {
+			return numberRange{}, err
+		}
+		end, err := parse(f.Values[1])
+		if err != nil {
+			return numberRange{}, err
+		}
+		n.start, n.end = start, math.Nextafter(end, math.Inf(1))
+		return n, nil
+	}
+
+	number, err := parse(f.Value)
+	if err != nil {
+		return numberRange{}, err
+	}
+	switch f.Type {
+	case "gt":
+		n.start = math.Nextafter(number, math.Inf(1))
+	case "gte":
+		n.start = number
+	case "lt":
+		n.end = number
+	case "lte":
+		n.end = math.Nextafter(number, math.Inf(1))
+	}
+	return n, nil
 }
 
 // Operation operates on data
 type Operation struct {
-	Type string `json:"type"` // count | unique | group_by
+	Type string `json:"type"` // count | uniqueCount | approxUniqueCount | sum | avg | min | max | stddev | p50 | p90 | p99 | pNN | percentile | group_by
 	Key  string `json:"key"`  // e.g. user_id
+	Name string `json:"name"` // name of the result in meta, defaults to the type
+
+	// percentile
+	Percentile float64 `json:"percentile"` // between 0 and 100, e.g. 99.9
+
+	// uniqueCount and approxUniqueCount, counting the combined values of Key and Keys
+	Missing   string `json:"missing"`   // skip | null, whether events missing a key are skipped or counted with a null value
+	Precision int    `json:"precision"` // approxUniqueCount only, between 4 and 18, defaults to 14 with a standard error of 0.8%
+
+	// group_by
+	Keys       []string    `json:"keys"`       // e.g. [path, status_code], also counted by uniqueCount
+	Operations []Operation `json:"operations"` // applied to each group
+	OrderBy    string      `json:"orderBy"`    // name of a group result, defaults to the group keys
+	Order      string      `json:"order"`      // asc | desc, defaults to desc with orderBy
+	Limit      int         `json:"limit"`      // top N groups, zero is unlimited
+	Other      bool        `json:"other"`      // add the groups after the limit as one "other" group
+}
+
+// metaName returns the name of the result of the operation in meta
+func (o Operation) metaName() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return o.Type
+}
+
+// keys returns the keys the operation reads from the events
+func (o Operation) keys() []string {
+	var keys []string
+	if o.Key != "" {
+		keys = append(keys, o.Key)
+	}
+	keys = append(keys, o.Keys...)
+	for _, operation := range o.Operations {
+		keys = append(keys, operation.keys()...)
+	}
+	return keys
 }
 
 func (a *API) handleQuery(w http.ResponseWriter, r *http.Request) {
-	var query Query
-	err := json.NewDecoder(r.Body).Decode(&query)
+	query, text, err := readQuery(r)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Queries stop when the client goes away or the server timeout passes
+	ctx := r.Context()
+	if a.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.QueryTimeout)
+		defer cancel()
+	}
+
+	if acceptsNDJSON(r) {
+		a.streamQuery(ctx, w, query)
 		return
 	}
 
-	eventIDs := a.Store.QueryEvents(query)
+	result, err := a.Store.QueryEvents(ctx, query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if text {
+		result.Query, _ = FormatQuery(query)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(eventIDs)
+	json.NewEncoder(w).Encode(result)
+}
+
+// readQuery reads a JSON query, or a text query when the body is text/plain. text reports
+// whether the query was text.
+func readQuery(r *http.Request) (query Query, text bool, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/plain" {
+		err = json.NewDecoder(r.Body).Decode(&query)
+		return query, false, err
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Query{}, true, err
+	}
+	query, err = ParseQuery(string(body), time.Now())
+	return query, true, err
+}
+
+// ndjsonContentType is the content type of streamed query responses
+const ndjsonContentType = "application/x-ndjson"
+
+// streamFlushEvents is the number of events written between flushes of a streamed response
+const streamFlushEvents = 1000
+
+// These are the lines of a streamed query response. Each data block is written as one
+// event line per event followed by a meta line, and the response ends with a funnel line
+// when the query has a funnel and a formulas line when it has formulas. An error after the
+// response has started is written as an error line.
+type streamEventLine struct {
+	Type  string       `json:"type"` // event
+	Name  string       `json:"name"`
+	Event DecodedEvent `json:"event"`
+}
+
+type streamMetaLine struct {
+	Type   string                 `json:"type"` // meta
+	Name   string                 `json:"name"`
+	Meta   map[string]interface{} `json:"meta"`
+	Cursor string                 `json:"cursor,omitempty"`
+}
+
+type streamFunnelLine struct {
+	Type   string        `json:"type"` // funnel
+	Funnel *FunnelResult `json:"funnel"`
+}
+
+type streamFormulasLine struct {
+	Type     string                 `json:"type"` // formulas
+	Formulas map[string]interface{} `json:"formulas"`
+}
+
+type streamErrorLine struct {
+	Type     string            `json:"type"` // error
+	Error    ErrorResponseData `json:"error"`
+	Progress *QueryProgress    `json:"progress,omitempty"`
+}
+
+// acceptsNDJSON reports whether the request accepts a streamed NDJSON response
+func acceptsNDJSON(r *http.Request) bool {
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		if mediaType == ndjsonContentType || mediaType == "application/ndjson" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamQuery writes the events of each data block as they are read and its meta as soon as
+// it is resolved, flushing as it goes so that clients can process large results
+// incrementally
+func (a *API) streamQuery(ctx context.Context, w http.ResponseWriter, query Query) {
+	encoder := json.NewEncoder(w)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	events := 0
+	writeEvent := func(dataName string, event DecodedEvent) error {
+		start()
+		err := encoder.Encode(streamEventLine{Type: "event", Name: dataName, Event: event})
+		if err != nil {
+			return err
+		}
+		events++
+		if events%streamFlushEvents == 0 {
+			flush()
+		}
+		return nil
+	}
+	result, err := a.Store.StreamQueryEvents(ctx, query, writeEvent, func(data QueryResultData) error {
+		start()
+		err := encoder.Encode(streamMetaLine{Type: "meta", Name: data.Name, Meta: data.Meta, Cursor: data.Cursor})
+		flush()
+		return err
+	})
+	if err != nil {
+		if !started {
+			writeStoreError(w, err)
+			return
+		}
+		response := storeErrorResponse(err)
+		encoder.Encode(streamErrorLine{Type: "error", Error: response.Error, Progress: response.Progress})
+		flush()
+		return
+	}
+
+	start()
+	if result.Funnel != nil {
+		encoder.Encode(streamFunnelLine{Type: "funnel", Funnel: result.Funnel})
+	}
+	if result.Formulas != nil {
+		encoder.Encode(streamFormulasLine{Type: "formulas", Formulas: result.Formulas})
+	}
+	flush()
 }
 
 func (a *API) handleDebug(w http.ResponseWriter, r *http.Request) {
 	if !a.Debug {
-		http.Error(w, "Debug mode is not enabled", 503)
+		writeError(w, http.StatusServiceUnavailable, errors.New("Debug mode is not enabled"))
+		return
 	}
 
 	if r.URL.Query().Get("wipe") != "" {
-		a.Store.DB.DropAll()
+		err := a.Store.DropAll()
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
 		w.WriteHeader(200)
 		return
 	}
 
-	http.Error(w, "Invalid params", 400)
+	writeError(w, http.StatusBadRequest, errors.New("Invalid params"))
 }
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPI_handleQuery_stream(t *testing.T) {
+	api := &API{Store: newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"path": "/a"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"path": "/b"}},
+		{Tag: "tag2", TS: 1003, Data: map[string]string{"path": "/a"}},
+	})}
+
+	query := `{"data": [
+		{"name": "a", "tag": "tag1", "keys": ["path"], "operations": [{"type": "count"}]},
+		{"name": "b", "tag": "tag2", "keys": ["path"]}
+	], "formulas": [{"name": "half", "expression": "a.count / 2"}]}`
+	req := httptest.NewRequest("POST", APIPathQuery, strings.NewReader(query))
+	req.Header.Set("Accept", "application/json;q=0.5, application/x-ndjson")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ndjsonContentType || !w.Flushed {
+		t.Fatalf("ServeHTTP() = %d %q flushed %v", w.Code, w.Header().Get("Content-Type"), w.Flushed)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line struct {
+			Type     string       `json:"type"`
+			Name     string       `json:"name"`
+			Event    DecodedEvent `json:"event"`
+			Meta     M            `json:"meta"`
+			Formulas M            `json:"formulas"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		switch line.Type {
+		case "event":
+			lines = append(lines, line.Type+" "+line.Name+" "+line.Event.Data[0].Value)
+		case "meta":
+			lines = append(lines, line.Type+" "+line.Name+" "+strings.Join(sortedKeys(line.Meta), ","))
+		case "formulas":
+			lines = append(lines, fmt.Sprintf("%s %v", line.Type, line.Formulas["half"]))
+		}
+	}
+	want := []string{"event a /a", "event a /b", "meta a count,countError,countSamples", "event b /a", "meta b ", "formulas 1"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ServeHTTP() lines = %q, want %q", lines, want)
+	}
+
+	// Errors before the first block are returned as a normal error response
+	req = httptest.NewRequest("POST", APIPathQuery, strings.NewReader(`{"data": [{"tag": "tag1", "filters": [{"type": "unknown"}]}]}`))
+	req.Header.Set("Accept", ndjsonContentType)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("ServeHTTP() of invalid query = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Errors after the first block are written as the last line
+	req = httptest.NewRequest("POST", APIPathQuery, strings.NewReader(`{"data": [{"tag": "tag1"}, {"tag": "tag1", "filters": [{"type": "unknown"}]}]}`))
+	req.Header.Set("Accept", ndjsonContentType)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	body := strings.TrimSpace(w.Body.String())
+	if last := body[strings.LastIndex(body, "\n")+1:]; w.Code != http.StatusOK || !strings.HasPrefix(last, `{"type":"error","error":{"code":400`) {
+		t.Errorf("ServeHTTP() of query failing after the first block = %d, last line %s", w.Code, last)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestAPI_handleQuery_timeout(t *testing.T) {
+	api := &API{Store: newTestStore(t, []Event{{Tag: "tag1", TS: 1001, Data: map[string]string{"path": "/a"}}}), QueryTimeout: time.Nanosecond}
+
+	req := httptest.NewRequest("POST", APIPathQuery, strings.NewReader(`{"data": [{"tag": "tag1"}]}`))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	var response ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusGatewayTimeout || response.Error.Code != http.StatusGatewayTimeout || response.Progress == nil {
+		t.Errorf("ServeHTTP() of timed out query = %d %s", w.Code, w.Body.String())
+	}
+
+	// A per-query timeout can not be longer than the server timeout
+	api.QueryTimeout = time.Minute
+	req = httptest.NewRequest("POST", APIPathQuery, strings.NewReader(`{"timeout": "1ns", "data": [{"tag": "tag1"}]}`))
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("ServeHTTP() of query with timeout = %d %s", w.Code, w.Body.String())
+	}
+}
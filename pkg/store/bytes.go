@@ -4,8 +4,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"math"
 )
 
+// Keys are built from components that may contain any byte. Each component is escaped so
+// that 0x00 is written as 0x00 0xFF and is then terminated with 0x00 0x01. This keeps the
+// byte ordering of the components, and the escaped form of a string is a prefix of the
+// escaped form of every string that starts with it.
+const (
+	keyEscape     byte = 0x00
+	keyTerminator byte = 0x01
+	keyEscapedNul byte = 0xFF
+)
+
+// errInvalidKey is returned when a key can not be decoded
+var errInvalidKey = errors.New("invalid key")
+
 func uint64ToBytes(i uint64) []byte {
 	var buf [8]byte
 	binary.BigEndian.PutUint64(buf[:], i)
@@ -16,6 +31,32 @@ func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
+// float64ToBytes encodes f so that the byte order of the encoded values is the numeric
+// order. The sign bit is flipped for positive numbers and every bit is flipped for negative
+// numbers. -0 is encoded as 0.
+func float64ToBytes(f float64) []byte {
+	if f == 0 {
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return uint64ToBytes(bits)
+}
+
+func bytesToFloat64(b []byte) float64 {
+	bits := bytesToUint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
 func structToBytes(s interface{}) ([]byte, error) {
 	w := new(bytes.Buffer)
 	encoder := gob.NewEncoder(w)
@@ -25,3 +66,68 @@ func structToBytes(s interface{}) ([]byte, error) {
 	}
 	return w.Bytes(), nil
 }
+
+// appendEscaped appends the escaped component to dst without a terminator
+func appendEscaped(dst, component []byte) []byte {
+	for _, b := range component {
+		if b == keyEscape {
+			dst = append(dst, keyEscape, keyEscapedNul)
+		} else {
+			dst = append(dst, b)
+		}
+	}
+	return dst
+}
+
+// appendKeyComponent appends the escaped and terminated component to dst
+func appendKeyComponent(dst, component []byte) []byte {
+	return append(appendEscaped(dst, component), keyEscape, keyTerminator)
+}
+
+// encodeKey escapes and concatenates the components into a single key
+func encodeKey(components ...[]byte) []byte {
+	length := 0
+	for _, c := range components {
+		length += len(c) + 2
+	}
+	output := make([]byte, 0, length)
+	for _, c := range components {
+		output = appendKeyComponent(output, c)
+	}
+	return output
+}
+
+// decodeKey decodes n components from the start of the key and returns them along with
+// any remaining bytes
+func decodeKey(key []byte, n int) (components [][]byte, rest []byte, err error) {
+	components = make([][]byte, 0, n)
+	for len(components) < n {
+		var component []byte
+		i := 0
+		for {
+			j := bytes.IndexByte(key[i:], keyEscape)
+			if j < 0 || i+j+1 >= len(key) {
+				return nil, nil, errInvalidKey
+			}
+			j += i
+			if key[j+1] == keyTerminator {
+				if component == nil {
+					// Avoid copying when the component has no escaped bytes
+					component = key[:j:j]
+				} else {
+					component = append(component, key[i:j]...)
+				}
+				key = key[j+2:]
+				break
+			}
+			if key[j+1] != keyEscapedNul {
+				return nil, nil, errInvalidKey
+			}
+			component = append(component, key[i:j]...)
+			component = append(component, keyEscape)
+			i = j + 2
+		}
+		components = append(components, component)
+	}
+	return components, key, nil
+}
@@ -1,8 +1,13 @@
 package store
 
 import (
+	"bytes"
+	"encoding/gob"
+	"math"
 	"reflect"
+	"strconv"
 	"testing"
+	"testing/quick"
 )
 
 func Test_uint64ToBytes(t *testing.T) {
@@ -18,7 +23,7 @@ func Test_uint64ToBytes(t *testing.T) {
 		{args{1234567654321234567}, []byte{17, 34, 16, 189, 151, 1, 34, 135}},
 	}
 	for ti, tt := range tests {
-		t.Run(string(ti), func(t *testing.T) {
+		t.Run(strconv.Itoa(ti), func(t *testing.T) {
 			if got := uint64ToBytes(tt.args.i); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("uint64ToBytes() = %v, want %v", got, tt.want)
 			}
@@ -39,7 +44,7 @@ func Test_bytesToUint64(t *testing.T) {
 		{args{[]byte{17, 34, 16, 189, 151, 1, 34, 135}}, 1234567654321234567},
 	}
 	for ti, tt := range tests {
-		t.Run(string(ti), func(t *testing.T) {
+		t.Run(strconv.Itoa(ti), func(t *testing.T) {
 			if got := bytesToUint64(tt.args.b); got != tt.want {
 				t.Errorf("bytesToUint64() = %v, want %v", got, tt.want)
 			}
@@ -48,29 +53,124 @@ func Test_bytesToUint64(t *testing.T) {
 }
 
 func Test_structToBytes(t *testing.T) {
+	type foo struct{ Foo string }
 	type args struct {
 		s interface{}
 	}
 	tests := []struct {
 		args    args
-		want    []byte
+		want    foo
 		wantErr bool
 	}{
 		{
-			args:    args{struct{ Foo string }{"bar"}},
-			want:    []byte{20, 255, 129, 3, 1, 2, 255, 130, 0, 1, 1, 1, 3, 70, 111, 111, 1, 12, 0, 0, 0, 8, 255, 130, 1, 3, 98, 97, 114, 0},
+			args:    args{foo{"bar"}},
+			want:    foo{"bar"},
 			wantErr: false,
 		},
 	}
 	for ti, tt := range tests {
-		t.Run(string(ti), func(t *testing.T) {
+		t.Run(strconv.Itoa(ti), func(t *testing.T) {
 			got, err := structToBytes(tt.args.s)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("structToBytes() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("structToBytes() = %v, want %v", got, tt.want)
+			// Gob type ids differ between Go versions, so compare the decoded struct
+			var decoded foo
+			if err := gob.NewDecoder(bytes.NewReader(got)).Decode(&decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.want) {
+				t.Errorf("structToBytes() = %v, want %v", decoded, tt.want)
+			}
+		})
+	}
+}
+
+func Test_encodeKey(t *testing.T) {
+	tests := []struct {
+		components [][]byte
+		want       []byte
+	}{
+		{[][]byte{}, []byte{}},
+		{[][]byte{{}}, []byte{0, 1}},
+		{[][]byte{[]byte("e"), []byte("a:b")}, []byte{'e', 0, 1, 'a', ':', 'b', 0, 1}},
+		{[][]byte{{0}, {1, 0, 2}}, []byte{0, 255, 0, 1, 1, 0, 255, 2, 0, 1}},
+	}
+	for ti, tt := range tests {
+		t.Run(strconv.Itoa(ti), func(t *testing.T) {
+			if got := encodeKey(tt.components...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("encodeKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeKey_roundTrip(t *testing.T) {
+	f := func(components [][]byte, rest []byte) bool {
+		key := append(encodeKey(components...), rest...)
+		got, gotRest, err := decodeKey(key, len(components))
+		if err != nil || len(got) != len(components) || !bytes.Equal(gotRest, rest) {
+			return false
+		}
+		for i := range components {
+			if !bytes.Equal(got[i], components[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_encodeKey_preservesOrder(t *testing.T) {
+	f := func(a, b []byte) bool {
+		return bytes.Compare(a, b) == bytes.Compare(encodeKey(a), encodeKey(b))
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_float64ToBytes(t *testing.T) {
+	numbers := []float64{math.Inf(-1), -math.MaxFloat64, -10, -9, -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 1.5, 9, 10, math.MaxFloat64, math.Inf(1)}
+	for i, number := range numbers {
+		if got := bytesToFloat64(float64ToBytes(number)); got != number {
+			t.Errorf("bytesToFloat64(float64ToBytes(%v)) = %v", number, got)
+		}
+		if i > 0 && bytes.Compare(float64ToBytes(numbers[i-1]), float64ToBytes(number)) >= 0 {
+			t.Errorf("float64ToBytes(%v) does not sort before float64ToBytes(%v)", numbers[i-1], number)
+		}
+	}
+	if !bytes.Equal(float64ToBytes(math.Copysign(0, -1)), float64ToBytes(0)) {
+		t.Errorf("float64ToBytes(-0) != float64ToBytes(0)")
+	}
+
+	f := func(a, b float64) bool {
+		return (a < b) == (bytes.Compare(float64ToBytes(a), float64ToBytes(b)) < 0)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_decodeKey_invalid(t *testing.T) {
+	tests := []struct {
+		key []byte
+		n   int
+	}{
+		{[]byte{}, 1},
+		{[]byte{'a'}, 1},
+		{[]byte{'a', 0}, 1},
+		{[]byte{'a', 0, 2}, 1},
+		{[]byte{'a', 0, 1}, 2},
+	}
+	for ti, tt := range tests {
+		t.Run(strconv.Itoa(ti), func(t *testing.T) {
+			if _, _, err := decodeKey(tt.key, tt.n); err != errInvalidKey {
+				t.Errorf("decodeKey() error = %v, want %v", err, errInvalidKey)
 			}
 		})
 	}
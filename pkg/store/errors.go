@@ -0,0 +1,18 @@
+package store
+
+import (
+	"fmt"
+)
+
+// InvalidQueryError is returned when a query can not be run as written
+type InvalidQueryError struct {
+	Reason string
+}
+
+func (e *InvalidQueryError) Error() string {
+	return fmt.Sprintf("invalid query: %s", e.Reason)
+}
+
+func invalidQueryf(format string, a ...interface{}) error {
+	return &InvalidQueryError{Reason: fmt.Sprintf(format, a...)}
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Steps of the execution of a data block
+const (
+	stepScanInOrder = "scanInOrder" // scans the tag index in ts order, checking the records
+	stepFilter      = "filter"      // applies a filter of the block
+	stepTagScan     = "tagScan"     // reads every event of the tag, for blocks without filters
+	stepFetchKeys   = "fetchKeys"   // back-fills the keys the filters did not add
+	stepOperations  = "operations"  // applies the operations or the time series
+)
+
+// QueryStep is a step of the execution of a data block. The steps are returned in the meta
+// of the block under plan when the query is explained, and under profile with what each
+// step did when the query is profiled.
+type QueryStep struct {
+	Step       string            `json:"step"`
+	Filter     *Filter           `json:"filter,omitempty"`
+	Estimate   *uint64           `json:"estimate,omitempty"` // events of the tag the filter is estimated to match
+	Strategy   string            `json:"strategy,omitempty"` // scan | seek
+	Concurrent bool              `json:"concurrent,omitempty"`
+	Keys       []string          `json:"keys,omitempty"` // the keys back-filled
+	Profile    *QueryStepProfile `json:"profile,omitempty"`
+}
+
+// QueryStepProfile is what a step of a profiled query did
+type QueryStepProfile struct {
+	DurationMs   float64 `json:"durationMs"`
+	KeysScanned  uint64  `json:"keysScanned"`  // index and record keys read
+	BytesDecoded uint64  `json:"bytesDecoded"` // bytes of the keys and values read
+	Events       int     `json:"events"`       // events left after the step
+}
+
+// filterQueryStep returns the step of a planned filter
+func filterQueryStep(step filterStep) QueryStep {
+	filter := step.filter
+	estimate := step.estimate
+	return QueryStep{Step: stepFilter, Filter: &filter, Estimate: &estimate, Strategy: step.strategy, Concurrent: step.concurrent}
+}
+
+// backfillKeys returns the keys which are fetched after the filters, or * when every key is
+func backfillKeys(data Data, keys []string, fetchedKeysMap map[string]struct{}) []string {
+	if data.allKeys() {
+		return []string{allKeys}
+	}
+	var missing []string
+	seen := make(map[string]struct{})
+	for _, key := range keys {
+		_, fetched := fetchedKeysMap[key]
+		if _, ok := seen[key]; !ok && !fetched {
+			seen[key] = struct{}{}
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// explainData returns the steps the data block would be executed with, without running them
+func (s *Store) explainData(query Query, data Data) ([]QueryStep, error) {
+	inOrder, err := s.scansInOrder(query, data)
+	if err != nil {
+		return nil, err
+	}
+	if inOrder {
+		return []QueryStep{{Step: stepScanInOrder}}, nil
+	}
+
+	plan, err := s.planFilters(data)
+	if err != nil {
+		return nil, err
+	}
+	steps := []QueryStep{}
+	fetchedKeysMap := make(map[string]struct{})
+	for _, step := range plan.steps {
+		steps = append(steps, filterQueryStep(step))
+		if step.filter.addsKey() {
+			fetchedKeysMap[step.filter.Key] = struct{}{}
+		}
+	}
+	if len(data.Filters) == 0 {
+		steps = append(steps, QueryStep{Step: stepTagScan})
+	}
+
+	keys := backfillKeys(data, append(data.requiredKeys(), query.resultKeys(data.Name)...), fetchedKeysMap)
+	if len(keys) > 0 {
+		steps = append(steps, QueryStep{Step: stepFetchKeys, Keys: keys})
+	}
+	if len(data.Operations) > 0 || data.Granularity != "" {
+		steps = append(steps, QueryStep{Step: stepOperations})
+	}
+	return steps, nil
+}
+
+// queryProfile records the steps of a profiled data block. A nil profile records nothing.
+type queryProfile struct {
+	steps []QueryStep
+}
+
+// profiledStep measures a step from its start until done is called
+type profiledStep struct {
+	profile  *QueryStepProfile
+	start    time.Time
+	counters *stepCounters
+}
+
+// step starts to profile the step and returns the context the step must read with. The
+// steps which run at the same time are started before any of them runs.
+func (p *queryProfile) step(ctx context.Context, step QueryStep) (context.Context, *profiledStep) {
+	if p == nil {
+		return ctx, nil
+	}
+	ctx, counters := withStepCounters(ctx)
+	step.Profile = &QueryStepProfile{}
+	p.steps = append(p.steps, step)
+	return ctx, &profiledStep{profile: step.Profile, start: time.Now(), counters: counters}
+}
+
+// done records what the step did, with the events left after it
+func (s *profiledStep) done(events int) {
+	if s == nil {
+		return
+	}
+	s.profile.DurationMs = float64(time.Since(s.start)) / float64(time.Millisecond)
+	s.profile.KeysScanned = atomic.LoadUint64(&s.counters.keysScanned)
+	s.profile.BytesDecoded = atomic.LoadUint64(&s.counters.bytesDecoded)
+	s.profile.Events = events
+}
+
+// setEvents replaces the events left after the step, for concurrent steps whose events are
+// intersected once every one of them is done
+func (s *profiledStep) setEvents(events int) {
+	if s != nil {
+		s.profile.Events = events
+	}
+}
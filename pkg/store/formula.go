@@ -0,0 +1,505 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Formula is a named arithmetic expression over the meta of the named data blocks, e.g.
+// add_to_cart.uniqueCount / product_view.uniqueCount. Its result is in the formulas of the
+// query result under its name.
+//
+// An expression is numbers and references joined with + - * / and parentheses. A reference
+// is the name of a data block and the name of a result in its meta, and then the name of a
+// result in the meta of each group for a group_by, e.g. views.group_by.count. Names with
+// other characters than letters, digits and _ are quoted with backticks, e.g.
+// views.`p99.9`.
+//
+// A formula of time series is a time series with a value per bucket, and a formula of a
+// group_by is a group_by with a value per group. Buckets are matched by ts and groups by
+// their values, and a scalar applies to every bucket or group. Missing values, null
+// results and division by zero are null.
+type Formula struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// Formula expression nodes
+const (
+	formulaNumber    = "number"
+	formulaReference = "reference"
+	formulaNegate    = "negate"
+)
+
+// formulaNode is a number, a reference, a negation or a binary operator (+ - * /)
+type formulaNode struct {
+	op          string
+	number      float64
+	reference   []string // the data block followed by the names in its meta
+	left, right *formulaNode
+}
+
+// compiledFormula is a formula with its parsed expression
+type compiledFormula struct {
+	name string
+	node *formulaNode
+}
+
+// compileFormulas parses the formulas of the query and checks that their names are unique
+// and that they only reference data blocks of the query
+func compileFormulas(query Query) ([]compiledFormula, error) {
+	dataNames := make(map[string]int)
+	for _, data := range query.Data {
+		dataNames[data.Name]++
+	}
+
+	formulas := make([]compiledFormula, len(query.Formulas))
+	names := make(map[string]struct{})
+	for i, formula := range query.Formulas {
+		if formula.Name == "" {
+			return nil, invalidQueryf("formula %q has no name", formula.Expression)
+		}
+		if _, ok := names[formula.Name]; ok {
+			return nil, invalidQueryf("more than one formula is named %q", formula.Name)
+		}
+		names[formula.Name] = struct{}{}
+
+		p := &formulaParser{text: formula.Expression}
+		node, err := p.parse()
+		if err != nil {
+			return nil, invalidQueryf("formula %q: %s", formula.Name, err)
+		}
+		for _, reference := range node.references(nil) {
+			switch dataNames[reference[0]] {
+			case 0:
+				return nil, invalidQueryf("formula %q reads %q, which is not a data block", formula.Name, reference[0])
+			case 1:
+			default:
+				return nil, invalidQueryf("formula %q reads %q, which names more than one data block", formula.Name, reference[0])
+			}
+		}
+		formulas[i] = compiledFormula{name: formula.Name, node: node}
+	}
+	return formulas, nil
+}
+
+// formulaData returns the names of the data blocks the formulas read
+func formulaData(formulas []compiledFormula) map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, formula := range formulas {
+		for _, reference := range formula.node.references(nil) {
+			names[reference[0]] = struct{}{}
+		}
+	}
+	return names
+}
+
+func (n *formulaNode) references(references [][]string) [][]string {
+	switch n.op {
+	case formulaNumber:
+	case formulaReference:
+		references = append(references, n.reference)
+	default:
+		references = n.left.references(references)
+		if n.right != nil {
+			references = n.right.references(references)
+		}
+	}
+	return references
+}
+
+// evaluateFormulas returns the result of every formula over the meta of the data blocks
+func evaluateFormulas(formulas []compiledFormula, metas map[string]map[string]interface{}) (map[string]interface{}, error) {
+	results := make(map[string]interface{})
+	for _, formula := range formulas {
+		value, err := formula.node.evaluate(metas)
+		if err != nil {
+			return nil, invalidQueryf("formula %q: %s", formula.name, err)
+		}
+		results[formula.name] = value.result(formula.name)
+	}
+	return results, nil
+}
+
+// Kinds of formula values
+const (
+	formulaScalar = iota
+	formulaSeries
+	formulaGroups
+)
+
+// formulaValue is a scalar, which is null when it has no number, a value per time bucket or
+// a value per group
+type formulaValue struct {
+	kind   int
+	number *float64
+	points []formulaPoint
+	groups []formulaGroup
+}
+
+type formulaPoint struct {
+	ts    uint64
+	value formulaValue
+}
+
+type formulaGroup struct {
+	group map[string]interface{}
+	other bool
+	value formulaValue
+}
+
+// key identifies the group by its values
+func (g formulaGroup) key() string {
+	keys := make([]string, 0, len(g.group))
+	for key := range g.group {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%t", g.other)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %q=", key)
+		value, ok := g.group[key].(string)
+		writeKeyValue(&b, value, ok)
+	}
+	return b.String()
+}
+
+func scalarValue(number float64) formulaValue {
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return formulaValue{}
+	}
+	return formulaValue{number: &number}
+}
+
+func (n *formulaNode) evaluate(metas map[string]map[string]interface{}) (formulaValue, error) {
+	switch n.op {
+	case formulaNumber:
+		return scalarValue(n.number), nil
+	case formulaReference:
+		meta, ok := metas[n.reference[0]]
+		if !ok {
+			return formulaValue{}, fmt.Errorf("data block %q has no meta", n.reference[0])
+		}
+		return metaValue(meta, n.reference, 1)
+	case formulaNegate:
+		value, err := n.left.evaluate(metas)
+		if err != nil {
+			return formulaValue{}, err
+		}
+		return combineFormulaValues("-", scalarValue(0), value), nil
+	}
+	left, err := n.left.evaluate(metas)
+	if err != nil {
+		return formulaValue{}, err
+	}
+	right, err := n.right.evaluate(metas)
+	if err != nil {
+		return formulaValue{}, err
+	}
+	return combineFormulaValues(n.op, left, right), nil
+}
+
+// metaValue returns the value of the reference name at i in the meta
+func metaValue(meta map[string]interface{}, reference []string, i int) (formulaValue, error) {
+	if i == len(reference) {
+		return formulaValue{}, fmt.Errorf("%s is a group_by, reference a result of its groups", strings.Join(reference, "."))
+	}
+	value, ok := meta[reference[i]]
+	if !ok {
+		return formulaValue{}, fmt.Errorf("%s is not in the meta", strings.Join(reference[:i+1], "."))
+	}
+	return resultValue(value, reference, i+1)
+}
+
+// resultValue returns the value of a result in a meta, where the rest of the reference from
+// i names the results in the meta of its groups
+func resultValue(value interface{}, reference []string, i int) (formulaValue, error) {
+	var number float64
+	switch value := value.(type) {
+	case nil:
+		if i < len(reference) {
+			return formulaValue{}, fmt.Errorf("%s is not a group_by", strings.Join(reference[:i], "."))
+		}
+		return formulaValue{}, nil
+	case int:
+		number = float64(value)
+	case uint64:
+		number = float64(value)
+	case float64:
+		number = value
+	case []TimeSeriesPoint:
+		series := formulaValue{kind: formulaSeries, points: []formulaPoint{}}
+		for _, point := range value {
+			pointValue, err := resultValue(point.Value, reference, i)
+			if err != nil {
+				return formulaValue{}, err
+			}
+			series.points = append(series.points, formulaPoint{ts: point.TS, value: pointValue})
+		}
+		return series, nil
+	case []GroupResult:
+		groups := formulaValue{kind: formulaGroups, groups: []formulaGroup{}}
+		for _, group := range value {
+			groupValue, err := metaValue(group.Meta, reference, i)
+			if err != nil {
+				return formulaValue{}, err
+			}
+			groups.groups = append(groups.groups, formulaGroup{group: group.Group, other: group.Other, value: groupValue})
+		}
+		return groups, nil
+	default:
+		return formulaValue{}, fmt.Errorf("%s is not a number", strings.Join(reference[:i], "."))
+	}
+	if i < len(reference) {
+		return formulaValue{}, fmt.Errorf("%s is not a group_by", strings.Join(reference[:i], "."))
+	}
+	return scalarValue(number), nil
+}
+
+// combineFormulaValues applies the operator to the values, bucket by bucket and group by
+// group. A bucket or group missing from one of the values is null.
+func combineFormulaValues(op string, a, b formulaValue) formulaValue {
+	switch {
+	case a.kind == formulaSeries || b.kind == formulaSeries:
+		points := func(v formulaValue) map[uint64]formulaValue {
+			values := make(map[uint64]formulaValue)
+			for _, point := range v.points {
+				values[point.ts] = point.value
+			}
+			return values
+		}
+		var tss []uint64
+		seen := make(map[uint64]struct{})
+		for _, v := range []formulaValue{a, b} {
+			for _, point := range v.points {
+				if _, ok := seen[point.ts]; !ok {
+					seen[point.ts] = struct{}{}
+					tss = append(tss, point.ts)
+				}
+			}
+		}
+		sort.Slice(tss, func(i, j int) bool { return tss[i] < tss[j] })
+
+		aPoints, bPoints := points(a), points(b)
+		series := formulaValue{kind: formulaSeries, points: []formulaPoint{}}
+		for _, ts := range tss {
+			aValue, bValue := a, b
+			if a.kind == formulaSeries {
+				aValue = aPoints[ts]
+			}
+			if b.kind == formulaSeries {
+				bValue = bPoints[ts]
+			}
+			series.points = append(series.points, formulaPoint{ts: ts, value: combineFormulaValues(op, aValue, bValue)})
+		}
+		return series
+
+	case a.kind == formulaGroups || b.kind == formulaGroups:
+		var order []formulaGroup
+		aGroups, bGroups := make(map[string]formulaValue), make(map[string]formulaValue)
+		for _, g := range a.groups {
+			aGroups[g.key()] = g.value
+			order = append(order, g)
+		}
+		for _, g := range b.groups {
+			if _, ok := aGroups[g.key()]; !ok {
+				order = append(order, g)
+			}
+			bGroups[g.key()] = g.value
+		}
+
+		groups := formulaValue{kind: formulaGroups, groups: []formulaGroup{}}
+		for _, g := range order {
+			aValue, bValue := a, b
+			if a.kind == formulaGroups {
+				aValue = aGroups[g.key()]
+			}
+			if b.kind == formulaGroups {
+				bValue = bGroups[g.key()]
+			}
+			g.value = combineFormulaValues(op, aValue, bValue)
+			groups.groups = append(groups.groups, g)
+		}
+		return groups
+	}
+
+	if a.number == nil || b.number == nil {
+		return formulaValue{}
+	}
+	switch op {
+	case "+":
+		return scalarValue(*a.number + *b.number)
+	case "-":
+		return scalarValue(*a.number - *b.number)
+	case "*":
+		return scalarValue(*a.number * *b.number)
+	}
+	return scalarValue(*a.number / *b.number)
+}
+
+// result returns the value in the form of the meta it was computed from. The value of each
+// group is in the meta of the group under the name of the formula.
+func (v formulaValue) result(name string) interface{} {
+	switch v.kind {
+	case formulaSeries:
+		series := []TimeSeriesPoint{}
+		for _, point := range v.points {
+			series = append(series, TimeSeriesPoint{TS: point.ts, Value: point.value.result(name)})
+		}
+		return series
+	case formulaGroups:
+		groups := []GroupResult{}
+		for _, group := range v.groups {
+			meta := map[string]interface{}{name: group.value.result(name)}
+			groups = append(groups, GroupResult{Group: group.group, Meta: meta, Other: group.other})
+		}
+		return groups
+	}
+	if v.number == nil {
+		return nil
+	}
+	return *v.number
+}
+
+// formulaParser parses a formula expression by recursive descent
+type formulaParser struct {
+	text string
+	i    int
+}
+
+func (p *formulaParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", p.i+1, fmt.Sprintf(format, args...))
+}
+
+func (p *formulaParser) skipSpace() {
+	for p.i < len(p.text) && strings.IndexByte(" \t\r\n", p.text[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+// peek returns the next character after any space, or 0 at the end of the expression
+func (p *formulaParser) peek() byte {
+	p.skipSpace()
+	if p.i == len(p.text) {
+		return 0
+	}
+	return p.text[p.i]
+}
+
+func (p *formulaParser) parse() (*formulaNode, error) {
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if c := p.peek(); c != 0 {
+		return nil, p.errorf("unexpected %q", c)
+	}
+	return node, nil
+}
+
+func (p *formulaParser) parseSum() (*formulaNode, error) {
+	node, err := p.parseProduct()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := string(p.text[p.i])
+		p.i++
+		var right *formulaNode
+		right, err = p.parseProduct()
+		node = &formulaNode{op: op, left: node, right: right}
+	}
+	return node, err
+}
+
+func (p *formulaParser) parseProduct() (*formulaNode, error) {
+	node, err := p.parseUnary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := string(p.text[p.i])
+		p.i++
+		var right *formulaNode
+		right, err = p.parseUnary()
+		node = &formulaNode{op: op, left: node, right: right}
+	}
+	return node, err
+}
+
+func (p *formulaParser) parseUnary() (*formulaNode, error) {
+	if p.peek() == '-' {
+		p.i++
+		node, err := p.parseUnary()
+		return &formulaNode{op: formulaNegate, left: node}, err
+	}
+	return p.parseOperand()
+}
+
+func (p *formulaParser) parseOperand() (*formulaNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.i++
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.i++
+		return node, nil
+	case isDigit(c) || c == '.':
+		start := p.i
+		for p.i < len(p.text) && (isDigit(p.text[p.i]) || p.text[p.i] == '.') {
+			p.i++
+		}
+		text := p.text[start:p.i]
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.i = start
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return &formulaNode{op: formulaNumber, number: number}, nil
+	case c == '`' || isNameStart(c):
+		var reference []string
+		for {
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			reference = append(reference, name)
+			if p.i == len(p.text) || p.text[p.i] != '.' {
+				break
+			}
+			p.i++
+		}
+		if len(reference) < 2 {
+			return nil, p.errorf("expected a data block and a result, e.g. %s.count", reference[0])
+		}
+		return &formulaNode{op: formulaReference, reference: reference}, nil
+	case c == 0:
+		return nil, p.errorf("expected a number, a reference or (, found the end")
+	}
+	return nil, p.errorf("unexpected %q", c)
+}
+
+// parseName parses a name of letters, digits and _ or a name between backticks
+func (p *formulaParser) parseName() (string, error) {
+	if p.i < len(p.text) && p.text[p.i] == '`' {
+		end := strings.IndexByte(p.text[p.i+1:], '`')
+		if end < 0 {
+			return "", p.errorf("unterminated name")
+		}
+		name := p.text[p.i+1 : p.i+1+end]
+		p.i += end + 2
+		return name, nil
+	}
+	start := p.i
+	for p.i < len(p.text) && (isNameStart(p.text[p.i]) || isDigit(p.text[p.i])) {
+		p.i++
+	}
+	if p.i == start {
+		return "", p.errorf("expected a name")
+	}
+	return p.text[start:p.i], nil
+}
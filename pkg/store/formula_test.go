@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStore_QueryEvents_formulas(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "product_view", TS: 1000, Data: map[string]string{"user_id": "u1", "product": "x"}},
+		{Tag: "product_view", TS: 1500, Data: map[string]string{"user_id": "u2", "product": "x"}},
+		{Tag: "product_view", TS: 2000, Data: map[string]string{"user_id": "u1", "product": "y"}},
+		{Tag: "product_view", TS: 2500, Data: map[string]string{"user_id": "u3", "product": "y"}},
+		{Tag: "add_to_cart", TS: 1100, Data: map[string]string{"user_id": "u1", "product": "x"}},
+		{Tag: "add_to_cart", TS: 2100, Data: map[string]string{"user_id": "u1", "product": "y"}},
+		{Tag: "add_to_cart", TS: 3100, Data: map[string]string{"user_id": "u4", "product": "z"}},
+	})
+
+	byProduct := []Operation{{Type: "group_by", Keys: []string{"product"}, Operations: []Operation{{Type: "count"}}}}
+	groups := []Data{
+		{Name: "view", Tag: "product_view", Operations: byProduct, HideData: true},
+		{Name: "cart", Tag: "add_to_cart", Operations: byProduct, HideData: true},
+	}
+	uniqueCounts := []Data{
+		{Name: "view", Tag: "product_view", Operations: []Operation{{Type: "uniqueCount", Key: "user_id"}, {Type: "max", Key: "price"}}, HideData: true},
+		{Name: "add to cart", Tag: "add_to_cart", Operations: []Operation{{Type: "uniqueCount", Key: "user_id"}}, HideData: true},
+	}
+	series := []Data{
+		{Name: "view", Tag: "product_view", Granularity: "1s", Operations: []Operation{{Type: "count"}}, HideData: true},
+		{Name: "cart", Tag: "add_to_cart", Granularity: "1s", Operations: []Operation{{Type: "count"}}, HideData: true},
+	}
+
+	tests := []struct {
+		name       string
+		data       []Data
+		expression string
+		want       interface{}
+	}{
+		{"Scalars", uniqueCounts, "`add to cart`.uniqueCount * 100 / view.uniqueCount", 200.0 / 3},
+		{"Precedence", uniqueCounts, "-(1 + 2) * 3 - view.uniqueCount / 2", -10.5},
+		{"Null", uniqueCounts, "view.max + 1", nil},
+		{"Division by zero", uniqueCounts, "view.uniqueCount / (view.uniqueCount - 3)", nil},
+		{
+			"Time series",
+			series,
+			"cart.count / view.count",
+			[]TimeSeriesPoint{{TS: 1000, Value: 0.5}, {TS: 2000, Value: 0.5}, {TS: 3000, Value: nil}},
+		},
+		{
+			"Time series and scalar",
+			series,
+			"view.count * 2",
+			[]TimeSeriesPoint{{TS: 1000, Value: 4.0}, {TS: 2000, Value: 4.0}},
+		},
+		{
+			"Time series without events",
+			[]Data{{Name: "view", Tag: "unknown", Granularity: "1s", Operations: []Operation{{Type: "count"}}, HideData: true}},
+			"view.count * 2",
+			[]TimeSeriesPoint{},
+		},
+		{
+			"Groups",
+			groups,
+			"cart.group_by.count / view.group_by.count",
+			[]GroupResult{
+				{Group: map[string]interface{}{"product": "x"}, Meta: map[string]interface{}{"f": 0.5}},
+				{Group: map[string]interface{}{"product": "y"}, Meta: map[string]interface{}{"f": 0.5}},
+				{Group: map[string]interface{}{"product": "z"}, Meta: map[string]interface{}{"f": nil}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.QueryEvents(context.Background(), Query{Data: tt.data, Formulas: []Formula{{Name: "f", Expression: tt.expression}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := result.Formulas["f"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryEvents() formula = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStore_QueryEvents_invalidFormulas(t *testing.T) {
+	s := newTestStore(t, []Event{{Tag: "tag1", TS: 1001, Data: map[string]string{"path": "/a"}}})
+	data := []Data{{Name: "a", Tag: "tag1", Operations: []Operation{
+		{Type: "count"},
+		{Type: "group_by", Keys: []string{"path"}, Operations: []Operation{{Type: "count"}}},
+	}}}
+
+	tests := []struct {
+		name     string
+		formulas []Formula
+		want     string
+	}{
+		{"No name", []Formula{{Expression: "a.count"}}, `has no name`},
+		{"Duplicate names", []Formula{{Name: "f", Expression: "1"}, {Name: "f", Expression: "2"}}, `more than one formula is named "f"`},
+		{"Unknown block", []Formula{{Name: "f", Expression: "b.count"}}, `reads "b", which is not a data block`},
+		{"No result", []Formula{{Name: "f", Expression: "a"}}, `column 2: expected a data block and a result`},
+		{"Unclosed parenthesis", []Formula{{Name: "f", Expression: "(a.count + 1"}}, `column 13: expected )`},
+		{"Trailing operator", []Formula{{Name: "f", Expression: "a.count *"}}, `column 10: expected a number, a reference or (`},
+		{"Unexpected character", []Formula{{Name: "f", Expression: "a.count % 2"}}, `column 9: unexpected '%'`},
+		{"Unterminated name", []Formula{{Name: "f", Expression: "a.`count"}}, `unterminated name`},
+		{"Unknown result", []Formula{{Name: "f", Expression: "a.sum"}}, `a.sum is not in the meta`},
+		{"Group_by", []Formula{{Name: "f", Expression: "a.group_by"}}, `a.group_by is a group_by`},
+		{"Not a group_by", []Formula{{Name: "f", Expression: "a.count.x"}}, `a.count is not a group_by`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.QueryEvents(context.Background(), Query{Data: data, Formulas: tt.formulas})
+			if _, ok := err.(*InvalidQueryError); !ok || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("QueryEvents() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
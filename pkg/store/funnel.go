@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// Funnel joins the results of named data blocks into the steps of a funnel
+type Funnel struct {
+	Type   string   `json:"type"`   // exact_order | any_order
+	Order  []string `json:"order"`  // names of the data blocks of each step, e.g. [product_view, add_to_cart]
+	Match  []string `json:"match"`  // keys which must be equal across the steps, e.g. [user_id, item_colour_id]
+	Window string   `json:"window"` // max time from the first to the last step, e.g. 1h. Empty is unbounded
+}
+
+// FunnelResult is the result of a funnel
+type FunnelResult struct {
+	Steps []FunnelStep `json:"steps"`
+}
+
+// FunnelStep is the result of one step of a funnel. Counts are the number of distinct
+// match key values which reached the step, each weighted by the samplerate of the event
+// which reached it.
+type FunnelStep struct {
+	Name                string  `json:"name"`
+	Count               int     `json:"count"`
+	Conversion          float64 `json:"conversion"`                    // from the previous step
+	OverallConversion   float64 `json:"overallConversion"`             // from the first step
+	MedianTimeToConvert *uint64 `json:"medianTimeToConvert,omitempty"` // ms from the previous step
+}
+
+// funnelKeys returns the keys the funnel needs from the data block
+func (f *Funnel) funnelKeys(dataName string) []string {
+	if f == nil {
+		return nil
+	}
+	for _, name := range f.Order {
+		if name == dataName {
+			return f.Match
+		}
+	}
+	return nil
+}
+
+// validate checks the funnel against the data blocks of the query
+func (f *Funnel) validate(query Query) error {
+	if f.Type != "exact_order" && f.Type != "any_order" {
+		return invalidQueryf("unsupported funnel type %q", f.Type)
+	}
+	if len(f.Order) == 0 {
+		return invalidQueryf("funnel has no steps")
+	}
+	if len(f.Match) == 0 {
+		return invalidQueryf("funnel has no match keys")
+	}
+	names := make(map[string]int)
+	for _, data := range query.Data {
+		names[data.Name]++
+	}
+	for _, name := range f.Order {
+		switch n := names[name]; {
+		case n == 0:
+			return invalidQueryf("funnel step %q is not a data block", name)
+		case n > 1:
+			return invalidQueryf("funnel step %q names more than one data block", name)
+		}
+	}
+	if f.Window != "" {
+		if _, err := parseGranularity(f.Window); err != nil {
+			return invalidQueryf("invalid funnel window %q", f.Window)
+		}
+	}
+	return nil
+}
+
+// funnelEvent is an event of a funnel step
+type funnelEvent struct {
+	step       int
+	ts         uint64
+	samplerate int
+}
+
+// applyFunnel counts how many match key values reach each step of the funnel. The events
+// of each data block are keyed by its name. For each match key value every event of the
+// first step (or of any step for any_order) is tried as the start of the funnel and the
+// start reaching the most steps is used.
+func applyFunnel(ctx context.Context, f *Funnel, dataEvents map[string][]DecodedEvent) (FunnelResult, error) {
+	var window uint64
+	if f.Window != "" {
+		window, _ = parseGranularity(f.Window)
+	}
+
+	// Group the events of every step by the values of the match keys
+	entities := make(map[string][]funnelEvent)
+	for step, name := range f.Order {
+	events:
+		for _, event := range dataEvents[name] {
+			var entity strings.Builder
+			for _, key := range f.Match {
+				value, ok := eventValue(event, key)
+				if !ok {
+					continue events
+				}
+				writeKeyValue(&entity, value, true)
+			}
+			entities[entity.String()] = append(entities[entity.String()], funnelEvent{step: step, ts: event.TS, samplerate: event.Samplerate})
+		}
+	}
+
+	counts := make([]int, len(f.Order))
+	timesToConvert := make([][]uint64, len(f.Order))
+	n := 0
+	for _, events := range entities {
+		if err := checkContext(ctx, n); err != nil {
+			return FunnelResult{}, err
+		}
+		n++
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].ts < events[j].ts
+		})
+		positions := make([][]int, len(f.Order))
+		for i, event := range events {
+			positions[event.step] = append(positions[event.step], i)
+		}
+
+		var best []funnelEvent
+		for _, start := range events {
+			if f.Type == "exact_order" && start.step != 0 {
+				continue
+			}
+			var reached []funnelEvent
+			if f.Type == "exact_order" {
+				reached = funnelExactOrder(events, positions, start.ts, window)
+			} else {
+				reached = funnelAnyOrder(events, start.ts, window, len(f.Order))
+			}
+			if len(reached) > len(best) {
+				best = reached
+			}
+			if len(best) == len(f.Order) {
+				break
+			}
+		}
+
+		for step, event := range best {
+			counts[step] += getSamplerate(event.samplerate)
+			if step > 0 {
+				timesToConvert[step] = append(timesToConvert[step], event.ts-best[step-1].ts)
+			}
+		}
+	}
+
+	result := FunnelResult{Steps: make([]FunnelStep, len(f.Order))}
+	for step, name := range f.Order {
+		result.Steps[step] = FunnelStep{Name: name, Count: counts[step], MedianTimeToConvert: median(timesToConvert[step])}
+		if step == 0 {
+			if counts[0] > 0 {
+				result.Steps[step].Conversion = 1
+				result.Steps[step].OverallConversion = 1
+			}
+			continue
+		}
+		if counts[step-1] > 0 {
+			result.Steps[step].Conversion = float64(counts[step]) / float64(counts[step-1])
+		}
+		if counts[0] > 0 {
+			result.Steps[step].OverallConversion = float64(counts[step]) / float64(counts[0])
+		}
+	}
+	return result, nil
+}
+
+// funnelExactOrder returns the event reaching each step when the steps have to happen in
+// order, starting at start. events must be sorted by ts, and positions holds the indexes of
+// the events of each step in order.
+func funnelExactOrder(events []funnelEvent, positions [][]int, start, window uint64) []funnelEvent {
+	var reached []funnelEvent
+	next := sort.Search(len(events), func(i int) bool {
+		return events[i].ts >= start
+	})
+	for _, stepPositions := range positions {
+		i := sort.SearchInts(stepPositions, next)
+		if i == len(stepPositions) {
+			break
+		}
+		event := events[stepPositions[i]]
+		if window > 0 && event.ts-start > window {
+			break
+		}
+		reached = append(reached, event)
+		next = stepPositions[i] + 1
+	}
+	return reached
+}
+
+// funnelAnyOrder returns the event reaching each step when the steps can happen in any
+// order, starting at start. A step is reached once it and every step before it have
+// happened, at the time of the latest of them. events must be sorted by ts.
+func funnelAnyOrder(events []funnelEvent, start, window uint64, steps int) []funnelEvent {
+	first := make([]*funnelEvent, steps)
+	for i := range events {
+		event := events[i]
+		if event.ts < start {
+			continue
+		}
+		if window > 0 && event.ts-start > window {
+			break
+		}
+		if first[event.step] == nil {
+			first[event.step] = &events[i]
+		}
+	}
+
+	var reached []funnelEvent
+	var last uint64
+	for _, event := range first {
+		if event == nil {
+			break
+		}
+		if event.ts > last {
+			last = event.ts
+		}
+		reached = append(reached, funnelEvent{step: event.step, ts: last, samplerate: event.samplerate})
+	}
+	return reached
+}
+
+func median(values []uint64) *uint64 {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+	m := values[len(values)/2]
+	if len(values)%2 == 0 {
+		m = (values[len(values)/2-1] + m) / 2
+	}
+	return &m
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_applyFunnel(t *testing.T) {
+	dataEvents := map[string][]DecodedEvent{
+		"view": {
+			testEvent(10, 1, "user", "a", "item", "1"),
+			testEvent(20, 1, "user", "b", "item", "1"),
+			testEvent(30, 1, "user", "c", "item", "1"),
+			testEvent(40, 1, "user", "d"),
+		},
+		"cart": {
+			testEvent(15, 1, "user", "a", "item", "1"),
+			testEvent(60, 1, "user", "b", "item", "1"),
+			testEvent(25, 1, "user", "c", "item", "1"),
+			testEvent(45, 1, "user", "d"),
+		},
+		"buy": {
+			testEvent(16, 1, "user", "a", "item", "1"),
+			testEvent(70, 1, "user", "b", "item", "1"),
+		},
+	}
+	u := func(v uint64) *uint64 { return &v }
+
+	tests := []struct {
+		name   string
+		funnel Funnel
+		want   []FunnelStep
+	}{
+		{
+			name:   "Exact order",
+			funnel: Funnel{Type: "exact_order", Order: []string{"view", "cart", "buy"}, Match: []string{"user", "item"}},
+			want: []FunnelStep{
+				{Name: "view", Count: 3, Conversion: 1, OverallConversion: 1},
+				{Name: "cart", Count: 2, Conversion: 2.0 / 3, OverallConversion: 2.0 / 3, MedianTimeToConvert: u(22)},
+				{Name: "buy", Count: 2, Conversion: 1, OverallConversion: 2.0 / 3, MedianTimeToConvert: u(5)},
+			},
+		},
+		{
+			name:   "Window",
+			funnel: Funnel{Type: "exact_order", Order: []string{"view", "cart", "buy"}, Match: []string{"user", "item"}, Window: "10ms"},
+			want: []FunnelStep{
+				{Name: "view", Count: 3, Conversion: 1, OverallConversion: 1},
+				{Name: "cart", Count: 1, Conversion: 1.0 / 3, OverallConversion: 1.0 / 3, MedianTimeToConvert: u(5)},
+				{Name: "buy", Count: 1, Conversion: 1, OverallConversion: 1.0 / 3, MedianTimeToConvert: u(1)},
+			},
+		},
+		{
+			name:   "Any order",
+			funnel: Funnel{Type: "any_order", Order: []string{"view", "cart"}, Match: []string{"user"}},
+			want: []FunnelStep{
+				{Name: "view", Count: 4, Conversion: 1, OverallConversion: 1},
+				{Name: "cart", Count: 4, Conversion: 1, OverallConversion: 1, MedianTimeToConvert: u(5)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyFunnel(context.Background(), &tt.funnel, dataEvents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Steps, tt.want) {
+				t.Errorf("applyFunnel() = %+v, want %+v", got.Steps, tt.want)
+			}
+		})
+	}
+}
+
+func Test_applyFunnel_samplerate(t *testing.T) {
+	dataEvents := map[string][]DecodedEvent{
+		"view": {testEvent(10, 4, "user", "a"), testEvent(20, 1, "user", "b")},
+		"cart": {testEvent(15, 2, "user", "a")},
+	}
+	got, err := applyFunnel(context.Background(), &Funnel{Type: "exact_order", Order: []string{"view", "cart"}, Match: []string{"user"}}, dataEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Steps[0].Count != 5 || got.Steps[1].Count != 2 || got.Steps[1].Conversion != 0.4 {
+		t.Errorf("applyFunnel() = %+v, want counts 5 and 2", got.Steps)
+	}
+}
+
+func TestFunnel_validate(t *testing.T) {
+	query := Query{Data: []Data{{Name: "view"}, {Name: "cart"}, {Name: "cart"}}}
+
+	tests := []struct {
+		name   string
+		funnel Funnel
+		want   string
+	}{
+		{"Unknown type", Funnel{Type: "other", Order: []string{"view"}, Match: []string{"user"}}, `unsupported funnel type "other"`},
+		{"Unknown block", Funnel{Type: "exact_order", Order: []string{"view", "buy"}, Match: []string{"user"}}, `funnel step "buy" is not a data block`},
+		{"Duplicate names", Funnel{Type: "exact_order", Order: []string{"view", "cart"}, Match: []string{"user"}}, `funnel step "cart" names more than one data block`},
+		{"Invalid window", Funnel{Type: "exact_order", Order: []string{"view"}, Match: []string{"user"}, Window: "-1h"}, `invalid funnel window "-1h"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.funnel.validate(query)
+			if _, ok := err.(*InvalidQueryError); !ok || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validate() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
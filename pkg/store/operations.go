@@ -0,0 +1,573 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aaron7/eventstore/pkg/sketch"
+)
+
+// Every operation is weighted by the samplerate of the events, since an event sampled at
+// 1 in N stands in for N events. Next to its result each operation reports the number of
+// sampled events it was computed from and the standard error of the estimate, e.g.
+// count, countSamples and countError. min, max, stddev and percentiles have no standard
+// error and only report their samples.
+const (
+	metaSamplesSuffix = "Samples"
+	metaErrorSuffix   = "Error"
+)
+
+// GroupResult is the result of the operations on one group of a group_by
+type GroupResult struct {
+	Group map[string]interface{} `json:"group"` // nil values are missing from the events
+	Meta  map[string]interface{} `json:"meta"`
+	Other bool                   `json:"other,omitempty"` // the groups after the limit
+}
+
+// applyOperations applies the operations to the events and returns the meta
+func applyOperations(ctx context.Context, dataName string, operations []Operation, events []DecodedEvent) (map[string]interface{}, error) {
+	return applySketchedOperations(ctx, dataName, operations, events, nil)
+}
+
+// applySketchedOperations applies the operations like applyOperations. When sketches is
+// not nil it holds a sketch for each approxUniqueCount operation by index: the sketches
+// which are set are used instead of sketching the events, and the others are set to the
+// sketch of the events so that they can be merged with the sketches of other events.
+func applySketchedOperations(ctx context.Context, dataName string, operations []Operation, events []DecodedEvent, sketches []*uniqueSketch) (map[string]interface{}, error) {
+	meta := make(map[string]interface{})
+	for i, operation := range operations {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := operation.metaName()
+		switch operation.Type {
+		case "count":
+			count, stdErr := weightedCount(events)
+			setWeightedMeta(meta, name, count, len(events), stdErr)
+		case "uniqueCount":
+			value, err := uniqueValueFunc(dataName, operation)
+			if err != nil {
+				return nil, err
+			}
+			uniqueCount, samples, stdErr := weightedUniqueCount(events, value)
+			setWeightedMeta(meta, name, uniqueCount, samples, stdErr)
+		case "approxUniqueCount":
+			var h *uniqueSketch
+			if sketches != nil {
+				h = sketches[i]
+			}
+			if h == nil {
+				var err error
+				h, err = approxUniqueSketch(dataName, operation, events)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if sketches != nil {
+				sketches[i] = h
+			}
+			uniqueCount, stdErr := h.estimate()
+			setWeightedMeta(meta, name, uniqueCount, h.samples, stdErr)
+		case "sum", "avg", "min", "max", "stddev", "percentile":
+			err := applyNumericOperation(meta, dataName, operation, events)
+			if err != nil {
+				return nil, err
+			}
+		case "group_by":
+			groups, err := groupBy(ctx, dataName, operation, events)
+			if err != nil {
+				return nil, err
+			}
+			meta[name] = groups
+		default:
+			if _, ok := percentileType(operation.Type); ok {
+				err := applyNumericOperation(meta, dataName, operation, events)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, invalidQueryf("unsupported operation type %q in %q", operation.Type, dataName)
+		}
+	}
+	return meta, nil
+}
+
+func setWeightedMeta(meta map[string]interface{}, name string, value interface{}, samples int, stdErr float64) {
+	meta[name] = value
+	meta[name+metaSamplesSuffix] = samples
+	meta[name+metaErrorSuffix] = stdErr
+}
+
+// writeKeyValue writes a value, or a missing value when ok is false, to a key made of
+// several values. Values are quoted so that a missing value differs from every value and
+// values can not run into each other.
+func writeKeyValue(b *strings.Builder, value string, ok bool) {
+	if ok {
+		fmt.Fprintf(b, "%q", value)
+	} else {
+		b.WriteString("-")
+	}
+}
+
+// eventValue returns the value of the key in the event
+func eventValue(event DecodedEvent, key string) (string, bool) {
+	for _, kv := range event.Data {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return "", false
+}
+
+// weightedCount estimates the number of events. Each event sampled at 1 in r is counted r
+// times and adds r(r-1) to the variance of the estimate.
+func weightedCount(events []DecodedEvent) (count int, stdErr float64) {
+	var variance float64
+	for _, event := range events {
+		r := getSamplerate(event.Samplerate)
+		count += r
+		variance += float64(r) * float64(r-1)
+	}
+	return count, math.Sqrt(variance)
+}
+
+// uniqueValueFunc returns a function giving the value counted by a uniqueCount or
+// approxUniqueCount operation. The values of several keys are combined into one value.
+// Events missing a key are skipped, or with missing set to null the key is counted as null.
+func uniqueValueFunc(dataName string, operation Operation) (func(event DecodedEvent) (string, bool), error) {
+	var keys []string
+	if operation.Key != "" {
+		keys = append(keys, operation.Key)
+	}
+	keys = append(keys, operation.Keys...)
+	if len(keys) == 0 {
+		return nil, invalidQueryf("%s in %q has no key", operation.Type, dataName)
+	}
+	var countNull bool
+	switch operation.Missing {
+	case "", "skip":
+	case "null":
+		countNull = true
+	default:
+		return nil, invalidQueryf("unsupported %s missing %q in %q", operation.Type, operation.Missing, dataName)
+	}
+
+	if len(keys) == 1 && !countNull {
+		return func(event DecodedEvent) (string, bool) {
+			return eventValue(event, keys[0])
+		}, nil
+	}
+	return func(event DecodedEvent) (string, bool) {
+		var unique strings.Builder
+		for _, key := range keys {
+			value, ok := eventValue(event, key)
+			if !ok && !countNull {
+				return "", false
+			}
+			writeKeyValue(&unique, value, ok)
+		}
+		return unique.String(), true
+	}, nil
+}
+
+// weightedUniqueCount estimates the number of unique values given by value. The number of
+// events with a value is estimated from the samplerates, which gives the probability that
+// the value was sampled at least once. Each sampled value is then weighted by the inverse
+// of that probability.
+func weightedUniqueCount(events []DecodedEvent, value func(event DecodedEvent) (string, bool)) (uniqueCount uint64, samples int, stdErr float64) {
+	type valueCount struct {
+		sampled   int
+		estimated float64
+	}
+	uniqueMap := make(map[string]*valueCount)
+
+	for _, event := range events {
+		value, ok := value(event)
+		if !ok {
+			continue
+		}
+		c, ok := uniqueMap[value]
+		if !ok {
+			c = &valueCount{}
+			uniqueMap[value] = c
+		}
+		c.sampled++
+		c.estimated += float64(getSamplerate(event.Samplerate))
+	}
+
+	var estimate, variance float64
+	for _, c := range uniqueMap {
+		p := float64(c.sampled) / c.estimated
+		pSampled := 1 - math.Pow(1-p, c.estimated)
+		estimate += 1 / pSampled
+		variance += (1 - pSampled) / (pSampled * pSampled)
+	}
+	return uint64(math.Round(estimate)), len(uniqueMap), math.Sqrt(variance)
+}
+
+// uniqueSketch is a HyperLogLog sketch of the values of an approxUniqueCount operation,
+// with the number of events it was given and the number of events they are estimated to
+// stand in for. Sketches of different events can be merged.
+type uniqueSketch struct {
+	hll       *sketch.HyperLogLog
+	samples   int
+	estimated float64
+}
+
+// approxUniqueSketch returns the sketch of the values of the operation keys in the events,
+// with the operation precision
+func approxUniqueSketch(dataName string, operation Operation, events []DecodedEvent) (*uniqueSketch, error) {
+	precision := operation.Precision
+	if precision == 0 {
+		precision = sketch.DefaultPrecision
+	}
+	hll, err := sketch.NewHyperLogLog(precision)
+	if err != nil {
+		return nil, invalidQueryf("approxUniqueCount in %q: %s", dataName, err)
+	}
+	uniqueValue, err := uniqueValueFunc(dataName, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &uniqueSketch{hll: hll}
+	for _, event := range events {
+		value, ok := uniqueValue(event)
+		if !ok {
+			continue
+		}
+		h.hll.AddString(value)
+		h.samples++
+		h.estimated += float64(getSamplerate(event.Samplerate))
+	}
+	return h, nil
+}
+
+// merge adds the events of o to the sketch
+func (h *uniqueSketch) merge(o *uniqueSketch) error {
+	err := h.hll.Merge(o.hll)
+	if err != nil {
+		return err
+	}
+	h.samples += o.samples
+	h.estimated += o.estimated
+	return nil
+}
+
+// estimate estimates the number of unique values with a fixed amount of memory however many
+// values there are. It is weighted like weightedUniqueCount, but as the sketch does not
+// count the events of each value every sampled value is taken to have the same share of
+// the sampled and estimated events. The standard error combines the error of that weighting
+// and the error of the sketch, which is relative to the estimate.
+func (h *uniqueSketch) estimate() (uniqueCount uint64, stdErr float64) {
+	sampled := float64(h.hll.Count())
+	if sampled == 0 {
+		return 0, 0
+	}
+	p := float64(h.samples) / h.estimated
+	pSampled := 1 - math.Pow(1-p, h.estimated/sampled)
+	estimate := sampled / pSampled
+	variance := sampled * (1 - pSampled) / (pSampled * pSampled)
+	sketchErr := estimate * h.hll.RelativeError()
+	return uint64(math.Round(estimate)), math.Sqrt(variance + sketchErr*sketchErr)
+}
+
+// percentileType returns the percentile of an operation type such as p50, p99 or p99.9
+func percentileType(operationType string) (float64, bool) {
+	if !strings.HasPrefix(operationType, "p") {
+		return 0, false
+	}
+	percentile, err := strconv.ParseFloat(operationType[1:], 64)
+	if err != nil {
+		return 0, false
+	}
+	return percentile, true
+}
+
+// numericStats are the statistics of the numeric values of a key, weighted by samplerate
+type numericStats struct {
+	samples  int
+	weight   float64 // Σ r
+	sum      float64 // Σ r x
+	sumSq    float64 // Σ r x²
+	variance float64 // Σ r(r-1) x², the variance of sum
+	min, max float64
+	digest   *sketch.TDigest
+}
+
+// weightedNumericStats reads the values of the key which are numbers. The digest is only
+// built for percentiles.
+func weightedNumericStats(events []DecodedEvent, key string, percentiles bool) numericStats {
+	stats := numericStats{min: math.Inf(1), max: math.Inf(-1)}
+	if percentiles {
+		stats.digest = sketch.NewTDigest(sketch.DefaultCompression)
+	}
+	for _, event := range events {
+		value, ok := eventValue(event, key)
+		if !ok {
+			continue
+		}
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+			continue
+		}
+		r := float64(getSamplerate(event.Samplerate))
+		stats.samples++
+		stats.weight += r
+		stats.sum += r * x
+		stats.sumSq += r * x * x
+		stats.variance += r * (r - 1) * x * x
+		stats.min = math.Min(stats.min, x)
+		stats.max = math.Max(stats.max, x)
+		if stats.digest != nil {
+			stats.digest.Add(x, r)
+		}
+	}
+	return stats
+}
+
+// applyNumericOperation sets the result of a sum, avg, min, max, stddev or percentile
+// operation in meta. Values of the key which are not numbers are skipped, and the result of
+// every operation but sum is null without values.
+func applyNumericOperation(meta map[string]interface{}, dataName string, operation Operation, events []DecodedEvent) error {
+	if operation.Key == "" {
+		return invalidQueryf("%s operation in %q has no key", operation.Type, dataName)
+	}
+	percentile, isPercentile := percentileType(operation.Type)
+	if operation.Type == "percentile" {
+		percentile, isPercentile = operation.Percentile, true
+	}
+	if isPercentile && (percentile < 0 || percentile > 100 || math.IsNaN(percentile)) {
+		return invalidQueryf("%s operation in %q has a percentile outside of 0 to 100", operation.Type, dataName)
+	}
+
+	name := operation.metaName()
+	stats := weightedNumericStats(events, operation.Key, isPercentile)
+	var value interface{}
+	var mean, stddev float64
+	if stats.samples > 0 {
+		mean = stats.sum / stats.weight
+		stddev = math.Sqrt(math.Max(stats.sumSq/stats.weight-mean*mean, 0))
+		switch {
+		case isPercentile:
+			value = stats.digest.Quantile(percentile / 100)
+		case operation.Type == "avg":
+			value = mean
+		case operation.Type == "min":
+			value = stats.min
+		case operation.Type == "max":
+			value = stats.max
+		case operation.Type == "stddev":
+			value = stddev
+		}
+	}
+
+	switch operation.Type {
+	case "sum":
+		setWeightedMeta(meta, name, stats.sum, stats.samples, math.Sqrt(stats.variance))
+	case "avg":
+		// The standard error of the mean of the sampled values
+		var stdErr float64
+		if stats.samples > 0 {
+			stdErr = stddev / math.Sqrt(float64(stats.samples))
+		}
+		setWeightedMeta(meta, name, value, stats.samples, stdErr)
+	default:
+		meta[name] = value
+		meta[name+metaSamplesSuffix] = stats.samples
+	}
+	return nil
+}
+
+// eventGroup is the events with the same values for the group_by keys
+type eventGroup struct {
+	values   []*string
+	events   []DecodedEvent
+	result   GroupResult
+	sketches []*uniqueSketch // of the approxUniqueCount operations, merged into the other group
+}
+
+// groupBy splits the events by the values of the operation keys and applies the operation's
+// operations to each group
+func groupBy(ctx context.Context, dataName string, operation Operation, events []DecodedEvent) ([]GroupResult, error) {
+	if len(operation.Keys) == 0 {
+		return nil, invalidQueryf("group_by in %q has no keys", dataName)
+	}
+	if operation.Limit < 0 {
+		return nil, invalidQueryf("group_by in %q has a negative limit", dataName)
+	}
+	descending := operation.OrderBy != ""
+	switch operation.Order {
+	case "":
+	case "asc":
+		descending = false
+	case "desc":
+		descending = true
+	default:
+		return nil, invalidQueryf("unsupported group_by order %q in %q", operation.Order, dataName)
+	}
+
+	groupMap := make(map[string]*eventGroup)
+	var groups []*eventGroup
+	for i, event := range events {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+		values := make([]*string, len(operation.Keys))
+		var groupKey strings.Builder
+		for i, key := range operation.Keys {
+			value, ok := eventValue(event, key)
+			if ok {
+				values[i] = &value
+			}
+			writeKeyValue(&groupKey, value, ok)
+		}
+		group, ok := groupMap[groupKey.String()]
+		if !ok {
+			group = &eventGroup{values: values}
+			groupMap[groupKey.String()] = group
+			groups = append(groups, group)
+		}
+		group.events = append(group.events, event)
+	}
+
+	for _, group := range groups {
+		group.sketches = make([]*uniqueSketch, len(operation.Operations))
+		meta, err := applySketchedOperations(ctx, dataName, operation.Operations, group.events, group.sketches)
+		if err != nil {
+			return nil, err
+		}
+		group.result = GroupResult{Group: make(map[string]interface{}), Meta: meta}
+		for i, key := range operation.Keys {
+			if group.values[i] != nil {
+				group.result.Group[key] = *group.values[i]
+			} else {
+				group.result.Group[key] = nil
+			}
+		}
+	}
+
+	if operation.OrderBy != "" && len(groups) > 0 {
+		if _, ok := groups[0].result.Meta[operation.OrderBy]; !ok {
+			return nil, invalidQueryf("unknown group_by orderBy %q in %q", operation.OrderBy, dataName)
+		}
+	}
+
+	var orderErr error
+	sort.SliceStable(groups, func(i, j int) bool {
+		c, err := compareGroups(groups[i], groups[j], operation.OrderBy, descending)
+		if err != nil {
+			orderErr = err
+		}
+		return c < 0
+	})
+	if orderErr != nil {
+		return nil, invalidQueryf("group_by in %q: %s", dataName, orderErr)
+	}
+
+	results := []GroupResult{}
+	for i, group := range groups {
+		if operation.Limit > 0 && i == operation.Limit {
+			break
+		}
+		results = append(results, group.result)
+	}
+
+	if operation.Other && operation.Limit > 0 && len(groups) > operation.Limit {
+		var otherEvents []DecodedEvent
+		sketches := make([]*uniqueSketch, len(operation.Operations))
+		for _, group := range groups[operation.Limit:] {
+			otherEvents = append(otherEvents, group.events...)
+			for i, h := range group.sketches {
+				if h == nil {
+					continue
+				}
+				if sketches[i] == nil {
+					hll, _ := sketch.NewHyperLogLog(h.hll.Precision())
+					sketches[i] = &uniqueSketch{hll: hll}
+				}
+				if err := sketches[i].merge(h); err != nil {
+					return nil, err
+				}
+			}
+		}
+		meta, err := applySketchedOperations(ctx, dataName, operation.Operations, otherEvents, sketches)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, GroupResult{Group: map[string]interface{}{}, Meta: meta, Other: true})
+	}
+
+	return results, nil
+}
+
+// compareGroups compares groups by the result named orderBy, and then by their values in
+// ascending order. Without orderBy the values are compared in the requested order. Missing
+// values and null results sort first.
+func compareGroups(a, b *eventGroup, orderBy string, descending bool) (int, error) {
+	if orderBy != "" {
+		x, y := a.result.Meta[orderBy], b.result.Meta[orderBy]
+		xf, xok := toFloat64(x)
+		yf, yok := toFloat64(y)
+		if (!xok && x != nil) || (!yok && y != nil) {
+			return 0, fmt.Errorf("orderBy %q is not a number", orderBy)
+		}
+		c := 0
+		switch {
+		case x == nil && y == nil:
+		case x == nil:
+			c = -1
+		case y == nil:
+			c = 1
+		case xf < yf:
+			c = -1
+		case xf > yf:
+			c = 1
+		}
+		if descending {
+			c = -c
+		}
+		if c != 0 {
+			return c, nil
+		}
+	}
+
+	c := 0
+	for i := range a.values {
+		x, y := a.values[i], b.values[i]
+		if x == nil && y == nil {
+			continue
+		} else if x == nil {
+			c = -1
+		} else if y == nil {
+			c = 1
+		} else {
+			c = strings.Compare(*x, *y)
+		}
+		if c != 0 {
+			break
+		}
+	}
+	if orderBy == "" && descending {
+		c = -c
+	}
+	return c, nil
+}
+
+// toFloat64 converts a numeric result to a float64
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func testEvent(id uint64, samplerate int, data ...string) DecodedEvent {
+	event := DecodedEvent{ID: id, TS: id, Tag: "tag", Samplerate: samplerate}
+	for i := 0; i+1 < len(data); i += 2 {
+		event.Data = append(event.Data, DecodedEventData{data[i], data[i+1]})
+	}
+	return event
+}
+
+func Test_groupBy(t *testing.T) {
+	events := []DecodedEvent{
+		testEvent(1, 1, "path", "/a", "status", "200"),
+		testEvent(2, 1, "status", "500", "path", "/a"),
+		testEvent(3, 1, "path", "/b", "status", "200"),
+		testEvent(4, 1, "path", "/a", "status", "200"),
+		testEvent(5, 5, "path", "/c"),
+	}
+	count := []Operation{{Type: "count"}}
+	group := func(meta map[string]interface{}, other bool, values ...interface{}) GroupResult {
+		g := GroupResult{Group: map[string]interface{}{}, Meta: meta, Other: other}
+		for i := 0; i+1 < len(values); i += 2 {
+			g.Group[values[i].(string)] = values[i+1]
+		}
+		return g
+	}
+	countMeta := func(count, samples int) map[string]interface{} {
+		return map[string]interface{}{"count": count, "countSamples": samples, "countError": 0.0}
+	}
+
+	tests := []struct {
+		name      string
+		operation Operation
+		want      []GroupResult
+		wantErr   bool
+	}{
+		{
+			name:      "By group values",
+			operation: Operation{Type: "group_by", Keys: []string{"path", "status"}, Operations: count},
+			want: []GroupResult{
+				group(countMeta(2, 2), false, "path", "/a", "status", "200"),
+				group(countMeta(1, 1), false, "path", "/a", "status", "500"),
+				group(countMeta(1, 1), false, "path", "/b", "status", "200"),
+				group(map[string]interface{}{"count": 5, "countSamples": 1, "countError": 4.47213595499958}, false, "path", "/c", "status", nil),
+			},
+		},
+		{
+			name:      "Top N with other",
+			operation: Operation{Type: "group_by", Keys: []string{"path"}, Operations: count, OrderBy: "countSamples", Limit: 1, Other: true},
+			want: []GroupResult{
+				group(countMeta(3, 3), false, "path", "/a"),
+				group(map[string]interface{}{"count": 6, "countSamples": 2, "countError": 4.47213595499958}, true),
+			},
+		},
+		{
+			name:      "Ascending",
+			operation: Operation{Type: "group_by", Keys: []string{"status"}, Operations: count, OrderBy: "countSamples", Order: "asc"},
+			want: []GroupResult{
+				group(map[string]interface{}{"count": 5, "countSamples": 1, "countError": 4.47213595499958}, false, "status", nil),
+				group(countMeta(1, 1), false, "status", "500"),
+				group(countMeta(3, 3), false, "status", "200"),
+			},
+		},
+		{
+			name:      "No keys",
+			operation: Operation{Type: "group_by", Operations: count},
+			wantErr:   true,
+		},
+		{
+			name:      "Unknown orderBy",
+			operation: Operation{Type: "group_by", Keys: []string{"path"}, Operations: count, OrderBy: "sum"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := groupBy(context.Background(), "test", tt.operation, events)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("groupBy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groupBy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A group without values for the orderBy result sorts like a missing value
+	for order, want := range map[string][]interface{}{"desc": {"/a", "/b", "/c"}, "asc": {"/c", "/b", "/a"}} {
+		operation := Operation{Type: "group_by", Keys: []string{"path"}, Operations: []Operation{{Type: "max", Key: "status"}}, OrderBy: "max", Order: order}
+		got, err := groupBy(context.Background(), "test", operation, events)
+		if err != nil {
+			t.Fatalf("groupBy() ordered %s by a null result error = %v", order, err)
+		}
+		var paths []interface{}
+		for _, group := range got {
+			paths = append(paths, group.Group["path"])
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("groupBy() ordered %s by a null result = %v, want %v", order, paths, want)
+		}
+	}
+}
+
+func Test_applyOperations_numeric(t *testing.T) {
+	events := []DecodedEvent{
+		testEvent(1, 1, "ms", "1", "path", "/a"),
+		testEvent(2, 1, "ms", "2", "path", "/a"),
+		testEvent(3, 2, "ms", "3", "path", "/b"),
+		testEvent(4, 1, "ms", "slow", "path", "/b"),
+		testEvent(5, 1, "path", "/b"),
+	}
+	stddev := math.Sqrt(23.0/4 - 2.25*2.25)
+
+	tests := []struct {
+		operation Operation
+		want      map[string]interface{}
+	}{
+		{Operation{Type: "sum", Key: "ms"}, map[string]interface{}{"sum": 9.0, "sumSamples": 3, "sumError": math.Sqrt(18)}},
+		{Operation{Type: "avg", Key: "ms"}, map[string]interface{}{"avg": 2.25, "avgSamples": 3, "avgError": stddev / math.Sqrt(3)}},
+		{Operation{Type: "min", Key: "ms"}, map[string]interface{}{"min": 1.0, "minSamples": 3}},
+		{Operation{Type: "max", Key: "ms"}, map[string]interface{}{"max": 3.0, "maxSamples": 3}},
+		{Operation{Type: "stddev", Key: "ms"}, map[string]interface{}{"stddev": stddev, "stddevSamples": 3}},
+		{Operation{Type: "p50", Key: "ms"}, map[string]interface{}{"p50": 2 + 1.0/3, "p50Samples": 3}},
+		{Operation{Type: "p100", Key: "ms"}, map[string]interface{}{"p100": 3.0, "p100Samples": 3}},
+		{Operation{Type: "percentile", Key: "ms", Percentile: 0, Name: "fastest"}, map[string]interface{}{"fastest": 1.0, "fastestSamples": 3}},
+		{Operation{Type: "avg", Key: "missing"}, map[string]interface{}{"avg": nil, "avgSamples": 0, "avgError": 0.0}},
+		{Operation{Type: "sum", Key: "missing"}, map[string]interface{}{"sum": 0.0, "sumSamples": 0, "sumError": 0.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.operation.metaName(), func(t *testing.T) {
+			got, err := applyOperations(context.Background(), "test", []Operation{tt.operation}, events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("applyOperations() = %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				x, xok := toFloat64(got[name])
+				y, yok := toFloat64(want)
+				if xok != yok || (xok && math.Abs(x-y) > 1e-9) || (!xok && got[name] != want) {
+					t.Errorf("applyOperations()[%q] = %v, want %v", name, got[name], want)
+				}
+			}
+		})
+	}
+
+	groups, err := groupBy(context.Background(), "test", Operation{Type: "group_by", Keys: []string{"path"}, Operations: []Operation{{Type: "p50", Key: "ms"}}}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Meta["p50"] != 1.5 || groups[1].Meta["p50"] != 3.0 {
+		t.Errorf("groupBy() = %v", groups)
+	}
+
+	for _, operation := range []Operation{{Type: "sum"}, {Type: "p101", Key: "ms"}, {Type: "percentile", Key: "ms", Percentile: -1}} {
+		if _, err := applyOperations(context.Background(), "test", []Operation{operation}, events); err == nil {
+			t.Errorf("applyOperations(%v) error = nil, want *InvalidQueryError", operation)
+		} else if _, ok := err.(*InvalidQueryError); !ok {
+			t.Errorf("applyOperations(%v) error = %v, want *InvalidQueryError", operation, err)
+		}
+	}
+}
+
+func Test_applyOperations_approxUniqueCount(t *testing.T) {
+	var events []DecodedEvent
+	for i := 0; i < 1000; i++ {
+		events = append(events, testEvent(uint64(i), 1, "path", "/a", "user", strconv.Itoa(i%100)))
+	}
+	events = append(events, testEvent(1000, 1, "path", "/b"))
+
+	meta, err := applyOperations(context.Background(), "test", []Operation{{Type: "approxUniqueCount", Key: "user", Precision: 10}}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"approxUniqueCount": uint64(100), "approxUniqueCountSamples": 1000, "approxUniqueCountError": 100 * 1.04 / 32}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("applyOperations() = %v, want %v", meta, want)
+	}
+
+	if _, err := applyOperations(context.Background(), "test", []Operation{{Type: "approxUniqueCount", Key: "user", Precision: 30}}, events); err == nil {
+		t.Errorf("applyOperations() with precision 30 error = nil, want *InvalidQueryError")
+	}
+
+	// Sampled events are weighted like uniqueCount
+	for i := range events {
+		events[i].Samplerate = 10
+	}
+	operations := []Operation{{Type: "approxUniqueCount", Key: "user"}, {Type: "uniqueCount", Key: "user"}}
+	meta, err = applyOperations(context.Background(), "test", operations, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["approxUniqueCount"] != meta["uniqueCount"] || meta["approxUniqueCountError"].(float64) < meta["uniqueCountError"].(float64) {
+		t.Errorf("applyOperations() with samplerate = %v, want the uniqueCount", meta)
+	}
+
+	// The other group merges the sketches of its groups
+	groupBy := Operation{Type: "group_by", Keys: []string{"user"}, Limit: 10, Other: true, Operations: operations}
+	meta, err = applyOperations(context.Background(), "test", []Operation{groupBy}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := meta["group_by"].([]GroupResult)
+	if other := groups[len(groups)-1]; !other.Other || other.Meta["approxUniqueCount"] != other.Meta["uniqueCount"] {
+		t.Errorf("applyOperations() other group = %v, want the uniqueCount", other)
+	}
+}
+
+func Test_applyOperations_uniqueCount(t *testing.T) {
+	events := []DecodedEvent{
+		testEvent(1, 1, "path", "/a"),
+		testEvent(2, 1, "colour", "red", "user", "a"),
+		testEvent(3, 1, "user", "a", "colour", "blue"),
+		testEvent(4, 1, "user", "b", "colour", "red"),
+		testEvent(5, 1, "user", "a", "colour", "red"),
+		testEvent(6, 1, "user", "c"),
+		testEvent(7, 1, "user", "c"),
+	}
+
+	tests := []struct {
+		name      string
+		operation Operation
+		want      uint64
+	}{
+		{"Key", Operation{Type: "uniqueCount", Key: "user"}, 3},
+		{"Key counting null", Operation{Type: "uniqueCount", Key: "user", Missing: "null"}, 4},
+		{"Composite keys", Operation{Type: "uniqueCount", Keys: []string{"user", "colour"}}, 3},
+		{"Composite keys counting null", Operation{Type: "uniqueCount", Keys: []string{"user", "colour"}, Missing: "null"}, 5},
+		{"Key and keys", Operation{Type: "uniqueCount", Key: "user", Keys: []string{"colour"}, Missing: "skip"}, 3},
+		{"Approximate composite keys", Operation{Type: "approxUniqueCount", Keys: []string{"user", "colour"}, Missing: "null"}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := applyOperations(context.Background(), "test", []Operation{tt.operation}, events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := meta[tt.operation.metaName()]; got != tt.want {
+				t.Errorf("applyOperations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, operation := range []Operation{{Type: "uniqueCount"}, {Type: "uniqueCount", Key: "user", Missing: "zero"}} {
+		if _, err := applyOperations(context.Background(), "test", []Operation{operation}, events); err == nil {
+			t.Errorf("applyOperations(%v) error = nil, want *InvalidQueryError", operation)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"math"
+	"sort"
+
+	"github.com/aaron7/eventstore/pkg/db"
+)
+
+// Result orders. Without an order the events are returned in ID order.
+const (
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// eventCursor is the position of the last event of a page. A cursor is encoded as
+// base64(order ts8 id8) so that it can only be used with the order it was created for.
+type eventCursor struct {
+	order string
+	ts    uint64
+	id    uint64
+}
+
+func encodeCursor(order string, event DecodedEvent) string {
+	b := make([]byte, 0, 17)
+	b = append(b, cursorOrderByte(order))
+	b = append(b, uint64ToBytes(event.TS)...)
+	b = append(b, uint64ToBytes(event.ID)...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(data Data) (*eventCursor, error) {
+	if data.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(data.Cursor)
+	if err != nil || len(b) != 17 {
+		return nil, invalidQueryf("invalid cursor in %q", data.Name)
+	}
+	if b[0] != cursorOrderByte(data.Order) {
+		return nil, invalidQueryf("cursor in %q was created for another order", data.Name)
+	}
+	return &eventCursor{order: data.Order, ts: bytesToUint64(b[1:9]), id: bytesToUint64(b[9:])}, nil
+}
+
+func cursorOrderByte(order string) byte {
+	switch order {
+	case orderAsc:
+		return 'a'
+	case orderDesc:
+		return 'd'
+	}
+	return 'i'
+}
+
+// before reports whether event a comes before event b in the order
+func before(order string, a, b DecodedEvent) bool {
+	switch order {
+	case orderAsc:
+		return a.TS < b.TS || (a.TS == b.TS && a.ID < b.ID)
+	case orderDesc:
+		return a.TS > b.TS || (a.TS == b.TS && a.ID > b.ID)
+	}
+	return a.ID < b.ID
+}
+
+// after reports whether the event comes after the cursor
+func (c *eventCursor) after(event DecodedEvent) bool {
+	return c == nil || before(c.order, DecodedEvent{TS: c.ts, ID: c.id}, event)
+}
+
+// validatePagination checks the limit, order and cursor of the data block
+func (d Data) validatePagination() (*eventCursor, error) {
+	if d.Limit < 0 {
+		return nil, invalidQueryf("negative limit in %q", d.Name)
+	}
+	switch d.Order {
+	case "", orderAsc, orderDesc:
+	default:
+		return nil, invalidQueryf("unsupported order %q in %q", d.Order, d.Name)
+	}
+	return decodeCursor(d)
+}
+
+// pageEvents orders the events and returns the page after the cursor, with the cursor of
+// the next page if there are more events
+func pageEvents(data Data, cursor *eventCursor, events []DecodedEvent) ([]DecodedEvent, string) {
+	if data.Order != "" {
+		events = append([]DecodedEvent{}, events...)
+		sort.Slice(events, func(i, j int) bool {
+			return before(data.Order, events[i], events[j])
+		})
+	}
+	if cursor != nil {
+		i := sort.Search(len(events), func(i int) bool {
+			return cursor.after(events[i])
+		})
+		events = events[i:]
+	}
+	if data.Limit > 0 && len(events) > data.Limit {
+		events = events[:data.Limit]
+		return events, encodeCursor(data.Order, events[len(events)-1])
+	}
+	return events, ""
+}
+
+// canScanInOrder reports whether the page of the data block can be read by scanning the
+// tag index in ts order and stopping at the limit, which needs every event only for
+// operations, time series, funnels and the in_result filters of other blocks
+func (d Data) canScanInOrder(query Query) bool {
+	return d.Limit > 0 && d.Order != "" && len(d.Operations) == 0 && d.Granularity == "" &&
+		len(query.resultKeys(d.Name)) == 0
+}
+
+// scansInOrder reports whether the page of the data block is read by scanning the tag index
+// in ts order. With filters the scan reads the record of every event until the page is
+// full, which is about the limit over the share of the tag the filters are estimated to
+// match. The filters and the key fetches of the index path are used instead when they are
+// estimated to read less.
+func (s *Store) scansInOrder(query Query, data Data) (bool, error) {
+	if !data.canScanInOrder(query) {
+		return false, nil
+	}
+	if len(data.Filters) == 0 {
+		return true, nil
+	}
+	tagCount, err := s.statistic(getTagStatsKey(data.Tag))
+	if err != nil || tagCount == 0 {
+		return true, err
+	}
+	plan, err := s.planFilters(data)
+	if err != nil {
+		return false, err
+	}
+
+	// The filters of a block all have to match, so it matches at most the fewest events of
+	// one of them. The plan is sorted by estimate.
+	matched := plan.steps[0].estimate
+	records := float64(tagCount)
+	if matched > 0 {
+		records = math.Min(records, float64(data.Limit+1)*float64(tagCount)/float64(matched))
+	}
+
+	var indexKeys float64
+	fetchedKeysMap := make(map[string]struct{})
+	for _, step := range plan.steps {
+		indexKeys += float64(step.estimate)
+		if step.filter.addsKey() {
+			fetchedKeysMap[step.filter.Key] = struct{}{}
+		}
+	}
+	if data.allKeys() {
+		indexKeys += float64(matched) * seekCost
+	} else {
+		for _, key := range backfillKeys(data, data.requiredKeys(), fetchedKeysMap) {
+			count, err := s.statistic(getDimensionStatsKey(data.Tag, key))
+			if err != nil {
+				return false, err
+			}
+			indexKeys += float64(count)
+		}
+	}
+	return records*seekCost <= indexKeys, nil
+}
+
+// scanEventsInOrder returns the page of the data block by scanning the tag index in the
+// order of the block from the cursor. Filters are checked against the event records, so the
+// scan stops as soon as the page is full.
+func (s *Store) scanEventsInOrder(ctx context.Context, data Data, r timeRange, cursor *eventCursor) ([]DecodedEvent, string, error) {
+	events := []DecodedEvent{}
+	var next string
+	counters := newScanCounters(ctx)
+	defer counters.flush()
+	err := s.scanTagIndexInOrder(ctx, data.Tag, r, data.Order == orderDesc, cursor, func(entry eventIndexEntry) error {
+		if err := counters.scannedKey(); err != nil {
+			return err
+		}
+		value, exists, err := s.DB.LookupValue(getEventRecordKey(entry.eventID))
+		if err != nil || !exists {
+			return err
+		}
+		counters.decodedBytes(len(value))
+		record, err := decodeEventRecord(value)
+		if err != nil {
+			return err
+		}
+		for _, filter := range data.Filters {
+			matched, err := matchFilter(data, filter, record)
+			if err != nil || !matched {
+				return err
+			}
+		}
+
+		event := DecodedEvent{ID: entry.eventID, TS: entry.ts, Tag: data.Tag, Samplerate: entry.samplerate}
+		if len(events) == data.Limit {
+			next = encodeCursor(data.Order, events[len(events)-1])
+			return db.ErrStopIteration
+		}
+		event.Data = recordData(data, record)
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return events, next, nil
+}
+
+// recordData returns the data of a record in the order the index scans add it: the keys of
+// the filters which add their key, and then the remaining keys of the block
+func recordData(data Data, record Event) []DecodedEventData {
+	values := record.values()
+	fetched := make(map[string]struct{})
+	var eventData []DecodedEventData
+	add := func(key string) {
+		if _, ok := fetched[key]; ok {
+			return
+		}
+		fetched[key] = struct{}{}
+		if value, ok := values[key]; ok {
+			eventData = append(eventData, DecodedEventData{key, value})
+		}
+	}
+
+	for _, filter := range data.Filters {
+		if filter.addsKey() {
+			add(filter.Key)
+		}
+	}
+	if data.allKeys() {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add(key)
+		}
+		return eventData
+	}
+	for _, key := range data.requiredKeys() {
+		add(key)
+	}
+	return eventData
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestStore_QueryEvents_pagination(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1003, Data: map[string]string{"path": "/a", "user": "a"}},
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"path": "/b", "user": "b"}},
+		{Tag: "tag1", TS: 1005, Data: map[string]string{"path": "/a"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"path": "/a", "user": "c"}, Numbers: map[string]float64{"ms": 5}},
+		{Tag: "tag1", TS: 1003, Data: map[string]string{"path": "/a", "user": "d"}},
+		{Tag: "tag2", TS: 1004, Data: map[string]string{"path": "/a"}},
+	})
+
+	tests := []struct {
+		name  string
+		data  Data
+		pages [][]uint64
+	}{
+		{"ID order", Data{Tag: "tag1", Limit: 2}, [][]uint64{{1, 2}, {3, 4}, {5}}},
+		{"ts ascending", Data{Tag: "tag1", Limit: 2, Order: "asc"}, [][]uint64{{2, 4}, {1, 5}, {3}}},
+		{"ts descending", Data{Tag: "tag1", Limit: 2, Order: "desc"}, [][]uint64{{3, 5}, {1, 4}, {2}}},
+		{"Latest with filters", Data{Tag: "tag1", Limit: 1, Order: "desc", Keys: []string{"user"}, Filters: []Filter{
+			{Type: "eq", Key: "path", Value: "/a"},
+			{Type: "or", Filters: []Filter{{Type: "exists", Key: "user"}, {Type: "gt", Key: "ms", Value: "1"}}},
+		}}, [][]uint64{{5}, {1}, {4}}},
+		{"Time range", Data{Tag: "tag1", Start: 1002, End: 1005, Limit: 2, Order: "desc"}, [][]uint64{{5, 1}, {4}}},
+		{"Exact pages", Data{Tag: "tag1", Limit: 5, Order: "asc"}, [][]uint64{{2, 4, 1, 5, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The same pages are returned by the scan in order and by paging every event,
+			// which is needed for the operations
+			for _, operations := range [][]Operation{nil, {{Type: "count"}}} {
+				data := tt.data
+				data.Operations = operations
+				for i, want := range tt.pages {
+					result, err := s.QueryEvents(context.Background(), Query{Data: []Data{data}})
+					if err != nil {
+						t.Fatal(err)
+					}
+					got := []uint64{}
+					for _, event := range result.Data[0].Result {
+						got = append(got, event.ID)
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("QueryEvents() page %d with operations %v = %v, want %v", i, operations, got, want)
+					}
+					if last := i == len(tt.pages)-1; last != (result.Data[0].Cursor == "") {
+						t.Fatalf("QueryEvents() page %d cursor = %q", i, result.Data[0].Cursor)
+					}
+					data.Cursor = result.Data[0].Cursor
+				}
+			}
+		})
+	}
+
+	// Both ways of reading a page return the same event data
+	data := Data{Tag: "tag1", Limit: 3, Order: "desc", Keys: []string{"*"}, Filters: []Filter{{Type: "prefix", Key: "path", Value: "/"}}}
+	scanned, err := s.QueryEvents(context.Background(), Query{Data: []Data{data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Operations = []Operation{{Type: "count"}}
+	paged, err := s.QueryEvents(context.Background(), Query{Data: []Data{data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scanned.Data[0].Result, paged.Data[0].Result) {
+		t.Errorf("QueryEvents() scanned %v, paged %v", scanned.Data[0].Result, paged.Data[0].Result)
+	}
+	if paged.Data[0].Meta["count"] != 5 {
+		t.Errorf("QueryEvents() count = %v, want 5", paged.Data[0].Meta["count"])
+	}
+}
+
+func TestStore_QueryEvents_paginationInvalid(t *testing.T) {
+	s := newTestStore(t, []Event{{Tag: "tag1", TS: 1001}, {Tag: "tag1", TS: 1002}})
+	result, err := s.QueryEvents(context.Background(), Query{Data: []Data{{Tag: "tag1", Limit: 1, Order: "asc"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data Data
+	}{
+		{"Negative limit", Data{Tag: "tag1", Limit: -1}},
+		{"Unsupported order", Data{Tag: "tag1", Order: "random"}},
+		{"Invalid cursor", Data{Tag: "tag1", Cursor: "not a cursor"}},
+		{"Cursor of another order", Data{Tag: "tag1", Order: "desc", Cursor: result.Data[0].Cursor}},
+		{"Unsupported filter", Data{Tag: "tag1", Limit: 1, Order: "asc", Filters: []Filter{{Type: "unknown"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.QueryEvents(context.Background(), Query{Data: []Data{tt.data}})
+			if _, ok := err.(*InvalidQueryError); !ok {
+				t.Errorf("QueryEvents() error = %v, want *InvalidQueryError", err)
+			}
+		})
+	}
+}
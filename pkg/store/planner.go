@@ -0,0 +1,329 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Filter strategies
+const (
+	// strategyScan scans the index of the filter and intersects it with the candidates
+	strategyScan = "scan"
+	// strategySeek reads the record of every candidate and checks it against the filter
+	strategySeek = "seek"
+)
+
+// seekCost is how many index entries cost about as much to read as the record of one
+// candidate, which is a seek and a decode instead of the next key of a scan
+const seekCost = 16
+
+// filterStep is a filter of a data block in the order the plan applies it
+type filterStep struct {
+	filter     Filter
+	index      int    // the position of the filter in the data block
+	estimate   uint64 // events of the tag the filter is estimated to match
+	strategy   string
+	concurrent bool // scanned at the same time as the other concurrent steps
+}
+
+// filterPlan is the order and strategy of the filters of a data block
+type filterPlan struct {
+	steps []filterStep
+}
+
+// planFilters orders the filters of the data block from the fewest estimated events to the
+// most, so that the first scans produce the fewest candidates. A later filter is checked
+// against the records of the candidates when that is estimated to read less than scanning
+// its index. The leading filters which scan an index of their own are scanned concurrently.
+func (s *Store) planFilters(data Data) (filterPlan, error) {
+	tagCount, err := s.statistic(getTagStatsKey(data.Tag))
+	if err != nil {
+		return filterPlan{}, err
+	}
+
+	steps := make([]filterStep, len(data.Filters))
+	for i, filter := range data.Filters {
+		estimate, err := s.estimateFilter(data.Tag, filter, tagCount)
+		if err != nil {
+			return filterPlan{}, err
+		}
+		steps[i] = filterStep{filter: filter, index: i, estimate: estimate, strategy: strategyScan}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].estimate < steps[j].estimate
+	})
+
+	// Filters are assumed to be independent, so each one keeps its share of the candidates
+	candidates := float64(tagCount)
+	for i := range steps {
+		if i > 0 && candidates*seekCost < float64(steps[i].estimate) {
+			steps[i].strategy = strategySeek
+		}
+		if tagCount > 0 {
+			candidates *= float64(steps[i].estimate) / float64(tagCount)
+		}
+	}
+
+	leading := 0
+	for leading < len(steps) && steps[leading].strategy == strategyScan && steps[leading].filter.addsKey() {
+		leading++
+	}
+	if leading > 1 {
+		for i := 0; i < leading; i++ {
+			steps[i].concurrent = true
+		}
+	}
+	return filterPlan{steps: steps}, nil
+}
+
+// estimateFilter returns the estimated number of events of the tag matched by the filter.
+// Filters which read values of the dimension other than their own are estimated to match
+// every event with the dimension.
+func (s *Store) estimateFilter(tag string, filter Filter, tagCount uint64) (uint64, error) {
+	if positive, ok := negatedFilterTypes[filter.Type]; ok {
+		filter.Type = positive
+		estimate, err := s.estimateFilter(tag, filter, tagCount)
+		return complementEstimate(tagCount, estimate), err
+	}
+
+	switch filter.Type {
+	case "eq":
+		return s.statistic(getValueStatsKey(tag, filter.Key, filter.Value))
+	case "in":
+		// The values of a large in_result filter are estimated to match about as many
+		// events as they were read from, without looking up each of them
+		if filter.valueSet != nil {
+			estimate, err := s.statistic(getDimensionStatsKey(tag, filter.Key))
+			if uint64(filter.resultEvents) < estimate {
+				estimate = uint64(filter.resultEvents)
+			}
+			return estimate, err
+		}
+		var estimate uint64
+		seen := make(map[string]struct{})
+		for _, value := range filter.Values {
+			if _, ok := seen[value]; ok {
+				continue
+			}
+			seen[value] = struct{}{}
+			count, err := s.statistic(getValueStatsKey(tag, filter.Key, value))
+			if err != nil {
+				return 0, err
+			}
+			estimate += count
+		}
+		return estimate, nil
+	case "and", "or", "not":
+		var estimate uint64
+		for i, childFilter := range filter.Filters {
+			childEstimate, err := s.estimateFilter(tag, childFilter, tagCount)
+			if err != nil {
+				return 0, err
+			}
+			switch {
+			case filter.Type == "or":
+				estimate += childEstimate
+			case i == 0 || childEstimate < estimate:
+				estimate = childEstimate
+			}
+		}
+		if filter.Type == "not" {
+			return complementEstimate(tagCount, estimate), nil
+		}
+		if estimate > tagCount {
+			return tagCount, nil
+		}
+		return estimate, nil
+	}
+	return s.statistic(getDimensionStatsKey(tag, filter.Key))
+}
+
+func complementEstimate(tagCount, estimate uint64) uint64 {
+	if estimate > tagCount {
+		return 0
+	}
+	return tagCount - estimate
+}
+
+// reordered reports whether the plan applies the filters in another order than they were
+// written
+func (p filterPlan) reordered() bool {
+	for i, step := range p.steps {
+		if step.index != i {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFilters returns the events of the data block which match every filter, sorted by ID,
+// with the keys of the filters which were added to their data
+func (s *Store) applyFilters(ctx context.Context, data Data, r timeRange, profile *queryProfile) ([]DecodedEvent, map[string]struct{}, error) {
+	plan, err := s.planFilters(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var events []DecodedEvent
+	fetchedKeysMap := make(map[string]struct{})
+	i := 0
+	for i < len(plan.steps) && plan.steps[i].concurrent {
+		fetchedKeysMap[plan.steps[i].filter.Key] = struct{}{}
+		i++
+	}
+	if i > 0 {
+		events, err = s.scanFiltersConcurrently(ctx, data, r, plan.steps[:i], profile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for ; i < len(plan.steps); i++ {
+		filter := plan.steps[i].filter
+		stepCtx, step := profile.step(ctx, filterQueryStep(plan.steps[i]))
+		var fetched bool
+		if plan.steps[i].strategy == strategySeek {
+			events, fetched, err = s.seekFilter(stepCtx, data, filter, events)
+		} else {
+			events, fetched, err = s.applyFilter(stepCtx, data, filter, r, events, i == 0)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		step.done(len(events))
+
+		// Record we fetched the key
+		if fetched {
+			fetchedKeysMap[filter.Key] = struct{}{}
+		}
+	}
+
+	// The data of the events is returned in the order the filters were written
+	if plan.reordered() {
+		orderEventData(data, events)
+	}
+	return events, fetchedKeysMap, nil
+}
+
+// scanFiltersConcurrently scans the index of each filter at the same time and intersects
+// the events, adding the data of every filter
+func (s *Store) scanFiltersConcurrently(ctx context.Context, data Data, r timeRange, steps []filterStep, profile *queryProfile) ([]DecodedEvent, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stepCtxs := make([]context.Context, len(steps))
+	profiled := make([]*profiledStep, len(steps))
+	for i, step := range steps {
+		stepCtxs[i], profiled[i] = profile.step(ctx, filterQueryStep(step))
+	}
+
+	results := make([][]DecodedEvent, len(steps))
+	errs := make([]error, len(steps))
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		wg.Add(1)
+		go func(i int, filter Filter) {
+			defer wg.Done()
+			results[i], _, errs[i] = s.applyFilter(stepCtxs[i], data, filter, r, nil, true)
+			if errs[i] != nil {
+				cancel()
+			}
+			profiled[i].done(len(results[i]))
+		}(i, step.filter)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each step is left with the events which survive its intersection with the steps before
+	events := results[0]
+	for i, matched := range results[1:] {
+		var err error
+		events, err = intersectEventData(ctx, events, matched)
+		if err != nil {
+			return nil, err
+		}
+		profiled[i+1].setEvents(len(events))
+	}
+	return events, nil
+}
+
+// intersectEventData returns the events which are also in matched with the data of both.
+// Both must be sorted by ID.
+func intersectEventData(ctx context.Context, events, matched []DecodedEvent) ([]DecodedEvent, error) {
+	result := []DecodedEvent{}
+	j := 0
+	for i, event := range events {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+		for j < len(matched) && matched[j].ID < event.ID {
+			j++
+		}
+		if j < len(matched) && matched[j].ID == event.ID {
+			event.Data = append(event.Data, matched[j].Data...)
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// seekFilter returns the events which match the filter by reading their records. It adds
+// the value of the filter key to the data like the index scan of the filter would.
+func (s *Store) seekFilter(ctx context.Context, data Data, filter Filter, events []DecodedEvent) ([]DecodedEvent, bool, error) {
+	eventIDs := make([]uint64, len(events))
+	for i, event := range events {
+		eventIDs[i] = event.ID
+	}
+
+	matched := []DecodedEvent{}
+	i := 0
+	err := s.rangeEventRecords(ctx, eventIDs, func(eventID uint64, record Event) error {
+		for events[i].ID != eventID {
+			i++
+		}
+		ok, err := matchFilter(data, filter, record)
+		if err != nil || !ok {
+			return err
+		}
+		event := events[i]
+		if filter.addsKey() {
+			if value, ok := record.values()[filter.Key]; ok {
+				event.Data = append(event.Data, DecodedEventData{filter.Key, value})
+			}
+		}
+		matched = append(matched, event)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return matched, filter.addsKey(), nil
+}
+
+// orderEventData sorts the data added by the filters of every event into the order the
+// filters were written. Data added after the filters keeps its place at the end.
+func orderEventData(data Data, events []DecodedEvent) {
+	rank := make(map[string]int)
+	for i, filter := range data.Filters {
+		if _, ok := rank[filter.Key]; !ok && filter.addsKey() {
+			rank[filter.Key] = i
+		}
+	}
+	keyRank := func(key string) int {
+		if i, ok := rank[key]; ok {
+			return i
+		}
+		return len(data.Filters)
+	}
+	for _, event := range events {
+		eventData := event.Data
+		sort.SliceStable(eventData, func(i, j int) bool {
+			return keyRank(eventData[i].Key) < keyRank(eventData[j].Key)
+		})
+	}
+}
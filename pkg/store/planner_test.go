@@ -0,0 +1,324 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newPlannerTestStore(t *testing.T) *Store {
+	var events []Event
+	for i := 0; i < 100; i++ {
+		data := map[string]string{"browser": "chrome", "user": fmt.Sprintf("u%d", i%50)}
+		if i%2 == 0 {
+			data["browser"] = "firefox"
+		}
+		if i == 7 {
+			data["campaign"] = "spring"
+		}
+		events = append(events, Event{Tag: "tag1", TS: uint64(1000 + i), Data: data})
+	}
+	return newTestStore(t, events)
+}
+
+func TestStore_planFilters(t *testing.T) {
+	s := newPlannerTestStore(t)
+
+	tests := []struct {
+		name    string
+		filters []Filter
+		want    []filterStep
+	}{
+		{
+			"Selective filter first and broad filter seeked",
+			[]Filter{{Type: "exists", Key: "browser"}, {Type: "eq", Key: "campaign", Value: "spring"}},
+			[]filterStep{
+				{index: 1, estimate: 1, strategy: strategyScan},
+				{index: 0, estimate: 100, strategy: strategySeek},
+			},
+		},
+		{
+			"Similar filters scanned concurrently",
+			[]Filter{{Type: "eq", Key: "browser", Value: "chrome"}, {Type: "in", Key: "user", Values: []string{"u1", "u2", "u1"}}},
+			[]filterStep{
+				{index: 1, estimate: 4, strategy: strategyScan, concurrent: true},
+				{index: 0, estimate: 50, strategy: strategyScan, concurrent: true},
+			},
+		},
+		{
+			"Negated and boolean filters",
+			[]Filter{
+				{Type: "neq", Key: "browser", Value: "chrome"},
+				{Type: "or", Filters: []Filter{{Type: "eq", Key: "user", Value: "u1"}, {Type: "eq", Key: "campaign", Value: "spring"}}},
+				{Type: "not_exists", Key: "campaign"},
+			},
+			[]filterStep{
+				{index: 1, estimate: 3, strategy: strategyScan},
+				{index: 0, estimate: 50, strategy: strategySeek},
+				{index: 2, estimate: 99, strategy: strategySeek},
+			},
+		},
+		{
+			"Unknown values",
+			[]Filter{{Type: "eq", Key: "browser", Value: "chrome"}, {Type: "eq", Key: "browser", Value: "opera"}},
+			[]filterStep{
+				{index: 1, estimate: 0, strategy: strategyScan},
+				{index: 0, estimate: 50, strategy: strategySeek},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := s.planFilters(Data{Tag: "tag1", Filters: tt.filters})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range plan.steps {
+				plan.steps[i].filter = Filter{}
+			}
+			if !reflect.DeepEqual(plan.steps, tt.want) {
+				t.Errorf("planFilters() = %+v, want %+v", plan.steps, tt.want)
+			}
+		})
+	}
+}
+
+func TestStore_QueryEvents_planned(t *testing.T) {
+	s := newPlannerTestStore(t)
+
+	filters := [][]Filter{
+		{{Type: "exists", Key: "browser"}, {Type: "eq", Key: "campaign", Value: "spring"}},
+		{{Type: "eq", Key: "browser", Value: "chrome"}, {Type: "in", Key: "user", Values: []string{"u1", "u2"}}},
+		{{Type: "prefix", Key: "user", Value: "u1"}, {Type: "neq", Key: "browser", Value: "firefox"}, {Type: "regex", Key: "browser", Value: "^c"}},
+		{{Type: "eq", Key: "browser", Value: "chrome"}, {Type: "not", Filters: []Filter{{Type: "eq", Key: "user", Value: "u1"}}}},
+	}
+	for _, f := range filters {
+		data := Data{Tag: "tag1", Keys: []string{"user"}, Filters: f}
+		result, err := s.QueryEvents(context.Background(), Query{Data: []Data{data}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Scanning the tag index in order checks the filters in the order they were written
+		data.Limit, data.Order = 1000, orderAsc
+		scanned, err := s.QueryEvents(context.Background(), Query{Data: []Data{data}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Data[0].Result) == 0 || !reflect.DeepEqual(result.Data[0].Result, scanned.Data[0].Result) {
+			t.Errorf("QueryEvents() with filters %v = %v, want %v", f, result.Data[0].Result, scanned.Data[0].Result)
+		}
+	}
+}
+
+func TestStore_IngestEvents_stats(t *testing.T) {
+	s := newPlannerTestStore(t)
+	if err := s.IngestEvents(context.Background(), []Event{{Tag: "tag1", TS: 2000, Data: map[string]string{"campaign": "spring"}, Numbers: map[string]float64{"price": 1.5}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  []byte
+		want uint64
+	}{
+		{getTagStatsKey("tag1"), 101},
+		{getDimensionStatsKey("tag1", "browser"), 100},
+		{getDimensionStatsKey("tag1", "campaign"), 2},
+		{getValueStatsKey("tag1", "campaign", "spring"), 2},
+		{getValueStatsKey("tag1", "user", "u1"), 2},
+		{getValueStatsKey("tag1", "price", "1.5"), 1},
+		{getTagStatsKey("tag2"), 0},
+	}
+	for _, tt := range tests {
+		if got, err := s.statistic(tt.key); err != nil || got != tt.want {
+			t.Errorf("statistic(%q) = %v, %v, want %v", tt.key, got, err, tt.want)
+		}
+	}
+}
+
+func TestStore_IngestEvents_concurrentStats(t *testing.T) {
+	s := newTestStore(t, nil)
+
+	// Concurrent ingests count into the pending statistics without losing counts
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				errs[i] = s.IngestEvents(context.Background(), []Event{{Tag: "tag1", TS: 1000, Data: map[string]string{"user": fmt.Sprintf("u%d", j)}}})
+				if errs[i] != nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := getValueStatsKey("tag1", "user", "u1")
+	if got, err := s.statistic(key); err != nil || got != 8 {
+		t.Errorf("statistic() = %v, %v, want 8", got, err)
+	}
+	if err := s.flushStats(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{getTagStatsKey("tag1"), getDimensionStatsKey("tag1", "user")} {
+		if got, err := s.storedStatistic(key); err != nil || got != 400 {
+			t.Errorf("storedStatistic(%q) = %v, %v, want 400", key, got, err)
+		}
+	}
+	if got, err := s.statistic(key); err != nil || got != 8 {
+		t.Errorf("statistic() after flush = %v, %v, want 8", got, err)
+	}
+}
+
+func TestStore_DropAll_concurrentFlush(t *testing.T) {
+	s := newTestStore(t, nil)
+	key := getTagStatsKey("tag1")
+	for i := 0; i < 50; i++ {
+		if err := s.IngestEvents(context.Background(), []Event{{Tag: "tag1", TS: 1000, Data: map[string]string{"user": "u1"}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The flush either writes before the drop or finds no counts after it
+		var wg sync.WaitGroup
+		var flushErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			flushErr = s.flushStats()
+		}()
+		if err := s.DropAll(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		if flushErr != nil {
+			t.Fatal(flushErr)
+		}
+		if got, err := s.statistic(key); err != nil || got != 0 {
+			t.Fatalf("statistic() after DropAll = %v, %v, want 0", got, err)
+		}
+	}
+}
+
+func TestStore_QueryEvents_explain(t *testing.T) {
+	s := newPlannerTestStore(t)
+
+	result, err := s.QueryEvents(context.Background(), Query{Explain: true, Data: []Data{{
+		Tag:        "tag1",
+		Keys:       []string{"user", "browser"},
+		Filters:    []Filter{{Type: "exists", Key: "browser"}, {Type: "eq", Key: "campaign", Value: "spring"}},
+		Operations: []Operation{{Type: "count"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one, hundred := uint64(1), uint64(100)
+	want := []QueryStep{
+		{Step: stepFilter, Filter: &Filter{Type: "eq", Key: "campaign", Value: "spring"}, Estimate: &one, Strategy: strategyScan},
+		{Step: stepFilter, Filter: &Filter{Type: "exists", Key: "browser"}, Estimate: &hundred, Strategy: strategySeek},
+		{Step: stepFetchKeys, Keys: []string{"user"}},
+		{Step: stepOperations},
+	}
+	if got := result.Data[0].Meta["plan"]; len(result.Data[0].Result) != 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryEvents() plan = %+v, want %+v", got, want)
+	}
+
+	result, err = s.QueryEvents(context.Background(), Query{Explain: true, Data: []Data{{Tag: "tag1", Limit: 10, Order: orderAsc}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Data[0].Meta["plan"]; !reflect.DeepEqual(got, []QueryStep{{Step: stepScanInOrder}}) {
+		t.Errorf("QueryEvents() plan of a page in order = %+v", got)
+	}
+
+	// A page in order scans the tag index unless the filters match few of its events
+	page := Data{Tag: "tag1", Limit: 1, Order: orderDesc, Filters: []Filter{{Type: "exists", Key: "browser"}}}
+	selectivePage := page
+	selectivePage.Filters = []Filter{{Type: "eq", Key: "campaign", Value: "spring"}}
+	result, err = s.QueryEvents(context.Background(), Query{Explain: true, Data: []Data{page, selectivePage}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.Data[0].Meta["plan"]; !reflect.DeepEqual(got, []QueryStep{{Step: stepScanInOrder}}) {
+		t.Errorf("QueryEvents() plan of a filtered page in order = %+v", got)
+	}
+	if got := result.Data[1].Meta["plan"].([]QueryStep); got[0].Step != stepFilter {
+		t.Errorf("QueryEvents() plan of a selective page in order = %+v", got)
+	}
+	result, err = s.QueryEvents(context.Background(), Query{Data: []Data{selectivePage}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := result.Data[0].Result; len(events) != 1 || events[0].TS != 1007 || result.Data[0].Cursor != "" {
+		t.Errorf("QueryEvents() selective page in order = %v, cursor %q", events, result.Data[0].Cursor)
+	}
+}
+
+func TestStore_QueryEvents_profile(t *testing.T) {
+	s := newPlannerTestStore(t)
+
+	tests := []struct {
+		name       string
+		filters    []Filter
+		wantSteps  []string
+		wantEvents []int
+		wantKeys   []uint64
+	}{
+		{
+			"Scan and seek",
+			[]Filter{{Type: "exists", Key: "browser"}, {Type: "eq", Key: "campaign", Value: "spring"}},
+			[]string{stepFilter, stepFilter, stepFetchKeys, stepOperations},
+			[]int{1, 1, 1, 1},
+			[]uint64{1, 1, 100, 0},
+		},
+		{
+			"Concurrent scans",
+			[]Filter{{Type: "eq", Key: "browser", Value: "chrome"}, {Type: "in", Key: "user", Values: []string{"u1", "u2"}}},
+			[]string{stepFilter, stepFilter, stepOperations},
+			[]int{4, 2, 2},
+			[]uint64{4, 50, 0},
+		},
+		{
+			"Tag scan",
+			nil,
+			[]string{stepTagScan, stepFetchKeys, stepOperations},
+			[]int{100, 100, 100},
+			[]uint64{100, 100, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.QueryEvents(context.Background(), Query{Profile: true, Data: []Data{{
+				Tag:        "tag1",
+				Keys:       []string{"user"},
+				Filters:    tt.filters,
+				Operations: []Operation{{Type: "count"}},
+			}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps, ok := result.Data[0].Meta["profile"].([]QueryStep)
+			if !ok || len(steps) != len(tt.wantSteps) {
+				t.Fatalf("QueryEvents() profile = %+v, want steps %v", result.Data[0].Meta["profile"], tt.wantSteps)
+			}
+			for i, step := range steps {
+				profile := step.Profile
+				if step.Step != tt.wantSteps[i] || profile.Events != tt.wantEvents[i] || profile.KeysScanned != tt.wantKeys[i] ||
+					(profile.KeysScanned > 0) != (profile.BytesDecoded > 0) {
+					t.Errorf("QueryEvents() profile step %d = %s %+v, want %s with %d events and %d keys",
+						i, step.Step, profile, tt.wantSteps[i], tt.wantEvents[i], tt.wantKeys[i])
+				}
+			}
+		})
+	}
+}
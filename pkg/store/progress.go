@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// QueryProgress is how far a query got before it stopped
+type QueryProgress struct {
+	DataCompleted int    `json:"dataCompleted"` // data blocks which were resolved
+	KeysScanned   uint64 `json:"keysScanned"`   // index and record keys read
+}
+
+// QueryTimeoutError is returned when a query runs out of time. It wraps the error of the
+// context.
+type QueryTimeoutError struct {
+	Progress QueryProgress
+	Err      error
+}
+
+func (e *QueryTimeoutError) Error() string {
+	return fmt.Sprintf("query timed out after %d data blocks and %d keys: %s", e.Progress.DataCompleted, e.Progress.KeysScanned, e.Err)
+}
+
+func (e *QueryTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// queryProgress counts the progress of a running query. It is kept in the context of the
+// query so that every scan can count the keys it reads.
+type queryProgress struct {
+	dataCompleted int64
+	keysScanned   uint64
+}
+
+type queryProgressKey struct{}
+
+func withQueryProgress(ctx context.Context) (context.Context, *queryProgress) {
+	p := &queryProgress{}
+	return context.WithValue(ctx, queryProgressKey{}, p), p
+}
+
+func (p *queryProgress) snapshot() QueryProgress {
+	return QueryProgress{
+		DataCompleted: int(atomic.LoadInt64(&p.dataCompleted)),
+		KeysScanned:   atomic.LoadUint64(&p.keysScanned),
+	}
+}
+
+// stepCounters count what a step of a profiled query reads. They are kept in the context of
+// the step, next to the progress of the query.
+type stepCounters struct {
+	keysScanned  uint64
+	bytesDecoded uint64
+}
+
+type stepCountersKey struct{}
+
+func withStepCounters(ctx context.Context) (context.Context, *stepCounters) {
+	c := &stepCounters{}
+	return context.WithValue(ctx, stepCountersKey{}, c), c
+}
+
+// contextCheckInterval is how many keys a scan reads, or events a CPU-bound phase goes
+// through, between checks of the context
+const contextCheckInterval = 1024
+
+// checkContext returns the error of the context every contextCheckInterval calls, with i
+// counting the calls, so that long loops stop soon after the query is cancelled or times out
+func checkContext(ctx context.Context, i int) error {
+	if i%contextCheckInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// scanCounters count the keys and bytes a scan reads for the progress of its query and
+// the counters of its profiled step. They are looked up in the context once when the scan
+// starts and are added to the shared counters whenever the context is checked, so flush
+// must be called when the scan is done.
+type scanCounters struct {
+	ctx          context.Context
+	progress     *queryProgress
+	step         *stepCounters
+	keysScanned  uint64
+	bytesDecoded uint64
+	keysFlushed  uint64
+	bytesFlushed uint64
+}
+
+func newScanCounters(ctx context.Context) *scanCounters {
+	c := &scanCounters{ctx: ctx}
+	c.progress, _ = ctx.Value(queryProgressKey{}).(*queryProgress)
+	c.step, _ = ctx.Value(stepCountersKey{}).(*stepCounters)
+	return c
+}
+
+// scannedKey counts a key read by the scan and returns the error of the context for the
+// first key and every contextCheckInterval keys after it
+func (c *scanCounters) scannedKey() error {
+	c.keysScanned++
+	if (c.keysScanned-1)%contextCheckInterval != 0 {
+		return nil
+	}
+	c.flush()
+	return c.ctx.Err()
+}
+
+// decodedBytes counts the bytes of the keys and values the scan decodes
+func (c *scanCounters) decodedBytes(n int) {
+	c.bytesDecoded += uint64(n)
+}
+
+// flush adds the keys and bytes counted since the last flush to the shared counters
+func (c *scanCounters) flush() {
+	if c.progress != nil {
+		atomic.AddUint64(&c.progress.keysScanned, c.keysScanned-c.keysFlushed)
+	}
+	if c.step != nil {
+		atomic.AddUint64(&c.step.keysScanned, c.keysScanned-c.keysFlushed)
+		atomic.AddUint64(&c.step.bytesDecoded, c.bytesDecoded-c.bytesFlushed)
+	}
+	c.keysFlushed, c.bytesFlushed = c.keysScanned, c.bytesDecoded
+}
@@ -1,83 +1,744 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"math"
 	"regexp"
 	"sort"
+	"strings"
+
+	"github.com/aaron7/eventstore/pkg/db"
 )
 
-// equalFilter filters the DB and merges keys equal to the value
-func equalFilter(tag, key, value string, store *Store, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
-	events := []DecodedEvent{}
-	keyItr := func(k []byte) error {
-		// Benchmark: 0.33 seconds for 3.3m keys
-		// TODO: Find faster decoding
-		_, _, eventValue, ts, eventID := decodeEventIndexKey(k)
+// timeRange is a half-open range [start, end) of timestamps in ms. An end of zero is
+// unbounded.
+type timeRange struct {
+	start uint64
+	end   uint64
+}
 
-		if first {
-			// Benchmark: Using map is 0.6s longer. Ids is 0.3s quicker.
-			// TODO: Find fasting encoding than struct?
-			events = append(events, DecodedEvent{ID: eventID, TS: ts, Tag: tag, Data: []DecodedEventData{{key, eventValue}}})
-		} else {
-			// Intersect by searching the events list from previous combined filters and only
-			// adding the event from this filter if it is also in the previous combined filters.
-			idx := sort.Search(len(mergeEvents), func(i int) bool {
-				return eventID <= mergeEvents[i].ID
-			})
-			if idx < len(mergeEvents) && mergeEvents[idx].ID == eventID {
-				mergeEvents[idx].Data = append(mergeEvents[idx].Data, DecodedEventData{key, eventValue})
-				events = append(events, mergeEvents[idx])
-			}
-		}
+func (r timeRange) contains(ts uint64) bool {
+	return ts >= r.start && (r.end == 0 || ts < r.end)
+}
+
+// overlapsBucket returns whether any timestamp in the bucket is within the range
+func (r timeRange) overlapsBucket(bucket uint64) bool {
+	first := bucket * eventIndexBucketWidth
+	last := first + eventIndexBucketWidth - 1
+	return last >= r.start && (r.end == 0 || first < r.end)
+}
 
+// containsBucket returns whether every timestamp in the bucket is within the range
+func (r timeRange) containsBucket(bucket uint64) bool {
+	first := bucket * eventIndexBucketWidth
+	last := first + eventIndexBucketWidth - 1
+	return r.contains(first) && r.contains(last)
+}
+
+// eventIndexBuckets returns the index buckets of the tag which overlap the time range
+func (s *Store) eventIndexBuckets(ctx context.Context, tag string, r timeRange) ([]uint64, error) {
+	buckets := []uint64{}
+	keyItr := func(k []byte) error {
+		_, bucket, err := decodeEventIndexBucketKey(k)
+		if err != nil {
+			return err
+		}
+		if r.overlapsBucket(bucket) {
+			buckets = append(buckets, bucket)
+		}
 		return nil
 	}
 
-	err := store.DB.RangeKeys(getPartialEventIndexValueRangeKey(tag, key, value), keyItr)
+	err := s.DB.RangeKeys(ctx, getPartialEventIndexBucketTagRangeKey(tag), keyItr)
 	if err != nil {
 		return nil, err
 	}
 
-	return events, nil
+	return buckets, nil
 }
 
-// regexFilter filters the DB and merges keys equal to the value
-func regexFilter(tag, key, regex string, store *Store, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
-	events := []DecodedEvent{}
-	keyItr := func(k []byte) error {
-		// Benchmark: 0.33 seconds for 3.3m keys
-		// TODO: Find faster decoding
-		_, _, eventValue, ts, eventID := decodeEventIndexKey(k)
-
-		// Do not add event if we don't match regex
-		// TODO: Improve performance
-		matched, _ := regexp.MatchString(regex, eventValue)
-		if !matched {
+// eventIndexEntry is a decoded event index entry
+type eventIndexEntry struct {
+	value      string
+	ts         uint64
+	eventID    uint64
+	samplerate int
+}
+
+// indexKeyDecoder decodes the value, ts and event ID of an index key
+type indexKeyDecoder func(key []byte) (value string, ts, eventID uint64, err error)
+
+// indexValueDecoder decodes the value of an index key into its entry
+type indexValueDecoder func(value []byte, entry *eventIndexEntry) error
+
+func decodeEventIndexEntryKey(key []byte) (string, uint64, uint64, error) {
+	_, _, value, ts, eventID, err := decodeEventIndexKey(key)
+	return value, ts, eventID, err
+}
+
+func decodeEventIndexEntryValue(value []byte, entry *eventIndexEntry) error {
+	var err error
+	entry.samplerate, err = decodeEventIndexValue(value)
+	return err
+}
+
+func decodeNumericIndexEntryKey(key []byte) (string, uint64, uint64, error) {
+	_, _, number, ts, eventID, err := decodeNumericIndexKey(key)
+	return formatNumber(number), ts, eventID, err
+}
+
+func decodeNumericIndexEntryValue(value []byte, entry *eventIndexEntry) error {
+	samplerate, text, err := decodeNumericIndexValue(value)
+	if err != nil {
+		return err
+	}
+	entry.samplerate = samplerate
+	if text != "" {
+		entry.value = text
+	}
+	return nil
+}
+
+// scanEventIndex calls fn for every event index entry within the time range, iterating
+// over each bucket of the tag with the options returned by bucketOpts. fn can return
+// db.ErrStopIteration to stop the scan.
+func (s *Store) scanEventIndex(ctx context.Context, tag string, r timeRange, bucketOpts func(bucket uint64, edge bool) db.IteratorOptions, fn func(entry eventIndexEntry) error) error {
+	return s.scanIndex(ctx, tag, r, bucketOpts, decodeEventIndexEntryKey, decodeEventIndexEntryValue, fn)
+}
+
+// scanIndex calls fn for every entry of a bucketed index within the time range, decoding
+// the keys with decodeKey and their values with decodeValue
+func (s *Store) scanIndex(ctx context.Context, tag string, r timeRange, bucketOpts func(bucket uint64, edge bool) db.IteratorOptions, decodeKey indexKeyDecoder, decodeValue indexValueDecoder, fn func(entry eventIndexEntry) error) error {
+	buckets, err := s.eventIndexBuckets(ctx, tag, r)
+	if err != nil {
+		return err
+	}
+
+	counters := newScanCounters(ctx)
+	defer counters.flush()
+	for _, bucket := range buckets {
+		// Only the buckets at the edges of the range can contain events outside of it
+		edge := !r.containsBucket(bucket)
+		err := func() error {
+			it := s.DB.NewIterator(bucketOpts(bucket, edge))
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				if err := counters.scannedKey(); err != nil {
+					return err
+				}
+				// Benchmark: 0.33 seconds for 3.3m keys
+				// TODO: Find faster decoding
+				key := it.Key()
+				eventValue, ts, eventID, err := decodeKey(key)
+				if err != nil {
+					return err
+				}
+				counters.decodedBytes(len(key))
+				if edge && !r.contains(ts) {
+					continue
+				}
+				value, err := it.Value()
+				if err != nil {
+					return err
+				}
+				counters.decodedBytes(len(value))
+				entry := eventIndexEntry{value: eventValue, ts: ts, eventID: eventID}
+				err = decodeValue(value, &entry)
+				if err != nil {
+					return err
+				}
+				err = fn(entry)
+				if err != nil {
+					return err
+				}
+			}
 			return nil
+		}()
+		if err == db.ErrStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
+	}
 
-		if first {
-			// Benchmark: Using map is 0.6s longer. Ids is 0.3s quicker.
-			// TODO: Find fasting encoding than struct?
-			events = append(events, DecodedEvent{ID: eventID, TS: ts, Tag: tag, Data: []DecodedEventData{{key, eventValue}}})
+	return nil
+}
+
+// scanEventIndexValue calls fn for every index entry of the value within the time range.
+// The ts follows the value in the key, so the edges of the range are seeked to directly.
+func (s *Store) scanEventIndexValue(ctx context.Context, tag, dimension, value string, r timeRange, fn func(entry eventIndexEntry) error) error {
+	bucketOpts := func(bucket uint64, edge bool) db.IteratorOptions {
+		prefix := getPartialEventIndexValueRangeKey(tag, dimension, bucket, value)
+		opts := db.IteratorOptions{Prefix: prefix}
+		if edge && r.start > 0 {
+			opts.LowerBound = append(append([]byte{}, prefix...), uint64ToBytes(r.start)...)
+		}
+		if edge && r.end > 0 {
+			opts.UpperBound = append(append([]byte{}, prefix...), uint64ToBytes(r.end)...)
+		}
+		return opts
+	}
+	return s.scanEventIndex(ctx, tag, r, bucketOpts, fn)
+}
+
+// scanEventIndexValuePrefix calls fn for every index entry with a value starting with the
+// prefix within the time range. The escaped prefix is a prefix of the escaped value, so
+// only the matching values are read.
+func (s *Store) scanEventIndexValuePrefix(ctx context.Context, tag, dimension, prefix string, r timeRange, fn func(entry eventIndexEntry) error) error {
+	bucketOpts := func(bucket uint64, edge bool) db.IteratorOptions {
+		return db.IteratorOptions{Prefix: appendEscaped(getPartialEventIndexBucketRangeKey(tag, dimension, bucket), []byte(prefix))}
+	}
+	return s.scanEventIndex(ctx, tag, r, bucketOpts, fn)
+}
+
+// scanEventIndexDimension calls fn for every index entry of the dimension within the time
+// range
+func (s *Store) scanEventIndexDimension(ctx context.Context, tag, dimension string, r timeRange, fn func(entry eventIndexEntry) error) error {
+	bucketOpts := func(bucket uint64, edge bool) db.IteratorOptions {
+		return db.IteratorOptions{Prefix: getPartialEventIndexBucketRangeKey(tag, dimension, bucket)}
+	}
+	return s.scanEventIndex(ctx, tag, r, bucketOpts, fn)
+}
+
+// numberRange is a half open range of numbers [start, end)
+type numberRange struct {
+	start, end float64
+}
+
+// scanNumericIndexRange calls fn for every numeric index entry of the dimension with a
+// number in the range and a ts within the time range. The value of each entry is the JSON
+// form the number was ingested in.
+func (s *Store) scanNumericIndexRange(ctx context.Context, tag, dimension string, n numberRange, r timeRange, fn func(entry eventIndexEntry) error) error {
+	bucketOpts := func(bucket uint64, edge bool) db.IteratorOptions {
+		prefix := getPartialNumericIndexBucketRangeKey(tag, dimension, bucket)
+		opts := db.IteratorOptions{Prefix: prefix}
+		if !math.IsInf(n.start, -1) {
+			opts.LowerBound = getPartialNumericIndexValueRangeKey(tag, dimension, bucket, n.start)
+		}
+		if !math.IsInf(n.end, 1) {
+			opts.UpperBound = getPartialNumericIndexValueRangeKey(tag, dimension, bucket, n.end)
+		}
+		return opts
+	}
+	return s.scanIndex(ctx, tag, r, bucketOpts, decodeNumericIndexEntryKey, decodeNumericIndexEntryValue, fn)
+}
+
+// scanTagIndex calls fn for every event of the tag within the time range in ts order
+func (s *Store) scanTagIndex(ctx context.Context, tag string, r timeRange, fn func(entry eventIndexEntry) error) error {
+	return s.scanTagIndexInOrder(ctx, tag, r, false, nil, fn)
+}
+
+// scanTagIndexInOrder calls fn for every event of the tag within the time range after the
+// cursor, in ascending or descending ts order. fn can return db.ErrStopIteration to stop
+// the scan.
+func (s *Store) scanTagIndexInOrder(ctx context.Context, tag string, r timeRange, reverse bool, cursor *eventCursor, fn func(entry eventIndexEntry) error) error {
+	prefix := getPartialTagIndexRangeKey(tag)
+	opts := db.IteratorOptions{Prefix: prefix, Reverse: reverse}
+	if r.start > 0 {
+		opts.LowerBound = append(append([]byte{}, prefix...), uint64ToBytes(r.start)...)
+	}
+	if r.end > 0 {
+		opts.UpperBound = append(append([]byte{}, prefix...), uint64ToBytes(r.end)...)
+	}
+	if cursor != nil {
+		key := createTagIndexEntry(tag, cursor.ts, cursor.id, 1).Key
+		if reverse {
+			if opts.UpperBound == nil || bytes.Compare(key, opts.UpperBound) < 0 {
+				opts.UpperBound = key
+			}
 		} else {
-			// Intersect by searching the events list from previous combined filters and only
-			// adding the event from this filter if it is also in the previous combined filters.
-			idx := sort.Search(len(mergeEvents), func(i int) bool {
-				return eventID <= mergeEvents[i].ID
+			// The first key after the cursor
+			key = append(key, 0)
+			if bytes.Compare(key, opts.LowerBound) > 0 {
+				opts.LowerBound = key
+			}
+		}
+	}
+
+	it := s.DB.NewIterator(opts)
+	defer it.Close()
+
+	counters := newScanCounters(ctx)
+	defer counters.flush()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if err := counters.scannedKey(); err != nil {
+			return err
+		}
+		key := it.Key()
+		_, ts, eventID, err := decodeTagIndexKey(key)
+		if err != nil {
+			return err
+		}
+		value, err := it.Value()
+		if err != nil {
+			return err
+		}
+		counters.decodedBytes(len(key) + len(value))
+		samplerate, err := decodeEventIndexValue(value)
+		if err != nil {
+			return err
+		}
+		err = fn(eventIndexEntry{ts: ts, eventID: eventID, samplerate: samplerate})
+		if err == db.ErrStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeEvent adds the event to events, or if this is not the first filter, intersects it
+// with mergeEvents
+func mergeEvent(events, mergeEvents []DecodedEvent, first bool, tag, key string, entry eventIndexEntry) []DecodedEvent {
+	eventID, eventValue := entry.eventID, entry.value
+	if first {
+		// Benchmark: Using map is 0.6s longer. Ids is 0.3s quicker.
+		// TODO: Find fasting encoding than struct?
+		return append(events, DecodedEvent{ID: eventID, TS: entry.ts, Tag: tag, Samplerate: entry.samplerate, Data: []DecodedEventData{{key, eventValue}}})
+	}
+
+	// Intersect by searching the events list from previous combined filters and only
+	// adding the event from this filter if it is also in the previous combined filters.
+	idx := sort.Search(len(mergeEvents), func(i int) bool {
+		return eventID <= mergeEvents[i].ID
+	})
+	if idx < len(mergeEvents) && mergeEvents[idx].ID == eventID {
+		mergeEvents[idx].Data = append(mergeEvents[idx].Data, DecodedEventData{key, eventValue})
+		events = append(events, mergeEvents[idx])
+	}
+	return events
+}
+
+// sortEvents sorts events by ID. Index entries are read in bucket order, so the events
+// have to be sorted before they can be intersected.
+func sortEvents(events []DecodedEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+}
+
+// negatedFilterTypes maps the filter types which match every event not matched by another
+// filter type to that type. Events missing the dimension match negated filters.
+var negatedFilterTypes = map[string]string{
+	"neq":        "eq",
+	"not_in":     "in",
+	"not_exists": "exists",
+}
+
+// applyFilter returns the events of the data tag which match the filter, sorted by ID. If
+// this is not the first filter, only events in mergeEvents can match. fetched reports
+// whether the value of the filter key was added to the data of the events.
+func (s *Store) applyFilter(ctx context.Context, data Data, filter Filter, r timeRange, mergeEvents []DecodedEvent, first bool) (events []DecodedEvent, fetched bool, err error) {
+	tag, key := data.Tag, filter.Key
+
+	if positive, ok := negatedFilterTypes[filter.Type]; ok {
+		filter.Type = positive
+		matched, _, err := s.applyFilter(ctx, data, filter, r, mergeEvents, first)
+		if err != nil {
+			return nil, false, err
+		}
+		if first {
+			mergeEvents, err = s.tagEvents(ctx, tag, r)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		return subtractEvents(mergeEvents, matched), false, nil
+	}
+
+	switch filter.Type {
+	case "and", "or", "not":
+		events, err = s.booleanFilter(ctx, data, filter, r, mergeEvents, first)
+		return events, false, err
+	case "eq":
+		events, err = equalFilter(ctx, tag, key, filter.Value, r, s, mergeEvents, first)
+	case "in":
+		if filter.valueSet != nil {
+			events, err = dimensionFilter(ctx, tag, key, r, s, mergeEvents, first, func(value string) bool {
+				_, ok := filter.valueSet[value]
+				return ok
 			})
-			if idx < len(mergeEvents) && mergeEvents[idx].ID == eventID {
-				mergeEvents[idx].Data = append(mergeEvents[idx].Data, DecodedEventData{key, eventValue})
-				events = append(events, mergeEvents[idx])
+			break
+		}
+		events, err = inFilter(ctx, tag, key, filter.Values, r, s, mergeEvents, first)
+	case "prefix":
+		events, err = prefixFilter(ctx, tag, key, filter.Value, r, s, mergeEvents, first)
+	case "regex":
+		events, err = regexFilter(ctx, tag, key, filter.regex, filter.regexPrefix, r, s, mergeEvents, first)
+	case "gt", "gte", "lt", "lte", "between":
+		var n numberRange
+		n, err = filter.numberRange(data.Name)
+		if err != nil {
+			return nil, false, err
+		}
+		events, err = indexFilter(tag, key, mergeEvents, first, func(fn func(entry eventIndexEntry) error) error {
+			return s.scanNumericIndexRange(ctx, tag, key, n, r, fn)
+		})
+	case "contains":
+		events, err = dimensionFilter(ctx, tag, key, r, s, mergeEvents, first, func(value string) bool {
+			return strings.Contains(value, filter.Value)
+		})
+	case "exists":
+		events, err = dimensionFilter(ctx, tag, key, r, s, mergeEvents, first, func(value string) bool {
+			return true
+		})
+	default:
+		return nil, false, invalidQueryf("unsupported filter type %q in %q", filter.Type, data.Name)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return events, true, nil
+}
+
+// booleanFilter combines the events matched by the child filters with set intersection,
+// union or difference. The children only see the IDs of mergeEvents so that the data of
+// the returned events is the data of mergeEvents.
+func (s *Store) booleanFilter(ctx context.Context, data Data, filter Filter, r timeRange, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
+	if len(filter.Filters) == 0 {
+		return nil, invalidQueryf("%s filter in %q has no filters", filter.Type, data.Name)
+	}
+	if filter.Type == "not" && len(filter.Filters) != 1 {
+		return nil, invalidQueryf("not filter in %q must have exactly one filter", data.Name)
+	}
+
+	child := func(childFilter Filter, candidates []DecodedEvent, childFirst bool) ([]DecodedEvent, error) {
+		events, _, err := s.applyFilter(ctx, data, childFilter, r, withoutData(candidates), childFirst)
+		return events, err
+	}
+
+	var matched []DecodedEvent
+	switch filter.Type {
+	case "and":
+		matched = mergeEvents
+		for i, childFilter := range filter.Filters {
+			events, err := child(childFilter, matched, first && i == 0)
+			if err != nil {
+				return nil, err
+			}
+			matched = events
+		}
+	case "or":
+		for _, childFilter := range filter.Filters {
+			events, err := child(childFilter, mergeEvents, first)
+			if err != nil {
+				return nil, err
+			}
+			matched = unionEvents(matched, events)
+		}
+	case "not":
+		events, err := child(filter.Filters[0], mergeEvents, first)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			mergeEvents, err = s.tagEvents(ctx, data.Tag, r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return subtractEvents(mergeEvents, events), nil
+	}
+
+	if first {
+		return withoutData(matched), nil
+	}
+	return intersectEvents(ctx, mergeEvents, matched)
+}
+
+// matchFilter reports whether an event record matches the filter, giving the same result
+// as the index scans of applyFilter
+func matchFilter(data Data, filter Filter, record Event) (bool, error) {
+	switch filter.Type {
+	case "and", "or":
+		for _, childFilter := range filter.Filters {
+			matched, err := matchFilter(data, childFilter, record)
+			if err != nil {
+				return false, err
+			}
+			if matched == (filter.Type == "or") {
+				return matched, nil
+			}
+		}
+		return filter.Type == "and", nil
+	case "not":
+		matched, err := matchFilter(data, filter.Filters[0], record)
+		return !matched, err
+	case "gt", "gte", "lt", "lte", "between":
+		n, err := filter.numberRange(data.Name)
+		if err != nil {
+			return false, err
+		}
+		number, ok := record.Numbers[filter.Key]
+		return ok && number >= n.start && number < n.end, nil
+	}
+
+	if positive, ok := negatedFilterTypes[filter.Type]; ok {
+		filter.Type = positive
+		matched, err := matchFilter(data, filter, record)
+		return !matched, err
+	}
+
+	value, ok := record.values()[filter.Key]
+	if !ok {
+		return false, nil
+	}
+	switch filter.Type {
+	case "eq":
+		return value == filter.Value, nil
+	case "in":
+		if filter.valueSet != nil {
+			_, ok := filter.valueSet[value]
+			return ok, nil
+		}
+		for _, v := range filter.Values {
+			if value == v {
+				return true, nil
 			}
 		}
+		return false, nil
+	case "prefix":
+		return strings.HasPrefix(value, filter.Value), nil
+	case "regex":
+		return filter.regex.MatchString(value), nil
+	case "contains":
+		return strings.Contains(value, filter.Value), nil
+	case "exists":
+		return true, nil
+	}
+	return false, invalidQueryf("unsupported filter type %q in %q", filter.Type, data.Name)
+}
 
+// indexFilter collects the events of the index entries passed to fn by scan, sorted by ID
+func indexFilter(tag, key string, mergeEvents []DecodedEvent, first bool, scan func(fn func(entry eventIndexEntry) error) error) ([]DecodedEvent, error) {
+	events := []DecodedEvent{}
+	fn := func(entry eventIndexEntry) error {
+		events = mergeEvent(events, mergeEvents, first, tag, key, entry)
 		return nil
 	}
+	err := scan(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	sortEvents(events)
+	return events, nil
+}
+
+// equalFilter filters the DB and merges keys equal to the value
+func equalFilter(ctx context.Context, tag, key, value string, r timeRange, store *Store, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
+	return indexFilter(tag, key, mergeEvents, first, func(fn func(entry eventIndexEntry) error) error {
+		return store.scanEventIndexValue(ctx, tag, key, value, r, fn)
+	})
+}
+
+// inFilter filters the DB and merges keys equal to any of the values
+func inFilter(ctx context.Context, tag, key string, values []string, r timeRange, store *Store, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
+	return indexFilter(tag, key, mergeEvents, first, func(fn func(entry eventIndexEntry) error) error {
+		seen := make(map[string]struct{})
+		for _, value := range values {
+			if _, ok := seen[value]; ok {
+				continue
+			}
+			seen[value] = struct{}{}
+			err := store.scanEventIndexValue(ctx, tag, key, value, r, fn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	err := store.DB.RangeKeys(getPartialEventIndexDimensionRangeKey(tag, key), keyItr)
+// prefixFilter filters the DB and merges keys starting with the prefix
+func prefixFilter(ctx context.Context, tag, key, prefix string, r timeRange, store *Store, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
+	return indexFilter(tag, key, mergeEvents, first, func(fn func(entry eventIndexEntry) error) error {
+		return store.scanEventIndexValuePrefix(ctx, tag, key, prefix, r, fn)
+	})
+}
+
+// regexFilter filters the DB and merges keys matching the regex. Every match starts with
+// the literal prefix, so only the values with the prefix are read.
+func regexFilter(ctx context.Context, tag, key string, regex *regexp.Regexp, prefix string, r timeRange, store *Store, mergeEvents []DecodedEvent, first bool) ([]DecodedEvent, error) {
+	return matchingFilter(tag, key, mergeEvents, first, regex.MatchString, func(fn func(entry eventIndexEntry) error) error {
+		return store.scanEventIndexValuePrefix(ctx, tag, key, prefix, r, fn)
+	})
+}
+
+// dimensionFilter scans every value of the dimension and merges keys which match
+func dimensionFilter(ctx context.Context, tag, key string, r timeRange, store *Store, mergeEvents []DecodedEvent, first bool, match func(value string) bool) ([]DecodedEvent, error) {
+	return matchingFilter(tag, key, mergeEvents, first, match, func(fn func(entry eventIndexEntry) error) error {
+		return store.scanEventIndexDimension(ctx, tag, key, r, fn)
+	})
+}
+
+// matchingFilter collects the events of the index entries passed to fn by scan with a value
+// which matches. Each distinct value is only matched once.
+func matchingFilter(tag, key string, mergeEvents []DecodedEvent, first bool, match func(value string) bool, scan func(fn func(entry eventIndexEntry) error) error) ([]DecodedEvent, error) {
+	matches := make(map[string]bool)
+	return indexFilter(tag, key, mergeEvents, first, func(fn func(entry eventIndexEntry) error) error {
+		return scan(func(entry eventIndexEntry) error {
+			matched, ok := matches[entry.value]
+			if !ok {
+				matched = match(entry.value)
+				matches[entry.value] = matched
+			}
+			if !matched {
+				return nil
+			}
+			return fn(entry)
+		})
+	})
+}
+
+// tagEvents returns every event of the tag within the time range, sorted by ID
+func (s *Store) tagEvents(ctx context.Context, tag string, r timeRange) ([]DecodedEvent, error) {
+	events := []DecodedEvent{}
+	err := s.scanTagIndex(ctx, tag, r, func(entry eventIndexEntry) error {
+		events = append(events, DecodedEvent{ID: entry.eventID, TS: entry.ts, Tag: tag, Samplerate: entry.samplerate})
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	sortEvents(events)
 	return events, nil
 }
+
+// withoutData returns a copy of the events without their data
+func withoutData(events []DecodedEvent) []DecodedEvent {
+	result := make([]DecodedEvent, len(events))
+	for i, event := range events {
+		event.Data = nil
+		result[i] = event
+	}
+	return result
+}
+
+// unionEvents returns the events which are in a or b. Both must be sorted by ID and the
+// event from a is kept if it is in both.
+func unionEvents(a, b []DecodedEvent) []DecodedEvent {
+	result := make([]DecodedEvent, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].ID < b[j].ID:
+			result = append(result, a[i])
+			i++
+		case a[i].ID > b[j].ID:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// intersectEvents returns the events which are also in keep. Both must be sorted by ID.
+func intersectEvents(ctx context.Context, events, keep []DecodedEvent) ([]DecodedEvent, error) {
+	result := []DecodedEvent{}
+	j := 0
+	for i, event := range events {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+		for j < len(keep) && keep[j].ID < event.ID {
+			j++
+		}
+		if j < len(keep) && keep[j].ID == event.ID {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// subtractEvents returns the events which are not in remove. Both must be sorted by ID.
+func subtractEvents(events, remove []DecodedEvent) []DecodedEvent {
+	result := []DecodedEvent{}
+	j := 0
+	for _, event := range events {
+		for j < len(remove) && remove[j].ID < event.ID {
+			j++
+		}
+		if j < len(remove) && remove[j].ID == event.ID {
+			continue
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+// fetchKeys adds the values of the keys which have not been fetched yet to the events
+func (s *Store) fetchKeys(ctx context.Context, data Data, keys []string, r timeRange, events []DecodedEvent, fetchedKeysMap map[string]struct{}) error {
+	if data.allKeys() {
+		return s.fetchKeysFromRecords(ctx, events, fetchedKeysMap)
+	}
+
+	for _, dataKey := range keys {
+		if _, ok := fetchedKeysMap[dataKey]; !ok {
+			// Not yet fetched this key, so fetch it and save the values
+			err := s.fetchKeyFromIndex(ctx, data.Tag, dataKey, r, events)
+			if err != nil {
+				return err
+			}
+
+			// Record we fetched the key
+			fetchedKeysMap[dataKey] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// fetchKeyFromIndex adds the values of the dimension to the events by scanning the index
+func (s *Store) fetchKeyFromIndex(ctx context.Context, tag, dimension string, r timeRange, events []DecodedEvent) error {
+	fn := func(entry eventIndexEntry) error {
+		// Intersect by searching the events list from previous combined filters and only
+		// adding the event from this filter if it is also in the previous combined filters.
+		idx := sort.Search(len(events), func(i int) bool {
+			return entry.eventID <= events[i].ID
+		})
+		if idx < len(events) && events[idx].ID == entry.eventID {
+			events[idx].Data = append(events[idx].Data, DecodedEventData{dimension, entry.value})
+		}
+		return nil
+	}
+	return s.scanEventIndexDimension(ctx, tag, dimension, r, fn)
+}
+
+// fetchKeysFromRecords adds every dimension which has not been fetched to the events by
+// reading their records. The dimensions of each event are added sorted by name.
+func (s *Store) fetchKeysFromRecords(ctx context.Context, events []DecodedEvent, fetchedKeysMap map[string]struct{}) error {
+	eventIDs := make([]uint64, len(events))
+	for i, event := range events {
+		eventIDs[i] = event.ID
+	}
+
+	i := 0
+	return s.rangeEventRecords(ctx, eventIDs, func(eventID uint64, record Event) error {
+		for events[i].ID != eventID {
+			i++
+		}
+		values := record.values()
+		dimensions := make([]string, 0, len(values))
+		for dimension := range values {
+			if _, ok := fetchedKeysMap[dimension]; !ok {
+				dimensions = append(dimensions, dimension)
+			}
+		}
+		sort.Strings(dimensions)
+		for _, dimension := range dimensions {
+			events[i].Data = append(events[i].Data, DecodedEventData{dimension, values[dimension]})
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"testing"
+)
+
+func Test_timeRange(t *testing.T) {
+	const day = eventIndexBucketWidth
+	tests := []struct {
+		name           string
+		r              timeRange
+		bucket         uint64
+		wantOverlaps   bool
+		wantContains   bool
+		ts             uint64
+		wantContainsTS bool
+	}{
+		{"Unbounded", timeRange{}, 3, true, true, 0, true},
+		{"Start inside bucket", timeRange{start: day + 1}, 1, true, false, day, false},
+		{"End at bucket start", timeRange{end: day}, 1, false, false, day, false},
+		{"End inside bucket", timeRange{end: day + 1}, 1, true, false, day, true},
+		{"Exact bucket", timeRange{start: day, end: 2 * day}, 1, true, true, 2 * day, false},
+		{"Before bucket", timeRange{start: 2 * day, end: 3 * day}, 1, false, false, 2 * day, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.overlapsBucket(tt.bucket); got != tt.wantOverlaps {
+				t.Errorf("overlapsBucket() = %v, want %v", got, tt.wantOverlaps)
+			}
+			if got := tt.r.containsBucket(tt.bucket); got != tt.wantContains {
+				t.Errorf("containsBucket() = %v, want %v", got, tt.wantContains)
+			}
+			if got := tt.r.contains(tt.ts); got != tt.wantContainsTS {
+				t.Errorf("contains() = %v, want %v", got, tt.wantContainsTS)
+			}
+		})
+	}
+}
+
+func Test_anchoredLiteralPrefix(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"^/api/", "/api/"},
+		{"^/api/v[12]/", "/api/v"},
+		{`\A/api`, "/api"},
+		{"^abc$", "abc"},
+		{"/api/", ""},
+		{"^(?i)abc", ""},
+		{"(?m)^abc", ""},
+		{"^(abc|abd)", "ab"},
+		{"^a|^b", ""},
+		{"^.*", ""},
+		{"(", ""},
+	}
+	for _, tt := range tests {
+		if got := anchoredLiteralPrefix(tt.expr); got != tt.want {
+			t.Errorf("anchoredLiteralPrefix(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
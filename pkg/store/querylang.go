@@ -0,0 +1,1249 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Text queries are a compact form of Query for ad-hoc investigation:
+//
+//	FROM page_view AS views
+//	WHERE path =~ "^/api" AND status = 500
+//	SELECT count, uniqueCount(user_id)
+//	BY path ORDER BY count DESC LIMIT 10
+//	SINCE 1h
+//
+// A query is one or more data blocks followed by the FUNNEL, FORMULAs, SINCE, UNTIL and
+// TIMEOUT of the query, optionally starting with EXPLAIN or PROFILE. Each block is
+//
+//	FROM tag [AS name]
+//	[WHERE filters]
+//	[SELECT keys and operations]
+//	[BY keys]
+//	[EVERY granularity]
+//	[ORDER BY ts ASC|DESC] [LIMIT n] [CURSOR "cursor"]
+//
+// Top level filters joined with AND are the filters of the block. Filters are
+// key = value, key != value, key IN (values), key NOT IN (values), key PREFIX value,
+// key CONTAINS value, key =~ regex, key EXISTS, key NOT EXISTS, key > number (>=, <, <=),
+// key BETWEEN number AND number, key IN block (the events whose key is a value of the key in
+// the events of the named block) and key IN block.other_key, combined with AND, OR, NOT and
+// parentheses.
+//
+// SELECT lists the keys of the events, * for every key, and operations such as count,
+// sum(duration_ms), p99(duration_ms), percentile(duration_ms, 99.9),
+// uniqueCount(user_id, session_id, missing=null) or approxUniqueCount(user_id, precision=12),
+// each optionally named with AS. A block which selects operations and no keys hides its
+// events. BY groups the operations by the keys, and ORDER BY [name] [ASC|DESC] and
+// LIMIT n [WITH OTHER] then apply to the groups.
+//
+// The query ends with
+//
+//	[FUNNEL exact_order(name, name) [MATCH keys] [WITHIN window]]
+//	[FORMULA "expression" AS name]...
+//	[SINCE time] [UNTIL time] [TIMEOUT duration]
+//
+// where a formula expression is written as a string, see Formula, and a time is a ts in ms
+// or a duration before now such as 1h or 7d.
+//
+// Keywords are case insensitive. Names are letters, digits, _ and . not starting with a
+// digit, or any text between backticks. Strings are double quoted with Go escapes, and
+// numbers are written as numbers.
+
+// QuerySyntaxError is returned when a text query can not be parsed
+type QuerySyntaxError struct {
+	Line    int // starting at 1
+	Column  int // in characters, starting at 1
+	Message string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// queryKeywords are the words which can only be used as names between backticks
+var queryKeywords = map[string]struct{}{
+	"FROM": {}, "AS": {}, "WHERE": {}, "SELECT": {}, "BY": {}, "EVERY": {}, "ORDER": {},
+	"LIMIT": {}, "WITH": {}, "OTHER": {}, "CURSOR": {}, "FUNNEL": {}, "MATCH": {}, "WITHIN": {},
+	"SINCE": {}, "UNTIL": {}, "TIMEOUT": {}, "AND": {}, "OR": {}, "NOT": {}, "IN": {},
+	"EXISTS": {}, "BETWEEN": {}, "PREFIX": {}, "CONTAINS": {}, "ASC": {}, "DESC": {},
+	"EXPLAIN": {}, "PROFILE": {}, "FORMULA": {},
+}
+
+// Query tokens
+const (
+	tokenEOF = iota
+	tokenName
+	tokenQuotedName
+	tokenString
+	tokenNumber
+	tokenDuration
+	tokenSymbol
+)
+
+type queryToken struct {
+	kind int
+	text string // the unquoted text of strings and quoted names
+	pos  int    // byte offset in the query
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNamePart(c byte) bool {
+	return isNameStart(c) || c == '.' || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// querySymbols are the symbols of the language, longest first
+var querySymbols = []string{"!=", "=~", ">=", "<=", "=", ">", "<", "(", ")", ",", "*"}
+
+// lexQuery splits a text query into tokens, ending with a tokenEOF
+func lexQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isNameStart(c):
+			j := i + 1
+			for j < len(text) && isNamePart(text[j]) {
+				j++
+			}
+			tokens = append(tokens, queryToken{tokenName, text[i:j], i})
+			i = j
+		case c == '`':
+			j := strings.IndexByte(text[i+1:], '`')
+			if j < 0 {
+				return nil, syntaxErrorAt(text, i, "unterminated name")
+			}
+			tokens = append(tokens, queryToken{tokenQuotedName, text[i+1 : i+1+j], i})
+			i += j + 2
+		case c == '"':
+			j := i + 1
+			for j < len(text) && text[j] != '"' {
+				if text[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(text) {
+				return nil, syntaxErrorAt(text, i, "unterminated string")
+			}
+			value, err := strconv.Unquote(text[i : j+1])
+			if err != nil {
+				return nil, syntaxErrorAt(text, i, "invalid string")
+			}
+			tokens = append(tokens, queryToken{tokenString, value, i})
+			i = j + 1
+		case isDigit(c) || (c == '-' && i+1 < len(text) && isDigit(text[i+1])):
+			// Numbers and durations such as 1.5, -2e-3, 1h or 1m30s
+			j := i + 1
+			for j < len(text) && (isNamePart(text[j]) || ((text[j] == '+' || text[j] == '-') && (text[j-1] == 'e' || text[j-1] == 'E'))) {
+				j++
+			}
+			kind := tokenDuration
+			if _, err := strconv.ParseFloat(text[i:j], 64); err == nil {
+				kind = tokenNumber
+			}
+			tokens = append(tokens, queryToken{kind, text[i:j], i})
+			i = j
+		default:
+			symbol := ""
+			for _, s := range querySymbols {
+				if strings.HasPrefix(text[i:], s) {
+					symbol = s
+					break
+				}
+			}
+			if symbol == "" {
+				r, _ := utf8.DecodeRuneInString(text[i:])
+				return nil, syntaxErrorAt(text, i, fmt.Sprintf("unexpected character %q", r))
+			}
+			tokens = append(tokens, queryToken{tokenSymbol, symbol, i})
+			i += len(symbol)
+		}
+	}
+	return append(tokens, queryToken{tokenEOF, "", len(text)}), nil
+}
+
+// syntaxErrorAt returns a syntax error at the byte offset of the text
+func syntaxErrorAt(text string, pos int, message string) *QuerySyntaxError {
+	line := strings.Count(text[:pos], "\n") + 1
+	lineStart := strings.LastIndexByte(text[:pos], '\n') + 1
+	return &QuerySyntaxError{Line: line, Column: utf8.RuneCountInString(text[lineStart:pos]) + 1, Message: message}
+}
+
+// queryParser parses the tokens of a text query
+type queryParser struct {
+	text   string
+	tokens []queryToken
+	i      int
+	now    time.Time
+}
+
+// ParseQuery parses a text query. Durations in SINCE and UNTIL are taken before now. A
+// *QuerySyntaxError is returned if the text is not a valid query.
+func ParseQuery(text string, now time.Time) (Query, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return Query{}, err
+	}
+	p := &queryParser{text: text, tokens: tokens, now: now}
+	return p.parseQuery()
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.i]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.i]
+	if tok.kind != tokenEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *queryParser) errorf(tok queryToken, format string, args ...interface{}) error {
+	return syntaxErrorAt(p.text, tok.pos, fmt.Sprintf(format, args...))
+}
+
+// unexpected returns an error for the next token, which is not what was expected
+func (p *queryParser) unexpected(expected string) error {
+	tok := p.peek()
+	return p.errorf(tok, "expected %s, found %s", expected, describeToken(tok))
+}
+
+func describeToken(tok queryToken) string {
+	switch tok.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return strconv.Quote(tok.text)
+	case tokenQuotedName:
+		return "`" + tok.text + "`"
+	}
+	return fmt.Sprintf("%q", tok.text)
+}
+
+// isKeyword reports whether the next token is the keyword
+func (p *queryParser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokenName && strings.EqualFold(tok.text, keyword)
+}
+
+// keyword consumes the next token if it is the keyword
+func (p *queryParser) keyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectKeyword(keyword string) error {
+	if !p.keyword(keyword) {
+		return p.unexpected(keyword)
+	}
+	return nil
+}
+
+// symbol consumes the next token if it is the symbol
+func (p *queryParser) symbol(symbol string) bool {
+	if tok := p.peek(); tok.kind == tokenSymbol && tok.text == symbol {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectSymbol(symbol string) error {
+	if !p.symbol(symbol) {
+		return p.unexpected(strconv.Quote(symbol))
+	}
+	return nil
+}
+
+// isName reports whether the next token is a name which is not a keyword
+func (p *queryParser) isName() bool {
+	tok := p.peek()
+	if tok.kind == tokenQuotedName {
+		return true
+	}
+	_, isKeyword := queryKeywords[strings.ToUpper(tok.text)]
+	return tok.kind == tokenName && !isKeyword
+}
+
+func (p *queryParser) name(expected string) (string, error) {
+	if !p.isName() {
+		return "", p.unexpected(expected)
+	}
+	return p.next().text, nil
+}
+
+// names parses a comma separated list of names
+func (p *queryParser) names(expected string) ([]string, error) {
+	var names []string
+	for {
+		name, err := p.name(expected)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.symbol(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *queryParser) duration(expected string, parse func(string) error) (string, error) {
+	tok := p.peek()
+	if tok.kind != tokenDuration {
+		return "", p.unexpected(expected)
+	}
+	if err := parse(tok.text); err != nil {
+		return "", p.errorf(tok, "%q is not %s", tok.text, expected)
+	}
+	return p.next().text, nil
+}
+
+func (p *queryParser) count(expected string) (int, error) {
+	tok := p.peek()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != tokenNumber || err != nil || n < 0 {
+		return 0, p.unexpected(expected)
+	}
+	p.next()
+	return n, nil
+}
+
+func (p *queryParser) parseQuery() (Query, error) {
+	var query Query
+	if p.keyword("EXPLAIN") {
+		query.Explain = true
+	} else if p.keyword("PROFILE") {
+		query.Profile = true
+	}
+	for p.isKeyword("FROM") {
+		data, err := p.parseData()
+		if err != nil {
+			return Query{}, err
+		}
+		query.Data = append(query.Data, data)
+	}
+	if len(query.Data) == 0 {
+		return Query{}, p.unexpected("FROM")
+	}
+
+	var err error
+	if p.keyword("FUNNEL") {
+		query.Funnel, err = p.parseFunnel()
+		if err != nil {
+			return Query{}, err
+		}
+	}
+	for p.keyword("FORMULA") {
+		var formula Formula
+		if p.peek().kind != tokenString {
+			return Query{}, p.unexpected("a formula expression")
+		}
+		formula.Expression = p.next().text
+		if err := p.expectKeyword("AS"); err != nil {
+			return Query{}, err
+		}
+		formula.Name, err = p.name("a formula name")
+		if err != nil {
+			return Query{}, err
+		}
+		query.Formulas = append(query.Formulas, formula)
+	}
+	if p.keyword("SINCE") {
+		query.Start, err = p.parseTime()
+		if err != nil {
+			return Query{}, err
+		}
+	}
+	if p.keyword("UNTIL") {
+		query.End, err = p.parseTime()
+		if err != nil {
+			return Query{}, err
+		}
+	}
+	if p.keyword("TIMEOUT") {
+		query.Timeout, err = p.duration("a timeout", func(s string) error {
+			_, err := time.ParseDuration(s)
+			return err
+		})
+		if err != nil {
+			return Query{}, err
+		}
+	}
+	if p.peek().kind != tokenEOF {
+		return Query{}, p.unexpected("end of query")
+	}
+	return query, nil
+}
+
+// parseTime parses a ts in ms or a duration before now
+func (p *queryParser) parseTime() (uint64, error) {
+	tok := p.peek()
+	if tok.kind == tokenNumber {
+		ts, err := strconv.ParseUint(tok.text, 10, 64)
+		if err != nil {
+			return 0, p.errorf(tok, "invalid ts %q", tok.text)
+		}
+		p.next()
+		return ts, nil
+	}
+
+	var ago uint64
+	_, err := p.duration("a ts or a duration", func(s string) (err error) {
+		ago, err = parseGranularity(s)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	now := uint64(p.now.UnixNano() / int64(time.Millisecond))
+	if ago > now {
+		return 0, p.errorf(tok, "%s is before 1970", tok.text)
+	}
+	return now - ago, nil
+}
+
+func (p *queryParser) parseData() (Data, error) {
+	var data Data
+	var err error
+	p.keyword("FROM")
+	data.Tag, err = p.name("a tag")
+	if err != nil {
+		return Data{}, err
+	}
+	if p.keyword("AS") {
+		data.Name, err = p.name("a name")
+		if err != nil {
+			return Data{}, err
+		}
+	}
+	if p.keyword("WHERE") {
+		data.Filters, err = p.parseWhere()
+		if err != nil {
+			return Data{}, err
+		}
+	}
+
+	selected := false
+	if p.keyword("SELECT") {
+		selected = true
+		for {
+			err := p.parseSelectItem(&data)
+			if err != nil {
+				return Data{}, err
+			}
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	var group *Operation
+	if p.isKeyword("BY") {
+		if len(data.Operations) == 0 {
+			return Data{}, p.errorf(p.peek(), "BY needs operations in SELECT")
+		}
+		p.next()
+		keys, err := p.names("a key")
+		if err != nil {
+			return Data{}, err
+		}
+		data.Operations = []Operation{{Type: "group_by", Keys: keys, Operations: data.Operations}}
+		group = &data.Operations[0]
+	}
+
+	if p.keyword("EVERY") {
+		data.Granularity, err = p.duration("a granularity", func(s string) error {
+			granularity, err := parseGranularity(s)
+			if err == nil && granularity == 0 {
+				return fmt.Errorf("zero granularity")
+			}
+			return err
+		})
+		if err != nil {
+			return Data{}, err
+		}
+	}
+
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return Data{}, err
+		}
+		if group != nil {
+			if p.isName() {
+				group.OrderBy = p.next().text
+			}
+			group.Order = p.parseOrder()
+			if group.OrderBy == "" && group.Order == "" {
+				return Data{}, p.unexpected("a name, ASC or DESC")
+			}
+		} else {
+			tok := p.peek()
+			if name, err := p.name("ts"); err != nil || name != "ts" {
+				return Data{}, p.errorf(tok, "events can only be ordered by ts")
+			}
+			data.Order = p.parseOrder()
+			if data.Order == "" {
+				return Data{}, p.unexpected("ASC or DESC")
+			}
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		limit, err := p.count("a limit")
+		if err != nil {
+			return Data{}, err
+		}
+		if group != nil {
+			group.Limit = limit
+			if p.keyword("WITH") {
+				if err := p.expectKeyword("OTHER"); err != nil {
+					return Data{}, err
+				}
+				group.Other = true
+			}
+		} else {
+			data.Limit = limit
+		}
+	}
+
+	if group == nil && p.keyword("CURSOR") {
+		tok := p.peek()
+		if tok.kind != tokenString {
+			return Data{}, p.unexpected("a cursor string")
+		}
+		data.Cursor = p.next().text
+	}
+
+	data.HideData = selected && len(data.Keys) == 0
+	return data, nil
+}
+
+func (p *queryParser) parseOrder() string {
+	switch {
+	case p.keyword("ASC"):
+		return orderAsc
+	case p.keyword("DESC"):
+		return orderDesc
+	}
+	return ""
+}
+
+// parseSelectItem parses a key or an operation of SELECT
+func (p *queryParser) parseSelectItem(data *Data) error {
+	if p.symbol("*") {
+		data.Keys = append(data.Keys, allKeys)
+		return nil
+	}
+
+	tok := p.peek()
+	name, err := p.name("a key or an operation")
+	if err != nil {
+		return err
+	}
+	opened := p.symbol("(")
+	if !opened && (tok.kind == tokenQuotedName || name != "count") {
+		data.Keys = append(data.Keys, name)
+		return nil
+	}
+
+	operation := Operation{Type: name}
+	if name == "group_by" {
+		return p.errorf(tok, "group operations with BY")
+	}
+	if opened && !p.symbol(")") {
+		for {
+			err := p.parseOperationArgument(&operation)
+			if err != nil {
+				return err
+			}
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return err
+		}
+	}
+	if p.keyword("AS") {
+		operation.Name, err = p.name("a name")
+		if err != nil {
+			return err
+		}
+	}
+	data.Operations = append(data.Operations, operation)
+	return nil
+}
+
+// parseOperationArgument parses a key, a percentile or an option such as missing=null
+func (p *queryParser) parseOperationArgument(operation *Operation) error {
+	tok := p.peek()
+	if tok.kind == tokenNumber {
+		percentile, _ := strconv.ParseFloat(tok.text, 64)
+		if operation.Percentile != 0 {
+			return p.errorf(tok, "more than one percentile")
+		}
+		operation.Percentile = percentile
+		p.next()
+		return nil
+	}
+
+	name, err := p.name("a key, a percentile or an option")
+	if err != nil {
+		return err
+	}
+	if tok.kind == tokenQuotedName || !p.symbol("=") {
+		if operation.Key == "" {
+			operation.Key = name
+		} else {
+			operation.Keys = append(operation.Keys, name)
+		}
+		return nil
+	}
+
+	switch name {
+	case "missing":
+		operation.Missing, err = p.name("skip or null")
+		return err
+	case "precision":
+		operation.Precision, err = p.count("a precision")
+		return err
+	}
+	return p.errorf(tok, "unknown option %q", name)
+}
+
+func (p *queryParser) parseFunnel() (*Funnel, error) {
+	var funnel Funnel
+	var err error
+	funnel.Type, err = p.name("a funnel type")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	funnel.Order, err = p.names("a data name")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if p.keyword("MATCH") {
+		funnel.Match, err = p.names("a key")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("WITHIN") {
+		funnel.Window, err = p.duration("a window", func(s string) error {
+			_, err := parseGranularity(s)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &funnel, nil
+}
+
+// parseWhere parses the filters of a block. The top level filters joined with AND are
+// returned as separate filters.
+func (p *queryParser) parseWhere() ([]Filter, error) {
+	filters, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("OR") {
+		return filters, nil
+	}
+	filter, err := p.parseOrAfter(joinFilters("and", filters))
+	if err != nil {
+		return nil, err
+	}
+	return []Filter{filter}, nil
+}
+
+// parseOr parses filters joined with OR. Chains of OR are one or filter unless they are in
+// parentheses.
+func (p *queryParser) parseOr() (Filter, error) {
+	filters, err := p.parseAnd()
+	if err != nil {
+		return Filter{}, err
+	}
+	return p.parseOrAfter(joinFilters("and", filters))
+}
+
+func (p *queryParser) parseOrAfter(first Filter) (Filter, error) {
+	filters := []Filter{first}
+	for p.keyword("OR") {
+		and, err := p.parseAnd()
+		if err != nil {
+			return Filter{}, err
+		}
+		filters = append(filters, joinFilters("and", and))
+	}
+	return joinFilters("or", filters), nil
+}
+
+// parseAnd parses filters joined with AND
+func (p *queryParser) parseAnd() ([]Filter, error) {
+	var filters []Filter
+	for {
+		filter, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if !p.keyword("AND") {
+			return filters, nil
+		}
+	}
+}
+
+// joinFilters returns the filter joining the filters, or the filter if there is only one
+func joinFilters(filterType string, filters []Filter) Filter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return Filter{Type: filterType, Filters: filters}
+}
+
+func (p *queryParser) parseNot() (Filter, error) {
+	if p.keyword("NOT") {
+		filter, err := p.parseNot()
+		if err != nil {
+			return Filter{}, err
+		}
+		return Filter{Type: "not", Filters: []Filter{filter}}, nil
+	}
+	if p.symbol("(") {
+		filter, err := p.parseOr()
+		if err != nil {
+			return Filter{}, err
+		}
+		return filter, p.expectSymbol(")")
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses a filter on a key
+func (p *queryParser) parseComparison() (Filter, error) {
+	key, err := p.name("a key, NOT or (")
+	if err != nil {
+		return Filter{}, err
+	}
+	filter := Filter{Key: key}
+
+	tok := p.peek()
+	switch {
+	case p.symbol("="):
+		filter.Type = "eq"
+	case p.symbol("!="):
+		filter.Type = "neq"
+	case p.symbol("=~"):
+		filter.Type = "regex"
+	case p.symbol(">"):
+		filter.Type = "gt"
+	case p.symbol(">="):
+		filter.Type = "gte"
+	case p.symbol("<"):
+		filter.Type = "lt"
+	case p.symbol("<="):
+		filter.Type = "lte"
+	case p.keyword("PREFIX"):
+		filter.Type = "prefix"
+	case p.keyword("CONTAINS"):
+		filter.Type = "contains"
+	case p.keyword("EXISTS"):
+		filter.Type = "exists"
+		return filter, nil
+	case p.keyword("IN"):
+		if p.isName() {
+			return p.parseResultReference(filter), nil
+		}
+		filter.Type = "in"
+		filter.Values, err = p.parseValueList()
+		return filter, err
+	case p.keyword("BETWEEN"):
+		filter.Type = "between"
+		lo, err := p.parseValue()
+		if err != nil {
+			return Filter{}, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return Filter{}, err
+		}
+		hi, err := p.parseValue()
+		filter.Values = []string{lo, hi}
+		return filter, err
+	case p.keyword("NOT"):
+		switch {
+		case p.keyword("IN"):
+			filter.Type = "not_in"
+			filter.Values, err = p.parseValueList()
+			return filter, err
+		case p.keyword("EXISTS"):
+			filter.Type = "not_exists"
+			return filter, nil
+		}
+		return Filter{}, p.unexpected("IN or EXISTS")
+	default:
+		return Filter{}, p.errorf(tok, "expected a comparison after %q, found %s", key, describeToken(tok))
+	}
+
+	filter.Value, err = p.parseValue()
+	return filter, err
+}
+
+// parseResultReference parses the data block of an in_result filter, followed by a dot and
+// the key to read from its events when that is not the key of the filter
+func (p *queryParser) parseResultReference(filter Filter) Filter {
+	tok := p.next()
+	filter.Type, filter.Data = "in_result", tok.text
+	if i := strings.IndexByte(tok.text, '.'); tok.kind == tokenName && i >= 0 {
+		filter.Data, filter.DataKey = tok.text[:i], tok.text[i+1:]
+	}
+	return filter
+}
+
+// parseValue parses a string or a number. Numbers are kept as they are written like the
+// numbers of JSON queries, so that large integers and leading zeros are not lost.
+func (p *queryParser) parseValue() (string, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenString, tokenNumber:
+		return p.next().text, nil
+	}
+	return "", p.unexpected("a string or a number")
+}
+
+func (p *queryParser) parseValueList() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var values []string
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return values, p.expectSymbol(")")
+}
+
+// FormatQuery writes a query as text, which parses back into the same query. An error is
+// returned if the query uses something text queries can not express, such as the start or
+// end of a data block.
+func FormatQuery(query Query) (string, error) {
+	f := &queryFormatter{}
+	text, err := f.formatQuery(query)
+	if err == nil {
+		err = f.err
+	}
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// queryFormatter writes queries as text, keeping the first name which can not be written
+type queryFormatter struct {
+	err error
+}
+
+func (f *queryFormatter) formatQuery(query Query) (string, error) {
+	var lines []string
+	for _, data := range query.Data {
+		dataLines, err := f.formatData(data)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, dataLines...)
+	}
+
+	if query.Funnel != nil {
+		funnel, err := f.formatFunnel(*query.Funnel)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, funnel)
+	}
+	for _, formula := range query.Formulas {
+		lines = append(lines, "FORMULA "+strconv.Quote(formula.Expression)+" AS "+f.formatName(formula.Name))
+	}
+	if query.Start > 0 {
+		lines = append(lines, "SINCE "+strconv.FormatUint(query.Start, 10))
+	}
+	if query.End > 0 {
+		lines = append(lines, "UNTIL "+strconv.FormatUint(query.End, 10))
+	}
+	if query.Timeout != "" {
+		if !isDurationToken(query.Timeout) {
+			return "", fmt.Errorf("timeout %q can not be written as text", query.Timeout)
+		}
+		lines = append(lines, "TIMEOUT "+query.Timeout)
+	}
+
+	switch {
+	case query.Explain && query.Profile:
+		return "", fmt.Errorf("a text query can not be both explained and profiled")
+	case query.Explain && len(lines) > 0:
+		lines[0] = "EXPLAIN " + lines[0]
+	case query.Profile && len(lines) > 0:
+		lines[0] = "PROFILE " + lines[0]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (f *queryFormatter) formatData(data Data) ([]string, error) {
+	if len(data.Keys) == 0 && len(data.Operations) == 0 && data.HideData {
+		return nil, fmt.Errorf("%q hides its data without operations, which can not be written as text", data.Name)
+	}
+	if data.HideData != (len(data.Keys) == 0 && len(data.Operations) > 0) {
+		return nil, fmt.Errorf("%q has hideData %v with %d keys, which can not be written as text", data.Name, data.HideData, len(data.Keys))
+	}
+	if data.Start != 0 || data.End != 0 {
+		return nil, fmt.Errorf("%q has its own start or end, which can not be written as text", data.Name)
+	}
+
+	from := "FROM " + f.formatName(data.Tag)
+	if data.Name != "" {
+		from += " AS " + f.formatName(data.Name)
+	}
+	lines := []string{from}
+
+	if len(data.Filters) > 0 {
+		filters := make([]string, len(data.Filters))
+		for i, filter := range data.Filters {
+			context := filterContextTop
+			if len(data.Filters) > 1 {
+				context = filterContextAnd
+			}
+			var err error
+			filters[i], err = f.formatFilter(filter, context)
+			if err != nil {
+				return nil, err
+			}
+		}
+		lines = append(lines, "WHERE "+strings.Join(filters, " AND "))
+	}
+
+	operations := data.Operations
+	var group *Operation
+	if len(operations) == 1 && operations[0].Type == "group_by" {
+		group = &operations[0]
+		operations = group.Operations
+		if len(operations) == 0 || len(group.Keys) == 0 || group.Name != "" {
+			return nil, fmt.Errorf("group_by operation in %q can not be written as text", data.Name)
+		}
+	}
+	if len(data.Keys) > 0 || len(operations) > 0 {
+		var items []string
+		for _, key := range data.Keys {
+			if key == allKeys {
+				items = append(items, allKeys)
+			} else {
+				items = append(items, f.formatName(key))
+			}
+		}
+		for _, operation := range operations {
+			item, err := f.formatOperation(operation)
+			if err != nil {
+				return nil, fmt.Errorf("%s in %q", err, data.Name)
+			}
+			items = append(items, item)
+		}
+		lines = append(lines, "SELECT "+strings.Join(items, ", "))
+	}
+
+	if group != nil {
+		lines = append(lines, "BY "+f.formatNames(group.Keys))
+	}
+	if data.Granularity != "" {
+		if !isDurationToken(data.Granularity) {
+			return nil, fmt.Errorf("granularity %q in %q can not be written as text", data.Granularity, data.Name)
+		}
+		lines = append(lines, "EVERY "+data.Granularity)
+	}
+
+	var page []string
+	if group != nil {
+		if data.Order != "" || data.Limit != 0 || data.Cursor != "" {
+			return nil, fmt.Errorf("%q pages its events and groups them, which can not be written as text", data.Name)
+		}
+		if group.OrderBy != "" || group.Order != "" {
+			order := "ORDER BY"
+			if group.OrderBy != "" {
+				order += " " + f.formatName(group.OrderBy)
+			}
+			if group.Order != "" {
+				direction, err := formatOrder(group.Order)
+				if err != nil {
+					return nil, err
+				}
+				order += " " + direction
+			}
+			page = append(page, order)
+		}
+		if group.Limit < 0 || (group.Other && group.Limit == 0) {
+			return nil, fmt.Errorf("group limit in %q can not be written as text", data.Name)
+		}
+		if group.Limit > 0 {
+			limit := "LIMIT " + strconv.Itoa(group.Limit)
+			if group.Other {
+				limit += " WITH OTHER"
+			}
+			page = append(page, limit)
+		}
+	} else {
+		if data.Order != "" {
+			direction, err := formatOrder(data.Order)
+			if err != nil {
+				return nil, err
+			}
+			page = append(page, "ORDER BY ts "+direction)
+		}
+		if data.Limit < 0 {
+			return nil, fmt.Errorf("limit in %q can not be written as text", data.Name)
+		}
+		if data.Limit > 0 {
+			page = append(page, "LIMIT "+strconv.Itoa(data.Limit))
+		}
+		if data.Cursor != "" {
+			page = append(page, "CURSOR "+strconv.Quote(data.Cursor))
+		}
+	}
+	if len(page) > 0 {
+		lines = append(lines, strings.Join(page, " "))
+	}
+	return lines, nil
+}
+
+func formatOrder(order string) (string, error) {
+	switch order {
+	case orderAsc, orderDesc:
+		return strings.ToUpper(order), nil
+	}
+	return "", fmt.Errorf("order %q can not be written as text", order)
+}
+
+func (f *queryFormatter) formatOperation(operation Operation) (string, error) {
+	if !isPlainName(operation.Type) || operation.Type == "group_by" || len(operation.Operations) > 0 {
+		return "", fmt.Errorf("%s operation can not be written as text", operation.Type)
+	}
+	if operation.Key == "" && len(operation.Keys) > 0 {
+		return "", fmt.Errorf("%s operation with keys and no key can not be written as text", operation.Type)
+	}
+
+	var args []string
+	if operation.Key != "" {
+		args = append(args, f.formatName(operation.Key))
+	}
+	for _, key := range operation.Keys {
+		args = append(args, f.formatName(key))
+	}
+	if operation.Percentile != 0 {
+		args = append(args, formatNumber(operation.Percentile))
+	}
+	if operation.Missing != "" {
+		args = append(args, "missing="+f.formatName(operation.Missing))
+	}
+	if operation.Precision != 0 {
+		args = append(args, "precision="+strconv.Itoa(operation.Precision))
+	}
+
+	item := operation.Type
+	if len(args) > 0 || operation.Type != "count" {
+		item += "(" + strings.Join(args, ", ") + ")"
+	}
+	if operation.Name != "" {
+		item += " AS " + f.formatName(operation.Name)
+	}
+	return item, nil
+}
+
+func (f *queryFormatter) formatFunnel(funnel Funnel) (string, error) {
+	if !isPlainName(funnel.Type) || len(funnel.Order) == 0 {
+		return "", fmt.Errorf("%s funnel can not be written as text", funnel.Type)
+	}
+	s := "FUNNEL " + funnel.Type + "(" + f.formatNames(funnel.Order) + ")"
+	if len(funnel.Match) > 0 {
+		s += " MATCH " + f.formatNames(funnel.Match)
+	}
+	if funnel.Window != "" {
+		if !isDurationToken(funnel.Window) {
+			return "", fmt.Errorf("funnel window %q can not be written as text", funnel.Window)
+		}
+		s += " WITHIN " + funnel.Window
+	}
+	return s, nil
+}
+
+// The places a filter is written in, which decide whether it needs parentheses
+const (
+	filterContextTop = iota // the only filter of a block
+	filterContextAnd
+	filterContextOr
+	filterContextNot
+)
+
+func (f *queryFormatter) formatFilter(filter Filter, context int) (string, error) {
+	switch filter.Type {
+	case "and", "or":
+		if len(filter.Filters) == 0 {
+			return "", fmt.Errorf("%s filter without filters can not be written as text", filter.Type)
+		}
+		childContext, separator := filterContextAnd, " AND "
+		if filter.Type == "or" {
+			childContext, separator = filterContextOr, " OR "
+		}
+		children := make([]string, len(filter.Filters))
+		for i, child := range filter.Filters {
+			var err error
+			children[i], err = f.formatFilter(child, childContext)
+			if err != nil {
+				return "", err
+			}
+		}
+		s := strings.Join(children, separator)
+		// An and filter is only written without parentheses between ORs, which bind less
+		// tightly, and an or filter only as the one filter of a block
+		if (filter.Type == "and" && context != filterContextOr) || (filter.Type == "or" && context != filterContextTop) {
+			s = "(" + s + ")"
+		}
+		return s, nil
+	case "not":
+		if len(filter.Filters) != 1 {
+			return "", fmt.Errorf("not filter without exactly one filter can not be written as text")
+		}
+		child, err := f.formatFilter(filter.Filters[0], filterContextNot)
+		return "NOT " + child, err
+	}
+
+	key := f.formatName(filter.Key)
+	switch filter.Type {
+	case "eq", "neq", "regex", "gt", "gte", "lt", "lte", "prefix", "contains":
+		operators := map[string]string{
+			"eq": "=", "neq": "!=", "regex": "=~", "gt": ">", "gte": ">=", "lt": "<", "lte": "<=",
+			"prefix": "PREFIX", "contains": "CONTAINS",
+		}
+		return key + " " + operators[filter.Type] + " " + formatValue(filter.Value), nil
+	case "in", "not_in":
+		if len(filter.Values) == 0 {
+			return "", fmt.Errorf("%s filter without values can not be written as text", filter.Type)
+		}
+		values := make([]string, len(filter.Values))
+		for i, value := range filter.Values {
+			values[i] = formatValue(value)
+		}
+		operator := "IN"
+		if filter.Type == "not_in" {
+			operator = "NOT IN"
+		}
+		return key + " " + operator + " (" + strings.Join(values, ", ") + ")", nil
+	case "between":
+		if len(filter.Values) != 2 {
+			return "", fmt.Errorf("between filter without two values can not be written as text")
+		}
+		return key + " BETWEEN " + formatValue(filter.Values[0]) + " AND " + formatValue(filter.Values[1]), nil
+	case "exists":
+		return key + " EXISTS", nil
+	case "not_exists":
+		return key + " NOT EXISTS", nil
+	case "in_result":
+		return key + " IN " + f.formatResultReference(filter), nil
+	}
+	return "", fmt.Errorf("%s filter can not be written as text", filter.Type)
+}
+
+// formatValue writes a value as a number if it reads back as the same value, and as a
+// string otherwise
+func formatValue(value string) string {
+	if tokens, err := lexQuery(value); err == nil && len(tokens) == 2 && tokens[0].kind == tokenNumber && tokens[0].text == value {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// isPlainName reports whether the name can be written without backticks
+func isPlainName(name string) bool {
+	if name == "" || !isNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isNamePart(name[i]) {
+			return false
+		}
+	}
+	_, isKeyword := queryKeywords[strings.ToUpper(name)]
+	return !isKeyword
+}
+
+func (f *queryFormatter) formatName(name string) string {
+	if isPlainName(name) {
+		return name
+	}
+	if strings.Contains(name, "`") && f.err == nil {
+		f.err = fmt.Errorf("name %q can not be written as text", name)
+	}
+	return "`" + name + "`"
+}
+
+// formatResultReference writes the data block of an in_result filter, and the key it reads
+// after a dot. Block names with a dot are quoted so that the dot is not read as the key.
+func (f *queryFormatter) formatResultReference(filter Filter) string {
+	if filter.DataKey == "" {
+		if isPlainName(filter.Data) && !strings.Contains(filter.Data, ".") {
+			return filter.Data
+		}
+		if strings.Contains(filter.Data, "`") && f.err == nil {
+			f.err = fmt.Errorf("name %q can not be written as text", filter.Data)
+		}
+		return "`" + filter.Data + "`"
+	}
+	// The key is the rest of the name after the dot, so it may start with a digit
+	reference := filter.Data + "." + filter.DataKey
+	if !isPlainName(filter.Data) || strings.Contains(filter.Data, ".") || !isPlainName("_"+filter.DataKey) {
+		if f.err == nil {
+			f.err = fmt.Errorf("in_result reference %q can not be written as text", reference)
+		}
+	}
+	return reference
+}
+
+func (f *queryFormatter) formatNames(names []string) string {
+	formatted := make([]string, len(names))
+	for i, name := range names {
+		formatted[i] = f.formatName(name)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// isDurationToken reports whether the text is read as one duration
+func isDurationToken(text string) bool {
+	tokens, err := lexQuery(text)
+	return err == nil && len(tokens) == 2 && tokens[0].kind == tokenDuration && tokens[0].text == text
+}
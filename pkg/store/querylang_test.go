@@ -0,0 +1,289 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var queryTestNow = time.Unix(1600000000, 0)
+
+func TestParseQuery(t *testing.T) {
+	got, err := ParseQuery(`from page_view WHERE path =~ "^/api" AND status = 500 SELECT count, uniqueCount(user_id) BY path SINCE 1h`, queryTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Query{
+		Start: 1600000000000 - 60*60*1000,
+		Data: []Data{{
+			Tag: "page_view",
+			Filters: []Filter{
+				{Type: "regex", Key: "path", Value: "^/api"},
+				{Type: "eq", Key: "status", Value: "500"},
+			},
+			Operations: []Operation{{Type: "group_by", Keys: []string{"path"}, Operations: []Operation{
+				{Type: "count"},
+				{Type: "uniqueCount", Key: "user_id"},
+			}}},
+			HideData: true,
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseQuery() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseQuery_numbers(t *testing.T) {
+	got, err := ParseQuery(`FROM a WHERE id = 9007199254740993 AND zip IN (02134, 1e21, -0.50)`, queryTestNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Filter{
+		{Type: "eq", Key: "id", Value: "9007199254740993"},
+		{Type: "in", Key: "zip", Values: []string{"02134", "1e21", "-0.50"}},
+	}
+	if !reflect.DeepEqual(got.Data[0].Filters, want) {
+		t.Errorf("ParseQuery() filters = %+v, want %+v", got.Data[0].Filters, want)
+	}
+}
+
+func TestFormatQuery_roundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		text  string
+	}{
+		{
+			"Events",
+			Query{Data: []Data{{Tag: "page_view"}}},
+			"FROM page_view",
+		},
+		{
+			"Keys and pages",
+			Query{Start: 1000, End: 2000, Timeout: "1m30s", Data: []Data{{
+				Name: "views", Tag: "page view", Keys: []string{"path", "from"}, Order: orderDesc, Limit: 10, Cursor: "ZAB",
+			}}},
+			"FROM `page view` AS views\nSELECT path, `from`\nORDER BY ts DESC LIMIT 10 CURSOR \"ZAB\"\nSINCE 1000\nUNTIL 2000\nTIMEOUT 1m30s",
+		},
+		{
+			"Every key",
+			Query{Data: []Data{{Tag: "a", Keys: []string{allKeys}}}},
+			"FROM a\nSELECT *",
+		},
+		{
+			"Filters",
+			Query{Data: []Data{{Tag: "a", Filters: []Filter{
+				{Type: "neq", Key: "path", Value: "/home \"x\""},
+				{Type: "in", Key: "status", Values: []string{"500", "5e2", "01"}},
+				{Type: "not_in", Key: "b", Values: []string{"x"}},
+				{Type: "prefix", Key: "c", Value: "/api"},
+				{Type: "contains", Key: "d", Value: "x"},
+				{Type: "exists", Key: "e"},
+				{Type: "not_exists", Key: "f"},
+				{Type: "gte", Key: "g", Value: "-1.5"},
+				{Type: "lt", Key: "g", Value: "1e+21"},
+				{Type: "between", Key: "h", Values: []string{"1", "2"}},
+			}}}},
+			`FROM a` + "\n" + `WHERE path != "/home \"x\"" AND status IN (500, 5e2, 01) AND b NOT IN ("x") AND c PREFIX "/api" AND d CONTAINS "x" AND e EXISTS AND f NOT EXISTS AND g >= -1.5 AND g < 1e+21 AND h BETWEEN 1 AND 2`,
+		},
+		{
+			"Boolean filters",
+			Query{Data: []Data{{Tag: "a", Filters: []Filter{
+				{Type: "or", Filters: []Filter{
+					{Type: "and", Filters: []Filter{{Type: "eq", Key: "a", Value: "1"}, {Type: "eq", Key: "b", Value: "2"}}},
+					{Type: "or", Filters: []Filter{{Type: "eq", Key: "c", Value: "3"}, {Type: "eq", Key: "d", Value: "4"}}},
+					{Type: "not", Filters: []Filter{{Type: "and", Filters: []Filter{{Type: "exists", Key: "e"}, {Type: "exists", Key: "f"}}}}},
+				}},
+				{Type: "and", Filters: []Filter{{Type: "eq", Key: "g", Value: "5"}, {Type: "eq", Key: "h", Value: "6"}}},
+				{Type: "not", Filters: []Filter{{Type: "eq", Key: "i", Value: "7"}}},
+			}}}},
+			"FROM a\nWHERE (a = 1 AND b = 2 OR (c = 3 OR d = 4) OR NOT (e EXISTS AND f EXISTS)) AND (g = 5 AND h = 6) AND NOT i = 7",
+		},
+		{
+			"One or filter",
+			Query{Data: []Data{{Tag: "a", Filters: []Filter{
+				{Type: "or", Filters: []Filter{{Type: "eq", Key: "a", Value: "1"}, {Type: "regex", Key: "b", Value: `\d+`}}},
+			}}}},
+			"FROM a\nWHERE a = 1 OR b =~ \"\\\\d+\"",
+		},
+		{
+			"One and filter",
+			Query{Data: []Data{{Tag: "a", Filters: []Filter{
+				{Type: "and", Filters: []Filter{{Type: "eq", Key: "a", Value: "1"}, {Type: "eq", Key: "b", Value: "2"}}},
+			}}}},
+			"FROM a\nWHERE (a = 1 AND b = 2)",
+		},
+		{
+			"Operations",
+			Query{Data: []Data{{Tag: "a", Keys: []string{"path"}, Granularity: "1d", Operations: []Operation{
+				{Type: "count", Name: "views"},
+				{Type: "uniqueCount", Key: "user_id", Keys: []string{"session_id"}, Missing: "null"},
+				{Type: "approxUniqueCount", Key: "user_id", Precision: 12},
+				{Type: "p99.9", Key: "duration_ms"},
+				{Type: "percentile", Key: "duration_ms", Percentile: 99.5, Name: "select"},
+				{Type: "sum"},
+			}}}},
+			"FROM a\nSELECT path, count AS views, uniqueCount(user_id, session_id, missing=null), approxUniqueCount(user_id, precision=12), p99.9(duration_ms), percentile(duration_ms, 99.5) AS `select`, sum()\nEVERY 1d",
+		},
+		{
+			"Groups",
+			Query{Data: []Data{{Tag: "a", HideData: true, Operations: []Operation{{
+				Type: "group_by", Keys: []string{"path", "status"}, OrderBy: "count", Order: orderAsc, Limit: 5, Other: true,
+				Operations: []Operation{{Type: "count"}},
+			}}}}},
+			"FROM a\nSELECT count\nBY path, status\nORDER BY count ASC LIMIT 5 WITH OTHER",
+		},
+		{
+			"Results of other blocks",
+			Query{Data: []Data{
+				{Name: "purchases", Tag: "purchase", Filters: []Filter{
+					{Type: "in_result", Key: "user_id", Data: "viewed"},
+					{Type: "in_result", Key: "buyer", Data: "viewed", DataKey: "user_id"},
+					{Type: "not", Filters: []Filter{{Type: "in_result", Key: "user_id", Data: "cart.v2"}}},
+				}},
+				{Name: "viewed", Tag: "product_view"},
+				{Name: "cart.v2", Tag: "add_to_cart"},
+			}},
+			"FROM purchase AS purchases\nWHERE user_id IN viewed AND buyer IN viewed.user_id AND NOT user_id IN `cart.v2`\nFROM product_view AS viewed\nFROM add_to_cart AS cart.v2",
+		},
+		{
+			"Formulas",
+			Query{
+				Data: []Data{{Name: "view", Tag: "product_view", HideData: true, Operations: []Operation{{Type: "count"}}}},
+				Formulas: []Formula{
+					{Name: "double", Expression: "view.count * 2"},
+					{Name: "order", Expression: "view.`p99.9` / \"x\""},
+				},
+				Start: 1000,
+			},
+			"FROM product_view AS view\nSELECT count\nFORMULA \"view.count * 2\" AS double\nFORMULA \"view.`p99.9` / \\\"x\\\"\" AS `order`\nSINCE 1000",
+		},
+		{
+			"Explain",
+			Query{Explain: true, Data: []Data{{Tag: "a"}, {Tag: "b"}}},
+			"EXPLAIN FROM a\nFROM b",
+		},
+		{
+			"Profile",
+			Query{Profile: true, Data: []Data{{Tag: "a"}}, Timeout: "1s"},
+			"PROFILE FROM a\nTIMEOUT 1s",
+		},
+		{
+			"Funnel",
+			Query{
+				Data: []Data{
+					{Name: "view", Tag: "product_view", Keys: []string{"user_id"}},
+					{Name: "cart", Tag: "add_to_cart", Keys: []string{"user_id"}},
+				},
+				Funnel: &Funnel{Type: "exact_order", Order: []string{"view", "cart"}, Match: []string{"user_id"}, Window: "1h"},
+			},
+			"FROM product_view AS view\nSELECT user_id\nFROM add_to_cart AS cart\nSELECT user_id\nFUNNEL exact_order(view, cart) MATCH user_id WITHIN 1h",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := FormatQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tt.text {
+				t.Errorf("FormatQuery() = %s\nwant %s", text, tt.text)
+			}
+			query, err := ParseQuery(text, queryTestNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(query, tt.query) {
+				t.Errorf("ParseQuery() = %+v, want %+v", query, tt.query)
+			}
+		})
+	}
+}
+
+func TestParseQuery_errors(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", `line 1, column 1: expected FROM, found end of query`},
+		{"FROM a\nWHERE path ~ 1", `line 2, column 12: unexpected character '~'`},
+		{"FROM a\nWHERE path", `line 2, column 11: expected a comparison after "path", found end of query`},
+		{"FROM a WHERE (a = 1", `line 1, column 20: expected ")", found end of query`},
+		{"FROM a WHERE a = \"x", `line 1, column 18: unterminated string`},
+		{"FROM `a", `line 1, column 6: unterminated name`},
+		{"FROM select", `line 1, column 6: expected a tag, found "select"`},
+		{"FROM a SELECT count BY", `line 1, column 23: expected a key, found end of query`},
+		{"FROM a SELECT path BY path", `line 1, column 20: BY needs operations in SELECT`},
+		{"FROM a SELECT group_by(path)", `line 1, column 15: group operations with BY`},
+		{"FROM a SELECT uniqueCount(a, color=red)", `line 1, column 30: unknown option "color"`},
+		{"FROM a ORDER BY path DESC", `line 1, column 17: events can only be ordered by ts`},
+		{"FROM a LIMIT -1", `line 1, column 14: expected a limit, found "-1"`},
+		{"FROM a EVERY 1x", `line 1, column 14: "1x" is not a granularity`},
+		{"FROM a SINCE 1h TIMEOUT soon", `line 1, column 25: expected a timeout, found "soon"`},
+		{"FROM a éWHERE", `line 1, column 8: unexpected character 'é'`},
+		{"FROM a WHERE a = 1 FROM", `line 1, column 24: expected a tag, found end of query`},
+		{"FROM a b", `line 1, column 8: expected end of query, found "b"`},
+		{"FROM a FORMULA a.count", `line 1, column 16: expected a formula expression, found "a.count"`},
+		{"FROM a FORMULA \"a.count\"", `line 1, column 25: expected AS, found end of query`},
+	}
+	for _, tt := range tests {
+		_, err := ParseQuery(tt.text, queryTestNow)
+		if _, ok := err.(*QuerySyntaxError); !ok || err.Error() != tt.want {
+			t.Errorf("ParseQuery(%q) error = %v, want %s", tt.text, err, tt.want)
+		}
+	}
+}
+
+func TestFormatQuery_unsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		data Data
+	}{
+		{"Data start", Data{Tag: "a", Start: 1}},
+		{"Operations without hidden data", Data{Tag: "a", Operations: []Operation{{Type: "count"}}}},
+		{"Hidden keys", Data{Tag: "a", Keys: []string{"path"}, HideData: true}},
+		{"Group with other operations", Data{Tag: "a", HideData: true, Operations: []Operation{{Type: "count"}, {Type: "group_by", Keys: []string{"a"}, Operations: []Operation{{Type: "count"}}}}}},
+		{"Empty or", Data{Tag: "a", Filters: []Filter{{Type: "or"}}}},
+		{"Backtick", Data{Tag: "a`b"}},
+		{"Dotted block with a key", Data{Tag: "a", Filters: []Filter{{Type: "in_result", Key: "k", Data: "b.c", DataKey: "k"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if text, err := FormatQuery(Query{Data: []Data{tt.data}}); err == nil {
+				t.Errorf("FormatQuery() = %q, want error", text)
+			}
+		})
+	}
+}
+
+func TestAPI_handleQuery_text(t *testing.T) {
+	api := &API{Store: newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"path": "/a"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"path": "/b"}},
+	})}
+
+	req := httptest.NewRequest("POST", APIPathQuery, strings.NewReader("from tag1 where path = \"/a\" select count"))
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	var result QueryResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || result.Data[0].Meta["count"] != 1.0 || result.Query != "FROM tag1\nWHERE path = \"/a\"\nSELECT count" {
+		t.Errorf("ServeHTTP() = %d %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", APIPathQuery, strings.NewReader("FROM tag1 WHERE"))
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "line 1, column 16") {
+		t.Errorf("ServeHTTP() of invalid text query = %d %s", w.Code, w.Body.String())
+	}
+}
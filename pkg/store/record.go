@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/aaron7/eventstore/pkg/db"
+)
+
+// errInvalidRecord is returned when a record can not be decoded
+var errInvalidRecord = errors.New("invalid record")
+
+// StoredEvent is an event read back from its record
+type StoredEvent struct {
+	ID uint64 `json:"id"`
+	Event
+}
+
+// MarshalJSON writes the ID next to the fields of the event, which would otherwise be
+// replaced by the promoted Event.MarshalJSON
+func (e StoredEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID uint64 `json:"id"`
+		eventJSON
+	}{e.ID, e.Event.toJSON()})
+}
+
+// StoredEvents is a list of stored events
+type StoredEvents struct {
+	Events []StoredEvent `json:"events"`
+}
+
+// An event record is encoded as
+// uvarint(ts) uvarint(samplerate) string(tag) uvarint(n) n * (string(dimension) string(value))
+// uvarint(m) m * (string(dimension) float64(number))
+// where a string is uvarint(len) followed by the bytes and a float64 is its 8 IEEE 754 bits.
+// Dimensions are sorted by name.
+
+func encodeEventRecord(event Event) []byte {
+	dimensions := make([]string, 0, len(event.Data))
+	length := 4*binary.MaxVarintLen64 + len(event.Tag)
+	for dimension, value := range event.Data {
+		dimensions = append(dimensions, dimension)
+		length += 2*binary.MaxVarintLen64 + len(dimension) + len(value)
+	}
+	for dimension := range event.Numbers {
+		length += binary.MaxVarintLen64 + len(dimension) + 8
+	}
+	sort.Strings(dimensions)
+
+	buf := make([]byte, 0, length)
+	buf = appendUvarint(buf, event.TS)
+	buf = appendUvarint(buf, uint64(getSamplerate(event.Samplerate)))
+	buf = appendString(buf, event.Tag)
+	buf = appendUvarint(buf, uint64(len(dimensions)))
+	for _, dimension := range dimensions {
+		buf = appendString(buf, dimension)
+		buf = appendString(buf, event.Data[dimension])
+	}
+
+	dimensions = dimensions[:0]
+	for dimension := range event.Numbers {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	buf = appendUvarint(buf, uint64(len(dimensions)))
+	for _, dimension := range dimensions {
+		buf = appendString(buf, dimension)
+		buf = appendUint64(buf, math.Float64bits(event.Numbers[dimension]))
+	}
+	return buf
+}
+
+func decodeEventRecord(b []byte) (Event, error) {
+	var event Event
+	r := recordReader{b: b}
+	event.TS = r.uvarint()
+	event.Samplerate = int(r.uvarint())
+	event.Tag = r.string()
+	n := r.uvarint()
+	if r.err != nil || n > uint64(len(b)) {
+		return Event{}, errInvalidRecord
+	}
+	event.Data = make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		dimension := r.string()
+		event.Data[dimension] = r.string()
+	}
+	m := r.uvarint()
+	if r.err != nil || m > uint64(len(b)) {
+		return Event{}, errInvalidRecord
+	}
+	if m > 0 {
+		event.Numbers = make(map[string]float64, m)
+	}
+	for i := uint64(0); i < m; i++ {
+		dimension := r.string()
+		event.Numbers[dimension] = math.Float64frombits(r.uint64())
+	}
+	if r.err != nil || len(r.b) != 0 {
+		return Event{}, errInvalidRecord
+	}
+	return event, nil
+}
+
+// getSamplerate returns the samplerate of an event, treating a missing samplerate as 1
+func getSamplerate(samplerate int) int {
+	if samplerate < 1 {
+		return 1
+	}
+	return samplerate
+}
+
+func appendUvarint(dst []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return append(dst, buf[:n]...)
+}
+
+func appendUint64(dst []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], x)
+	return append(dst, buf[:]...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// recordReader reads an encoded record, remembering the first error
+type recordReader struct {
+	b   []byte
+	err error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errInvalidRecord
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *recordReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 8 {
+		r.err = errInvalidRecord
+		return 0
+	}
+	x := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return x
+}
+
+func (r *recordReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.b)) {
+		r.err = errInvalidRecord
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// LookupEvent returns the event with the ID
+func (s *Store) LookupEvent(eventID uint64) (event StoredEvent, exists bool, err error) {
+	value, exists, err := s.DB.LookupValue(getEventRecordKey(eventID))
+	if err != nil || !exists {
+		return StoredEvent{}, false, err
+	}
+	e, err := decodeEventRecord(value)
+	if err != nil {
+		return StoredEvent{}, false, err
+	}
+	return StoredEvent{ID: eventID, Event: e}, true, nil
+}
+
+// LookupEvents returns the events with the IDs in ID order. IDs which do not exist are
+// skipped.
+func (s *Store) LookupEvents(ctx context.Context, eventIDs []uint64) ([]StoredEvent, error) {
+	sorted := append([]uint64{}, eventIDs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	events := []StoredEvent{}
+	err := s.rangeEventRecords(ctx, sorted, func(eventID uint64, event Event) error {
+		events = append(events, StoredEvent{ID: eventID, Event: event})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// rangeEventRecords calls fn with the record of every event ID that exists. The IDs must be
+// sorted so that the records are read with a single forward iterator.
+func (s *Store) rangeEventRecords(ctx context.Context, eventIDs []uint64, fn func(eventID uint64, event Event) error) error {
+	it := s.DB.NewIterator(db.IteratorOptions{Prefix: getPartialEventRecordRangeKey()})
+	defer it.Close()
+
+	counters := newScanCounters(ctx)
+	defer counters.flush()
+	for i, eventID := range eventIDs {
+		if i > 0 && eventID == eventIDs[i-1] {
+			continue
+		}
+		if err := counters.scannedKey(); err != nil {
+			return err
+		}
+		key := getEventRecordKey(eventID)
+		it.Seek(key)
+		if !it.Valid() || string(it.Key()) != string(key) {
+			continue
+		}
+		value, err := it.Value()
+		if err != nil {
+			return err
+		}
+		counters.decodedBytes(len(value))
+		event, err := decodeEventRecord(value)
+		if err != nil {
+			return err
+		}
+		err = fn(eventID, event)
+		if err == db.ErrStopIteration {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func Test_decodeEventRecord_roundTrip(t *testing.T) {
+	f := func(tag string, ts uint64, samplerate uint16, data map[string]string, numbers map[string]float64) bool {
+		if len(numbers) == 0 {
+			numbers = nil
+		}
+		event := Event{Tag: tag, TS: ts, Samplerate: int(samplerate) + 1, Data: data, Numbers: numbers}
+		got, err := decodeEventRecord(encodeEventRecord(event))
+		if data == nil {
+			event.Data = map[string]string{}
+		}
+		return err == nil && reflect.DeepEqual(got, event)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := decodeEventRecord([]byte{1, 1, 5, 'a'}); err != errInvalidRecord {
+		t.Errorf("decodeEventRecord() error = %v, want %v", err, errInvalidRecord)
+	}
+}
+
+func TestEvent_JSON(t *testing.T) {
+	var event Event
+	err := json.Unmarshal([]byte(`{"tag": "tag1", "ts": 1001, "data": {"path": "/home", "duration_ms": 512.5, "status": 200, "id": 9007199254740993, "size": 1e21, "user": null}}`), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Event{
+		Tag:     "tag1",
+		TS:      1001,
+		Data:    map[string]string{"path": "/home", "duration_ms": "512.5", "status": "200", "id": "9007199254740993", "size": "1e21"},
+		Numbers: map[string]float64{"duration_ms": 512.5, "status": 200, "id": 9007199254740993, "size": 1e21},
+	}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("json.Unmarshal() = %v, want %v", event, want)
+	}
+
+	b, err := json.Marshal(StoredEvent{ID: 1, Event: event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON := `{"id":1,"tag":"tag1","ts":1001,"samplerate":0,"data":{"duration_ms":512.5,"id":9007199254740993,"path":"/home","size":1e21,"status":200}}`
+	if string(b) != wantJSON {
+		t.Errorf("json.Marshal() = %s, want %s", b, wantJSON)
+	}
+
+	if err := json.Unmarshal([]byte(`{"data": {"flag": true}}`), &event); err == nil {
+		t.Errorf("json.Unmarshal() of a boolean value did not return an error")
+	}
+}
+
+func TestStore_LookupEvents(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"dim1": "foo"}},
+		{Tag: "tag2", TS: 1002, Samplerate: 10, Data: map[string]string{"dim1": "bar", "dim2": "baz"}},
+	})
+
+	event, exists, err := s.LookupEvent(2)
+	want := StoredEvent{ID: 2, Event: Event{Tag: "tag2", TS: 1002, Samplerate: 10, Data: map[string]string{"dim1": "bar", "dim2": "baz"}}}
+	if err != nil || !exists || !reflect.DeepEqual(event, want) {
+		t.Errorf("LookupEvent() = %v, %v, %v, want %v", event, exists, err, want)
+	}
+	if _, exists, err := s.LookupEvent(3); err != nil || exists {
+		t.Errorf("LookupEvent() of missing event = %v, %v", exists, err)
+	}
+
+	events, err := s.LookupEvents(context.Background(), []uint64{3, 2, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != 1 || events[0].Samplerate != 1 || events[1].ID != 2 {
+		t.Errorf("LookupEvents() = %v", events)
+	}
+}
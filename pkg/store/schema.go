@@ -1,70 +1,290 @@
 package store
 
 import (
-	"fmt"
-	"strings"
+	"context"
+	"errors"
 
 	"github.com/aaron7/eventstore/pkg/db"
 )
 
+// Format version
+// (meta, format_version) => version
+//
+// The format version is bumped whenever the on-disk key layout changes so that a database
+// written with a different layout is rejected instead of being decoded wrong.
+const (
+	metaPrefix    = "m"
+	formatVersion = 8
+)
+
+var formatVersionKey = encodeKey([]byte(metaPrefix), []byte("format_version"))
+
+// ErrFormatVersion is returned when the database was written with a different key layout
+var ErrFormatVersion = errors.New("database format version is not supported")
+
 // Event index
-// (tag, dimension, value, event_id) => nil
-const eventIndexPrefix = "e"
+// (tag, dimension, bucket, value, ts, event_id) => samplerate
+//
+// The samplerate is stored as a uvarint and left empty when it is 1.
+//
+// Index entries are partitioned into fixed width time buckets so that a time range only
+// has to read the buckets it overlaps.
+const (
+	eventIndexPrefix      = "e"
+	eventIndexBucketWidth = 24 * 60 * 60 * 1000 // 1 day in ms
+)
 
-func createEventIndexEntry(tag, dimension, value string, ts, eventID uint64) db.KeyValuePair {
+func createEventIndexEntry(tag, dimension, value string, ts, eventID uint64, samplerate int) db.KeyValuePair {
 	return db.KeyValuePair{
 		Key:   getEventIndexEntryKey(tag, dimension, value, ts, eventID),
-		Value: nil,
+		Value: encodeEventIndexValue(samplerate),
 	}
 }
 
 func getEventIndexEntryKey(tag, dimension, value string, ts, eventID uint64) []byte {
-	return []byte(fmt.Sprintf("%s:%s:%s:%s:%s:%s", eventIndexPrefix, tag, dimension, value, uint64ToBytes(ts), uint64ToBytes(eventID)))
+	key := getPartialEventIndexValueRangeKey(tag, dimension, getEventIndexBucket(ts), value)
+	key = append(key, uint64ToBytes(ts)...)
+	return append(key, uint64ToBytes(eventID)...)
+}
+
+func decodeEventIndexKey(key []byte) (tag, dimension, value string, ts, eventID uint64, err error) {
+	components, rest, err := decodeKey(key, 5)
+	if err != nil {
+		return
+	}
+	if string(components[0]) != eventIndexPrefix || len(components[3]) != 8 || len(rest) != 16 {
+		err = errInvalidKey
+		return
+	}
+	return string(components[1]), string(components[2]), string(components[4]), bytesToUint64(rest[:8]), bytesToUint64(rest[8:]), nil
+}
+
+func encodeEventIndexValue(samplerate int) []byte {
+	if getSamplerate(samplerate) == 1 {
+		return nil
+	}
+	return appendUvarint(nil, uint64(samplerate))
+}
+
+func decodeEventIndexValue(value []byte) (samplerate int, err error) {
+	if len(value) == 0 {
+		return 1, nil
+	}
+	r := recordReader{b: value}
+	samplerate = int(r.uvarint())
+	if r.err != nil || len(r.b) != 0 {
+		return 0, errInvalidRecord
+	}
+	return getSamplerate(samplerate), nil
 }
 
-func decodeEventIndexKey(key []byte) (tag, dimension, value string, ts, eventID uint64) {
-	s := string(key)
-	parts := strings.SplitN(s, ":", 6)
-	return parts[1], parts[2], parts[3], bytesToUint64([]byte(parts[4])), bytesToUint64([]byte(parts[5]))
+func getEventIndexBucket(ts uint64) uint64 {
+	return ts / eventIndexBucketWidth
 }
 
 func getPartialEventIndexTagRangeKey(tag string) []byte {
-	return []byte(fmt.Sprintf("%s:%s:", eventIndexPrefix, tag))
-}
-
-func getPartialEventIndexDimensionRangeKey(tag, dimension string) []byte {
-	return []byte(fmt.Sprintf("%s:%s:%s:", eventIndexPrefix, tag, dimension))
-}
-
-func getPartialEventIndexValueRangeKey(tag, dimension, value string) []byte {
-	return []byte(fmt.Sprintf("%s:%s:%s:%s:", eventIndexPrefix, tag, dimension, value))
-}
-
-// TODO: Use the below
-// func encodeKey(ss ...[]byte) []byte {
-// 	length := 0
-// 	for _, s := range ss {
-// 		length += len(s) + 1
-// 	}
-// 	output, i := make([]byte, length, length), 0
-// 	for _, s := range ss {
-// 		copy(output[i:i+len(s)], s)
-// 		i += len(s) + 1
-// 	}
-// 	return output
-// }
-
-// func decodeKey(value []byte) [][]byte {
-// 	components := make([][]byte, 0, 5)
-// 	i, j := 0, 0
-// 	for j < len(value) {
-// 		if value[j] != 0 {
-// 			j++
-// 			continue
-// 		}
-// 		components = append(components, value[i:j])
-// 		j++
-// 		i = j
-// 	}
-// 	return components
-// }
+	return encodeKey([]byte(eventIndexPrefix), []byte(tag))
+}
+
+func getPartialEventIndexBucketRangeKey(tag, dimension string, bucket uint64) []byte {
+	return encodeKey([]byte(eventIndexPrefix), []byte(tag), []byte(dimension), uint64ToBytes(bucket))
+}
+
+func getPartialEventIndexValueRangeKey(tag, dimension string, bucket uint64, value string) []byte {
+	return encodeKey([]byte(eventIndexPrefix), []byte(tag), []byte(dimension), uint64ToBytes(bucket), []byte(value))
+}
+
+// Numeric event index
+// (tag, dimension, bucket, number, ts, event_id) => uvarint(samplerate) text
+//
+// Numeric values are also written to the event index in the JSON form they were ingested
+// in. The number is encoded with float64ToBytes so that a range of numbers is a range of
+// keys, and the value keeps the JSON form unless it is the decimal form of the number.
+const numericIndexPrefix = "n"
+
+func createNumericIndexEntry(tag, dimension string, number float64, text string, ts, eventID uint64, samplerate int) db.KeyValuePair {
+	key := getPartialNumericIndexValueRangeKey(tag, dimension, getEventIndexBucket(ts), number)
+	key = append(key, uint64ToBytes(ts)...)
+	value := appendUvarint(nil, uint64(getSamplerate(samplerate)))
+	if text != formatNumber(number) {
+		value = append(value, text...)
+	}
+	return db.KeyValuePair{
+		Key:   append(key, uint64ToBytes(eventID)...),
+		Value: value,
+	}
+}
+
+// decodeNumericIndexValue returns the samplerate and the JSON form of the number, which is
+// empty when it is the decimal form
+func decodeNumericIndexValue(value []byte) (samplerate int, text string, err error) {
+	r := recordReader{b: value}
+	samplerate = int(r.uvarint())
+	if r.err != nil {
+		return 0, "", errInvalidRecord
+	}
+	return getSamplerate(samplerate), string(r.b), nil
+}
+
+func decodeNumericIndexKey(key []byte) (tag, dimension string, number float64, ts, eventID uint64, err error) {
+	components, rest, err := decodeKey(key, 5)
+	if err != nil {
+		return
+	}
+	if string(components[0]) != numericIndexPrefix || len(components[3]) != 8 || len(components[4]) != 8 || len(rest) != 16 {
+		err = errInvalidKey
+		return
+	}
+	return string(components[1]), string(components[2]), bytesToFloat64(components[4]), bytesToUint64(rest[:8]), bytesToUint64(rest[8:]), nil
+}
+
+func getPartialNumericIndexBucketRangeKey(tag, dimension string, bucket uint64) []byte {
+	return encodeKey([]byte(numericIndexPrefix), []byte(tag), []byte(dimension), uint64ToBytes(bucket))
+}
+
+func getPartialNumericIndexValueRangeKey(tag, dimension string, bucket uint64, number float64) []byte {
+	return encodeKey([]byte(numericIndexPrefix), []byte(tag), []byte(dimension), uint64ToBytes(bucket), float64ToBytes(number))
+}
+
+// Event index buckets
+// (tag, bucket) => nil
+const eventIndexBucketPrefix = "b"
+
+func createEventIndexBucketEntry(tag string, bucket uint64) db.KeyValuePair {
+	return db.KeyValuePair{
+		Key:   encodeKey([]byte(eventIndexBucketPrefix), []byte(tag), uint64ToBytes(bucket)),
+		Value: nil,
+	}
+}
+
+func decodeEventIndexBucketKey(key []byte) (tag string, bucket uint64, err error) {
+	components, rest, err := decodeKey(key, 3)
+	if err != nil {
+		return
+	}
+	if string(components[0]) != eventIndexBucketPrefix || len(components[2]) != 8 || len(rest) != 0 {
+		err = errInvalidKey
+		return
+	}
+	return string(components[1]), bytesToUint64(components[2]), nil
+}
+
+func getPartialEventIndexBucketTagRangeKey(tag string) []byte {
+	return encodeKey([]byte(eventIndexBucketPrefix), []byte(tag))
+}
+
+// Tag index
+// (tag, ts, event_id) => samplerate
+const tagIndexPrefix = "t"
+
+func createTagIndexEntry(tag string, ts, eventID uint64, samplerate int) db.KeyValuePair {
+	key := getPartialTagIndexRangeKey(tag)
+	key = append(key, uint64ToBytes(ts)...)
+	return db.KeyValuePair{
+		Key:   append(key, uint64ToBytes(eventID)...),
+		Value: encodeEventIndexValue(samplerate),
+	}
+}
+
+func decodeTagIndexKey(key []byte) (tag string, ts, eventID uint64, err error) {
+	components, rest, err := decodeKey(key, 2)
+	if err != nil {
+		return
+	}
+	if string(components[0]) != tagIndexPrefix || len(rest) != 16 {
+		err = errInvalidKey
+		return
+	}
+	return string(components[1]), bytesToUint64(rest[:8]), bytesToUint64(rest[8:]), nil
+}
+
+func getPartialTagIndexRangeKey(tag string) []byte {
+	return encodeKey([]byte(tagIndexPrefix), []byte(tag))
+}
+
+// Event records
+// (event_id) => record
+const eventRecordPrefix = "r"
+
+func createEventRecordEntry(eventID uint64, event Event) db.KeyValuePair {
+	return db.KeyValuePair{
+		Key:   getEventRecordKey(eventID),
+		Value: encodeEventRecord(event),
+	}
+}
+
+func getEventRecordKey(eventID uint64) []byte {
+	return encodeKey([]byte(eventRecordPrefix), uint64ToBytes(eventID))
+}
+
+func getPartialEventRecordRangeKey() []byte {
+	return encodeKey([]byte(eventRecordPrefix))
+}
+
+// Statistics
+// (tag) => events
+// (tag, dimension) => events with the dimension
+// (tag, dimension, value) => events with the value
+//
+// Counts are uvarints of the events written, ignoring the samplerate and the time. They are
+// only used to estimate how many events a filter matches.
+const statsPrefix = "s"
+
+func getTagStatsKey(tag string) []byte {
+	return encodeKey([]byte(statsPrefix), []byte(tag))
+}
+
+func getDimensionStatsKey(tag, dimension string) []byte {
+	return encodeKey([]byte(statsPrefix), []byte(tag), []byte(dimension))
+}
+
+func getValueStatsKey(tag, dimension, value string) []byte {
+	return encodeKey([]byte(statsPrefix), []byte(tag), []byte(dimension), []byte(value))
+}
+
+func encodeStatsValue(count uint64) []byte {
+	return appendUvarint(nil, count)
+}
+
+func decodeStatsValue(value []byte) (uint64, error) {
+	r := recordReader{b: value}
+	count := r.uvarint()
+	if r.err != nil || len(r.b) != 0 {
+		return 0, errInvalidRecord
+	}
+	return count, nil
+}
+
+// checkFormatVersion makes sure the database uses the current key layout. An empty database
+// is marked with the current format version.
+func checkFormatVersion(d db.DB) error {
+	value, exists, err := d.LookupValue(formatVersionKey)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if len(value) != 8 || bytesToUint64(value) != formatVersion {
+			return ErrFormatVersion
+		}
+		return nil
+	}
+
+	// Without a format version any existing key was written by an older layout
+	empty := true
+	err = d.RangeKeys(context.Background(), nil, func(key []byte) error {
+		empty = false
+		return db.ErrStopIteration
+	})
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return ErrFormatVersion
+	}
+
+	return writeFormatVersion(d)
+}
+
+func writeFormatVersion(d db.DB) error {
+	return d.SetKeyValues([]db.KeyValuePair{{Key: formatVersionKey, Value: uint64ToBytes(formatVersion)}})
+}
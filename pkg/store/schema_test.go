@@ -0,0 +1,72 @@
+package store
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/aaron7/eventstore/pkg/db"
+)
+
+func Test_decodeEventIndexKey_roundTrip(t *testing.T) {
+	f := func(tag, dimension, value string, ts, eventID uint64) bool {
+		gotTag, gotDimension, gotValue, gotTS, gotEventID, err := decodeEventIndexKey(getEventIndexEntryKey(tag, dimension, value, ts, eventID))
+		return err == nil && gotTag == tag && gotDimension == dimension && gotValue == value && gotTS == ts && gotEventID == eventID
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Colons in components and 0x3A bytes in the ts and event_id used to decode wrong
+	tag, dimension, value, ts, eventID, err := decodeEventIndexKey(getEventIndexEntryKey("a:b", "url", "http://x:80/", 0x3A3A, 0x3A00003A))
+	if err != nil || tag != "a:b" || dimension != "url" || value != "http://x:80/" || ts != 0x3A3A || eventID != 0x3A00003A {
+		t.Errorf("decodeEventIndexKey() = %q, %q, %q, %v, %v, %v", tag, dimension, value, ts, eventID, err)
+	}
+}
+
+func Test_decodeNumericIndexKey_roundTrip(t *testing.T) {
+	f := func(tag, dimension string, number float64, ts, eventID uint64) bool {
+		gotTag, gotDimension, gotNumber, gotTS, gotEventID, err := decodeNumericIndexKey(createNumericIndexEntry(tag, dimension, number, formatNumber(number), ts, eventID, 1).Key)
+		return err == nil && gotTag == tag && gotDimension == dimension && gotNumber == number && gotTS == ts && gotEventID == eventID
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_checkFormatVersion(t *testing.T) {
+	d, err := db.New("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkFormatVersion(d); err != nil {
+		t.Fatalf("checkFormatVersion() on empty db error = %v", err)
+	}
+	if err := checkFormatVersion(d); err != nil {
+		t.Fatalf("checkFormatVersion() on current db error = %v", err)
+	}
+
+	err = d.SetKeyValues([]db.KeyValuePair{{Key: formatVersionKey, Value: uint64ToBytes(formatVersion + 1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFormatVersion(d); err != ErrFormatVersion {
+		t.Errorf("checkFormatVersion() on newer db error = %v, want %v", err, ErrFormatVersion)
+	}
+}
+
+func Test_checkFormatVersion_legacy(t *testing.T) {
+	d, err := db.New("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key written by the colon separated layout before the format version existed
+	err = d.SetKeyValues([]db.KeyValuePair{{Key: []byte("e:tag:dim:value:")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFormatVersion(d); err != ErrFormatVersion {
+		t.Errorf("checkFormatVersion() on legacy db error = %v, want %v", err, ErrFormatVersion)
+	}
+}
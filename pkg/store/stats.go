@@ -0,0 +1,160 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aaron7/eventstore/pkg/db"
+)
+
+// Statistics are counted in memory by each ingest and written in batches, so that ingests
+// neither read the stored counts nor wait for each other or for a flush. The counts which have not been
+// written yet are lost if the process stops, which only makes the estimates less accurate.
+const (
+	statsFlushKeys     = 10000            // counted keys which make an ingest write the counts
+	statsFlushInterval = 10 * time.Second // longest the counts of an ingest are kept in memory
+)
+
+// statsCounts counts the events of a batch by stats key
+type statsCounts map[string]uint64
+
+// addEvent counts the event for its tag, each of its dimensions and each of its values.
+// Numbers are counted by their decimal form, like the event index.
+func (c statsCounts) addEvent(event Event) {
+	c[string(getTagStatsKey(event.Tag))]++
+	for dimension, value := range event.values() {
+		c[string(getDimensionStatsKey(event.Tag, dimension))]++
+		c[string(getValueStatsKey(event.Tag, dimension, value))]++
+	}
+}
+
+func (c statsCounts) add(counts statsCounts) {
+	for key, count := range counts {
+		c[key] += count
+	}
+}
+
+// pendingStats holds the counts of the ingested events which have not been written yet
+type pendingStats struct {
+	mu        sync.Mutex  // held while the counts are changed or read
+	counts    statsCounts // counted since the last flush
+	flushing  statsCounts // being written by a flush
+	writes    uint64      // incremented when a flush starts and ends its write
+	lastFlush time.Time
+
+	running int32      // set while a flush runs, so that ingests do not wait for it
+	flushMu sync.Mutex // held by a running flush and by DropAll
+}
+
+// addStats adds the counts of ingested events to the pending counts, and writes every
+// pending count when there are enough of them or they have waited long enough. The events
+// are already written, so a failed write keeps its counts for the next one instead of
+// failing the ingest.
+func (s *Store) addStats(counts statsCounts) {
+	p := &s.stats
+	p.mu.Lock()
+	if p.counts == nil {
+		p.counts = make(statsCounts)
+	}
+	p.counts.add(counts)
+	due := len(p.counts) >= statsFlushKeys || time.Since(p.lastFlush) >= statsFlushInterval
+	p.mu.Unlock()
+	if due {
+		s.flushStats()
+	}
+}
+
+// flushStats adds the pending counts to the stored counts. Only one flush runs at a time,
+// and a flush started while another runs leaves its counts to the next one.
+func (s *Store) flushStats() error {
+	p := &s.stats
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&p.running, 0)
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	p.mu.Lock()
+	counts := p.counts
+	p.counts, p.flushing, p.lastFlush = make(statsCounts), counts, time.Now()
+	p.mu.Unlock()
+
+	entries := make([]db.KeyValuePair, 0, len(counts))
+	var err error
+	for key, count := range counts {
+		var stored uint64
+		stored, err = s.storedStatistic([]byte(key))
+		if err != nil {
+			break
+		}
+		entries = append(entries, db.KeyValuePair{Key: []byte(key), Value: encodeStatsValue(stored + count)})
+	}
+
+	// The write is done without the lock, marked by an odd number of writes for statistic
+	wrote := err == nil
+	if wrote {
+		p.mu.Lock()
+		p.writes++
+		p.mu.Unlock()
+		err = s.DB.SetKeyValues(entries)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if wrote {
+		p.writes++
+	}
+	if err != nil {
+		p.counts.add(counts)
+	}
+	p.flushing = nil
+	return err
+}
+
+// resetStats drops the pending counts. The caller must hold flushMu.
+func (s *Store) resetStats() {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	s.stats.counts, s.stats.flushing = nil, nil
+}
+
+// statistic returns the count of the stats key, including the counts which have not been
+// written yet. The stored count is read without holding the lock, so a read which overlaps
+// the write of a flush can not tell whether the flushed counts are stored yet and leaves
+// them out.
+func (s *Store) statistic(key []byte) (uint64, error) {
+	p := &s.stats
+	for {
+		p.mu.Lock()
+		pending, flushing, writes := p.counts[string(key)], p.flushing[string(key)], p.writes
+		p.mu.Unlock()
+
+		stored, err := s.storedStatistic(key)
+		if err != nil {
+			return 0, err
+		}
+		if writes%2 == 1 {
+			return stored + pending, nil
+		}
+
+		// A write which started during the read may or may not be in the stored count
+		p.mu.Lock()
+		changed := p.writes != writes
+		p.mu.Unlock()
+		if !changed {
+			return stored + pending + flushing, nil
+		}
+	}
+}
+
+// storedStatistic returns the count stored at the stats key, which is zero when it does
+// not exist
+func (s *Store) storedStatistic(key []byte) (uint64, error) {
+	value, exists, err := s.DB.LookupValue(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+	return decodeStatsValue(value)
+}
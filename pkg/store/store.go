@@ -1,8 +1,10 @@
 package store
 
 import (
-	"fmt"
-	"sort"
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -23,10 +25,17 @@ func init() {
 type Store struct {
 	DB              db.DB
 	EventIDSequence db.Sequence
+
+	stats pendingStats // statistics of ingested events which have not been written yet
 }
 
 // New creates a new store
 func New(db db.DB) (*Store, error) {
+	err := checkFormatVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
 	eventIDSequence, err := db.GetSequence([]byte("test"), 1000)
 	if err != nil {
 		return nil, err
@@ -38,25 +47,70 @@ func New(db db.DB) (*Store, error) {
 	}, nil
 }
 
-// IngestEvents takes events and stores them
-func (s *Store) IngestEvents(events []Event) error {
+// IngestEvents takes events and stores them. Nothing is stored if the context is done
+// before the events are written.
+func (s *Store) IngestEvents(ctx context.Context, events []Event) error {
 	var indexEntries []db.KeyValuePair
+	buckets := make(map[string]map[uint64]struct{})
+	stats := make(statsCounts)
 
 	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		eventID, err := s.EventIDSequence.Next()
 		if err != nil {
 			return err
 		}
+		indexEntries = append(indexEntries, createEventRecordEntry(eventID, event))
+		indexEntries = append(indexEntries, createTagIndexEntry(event.Tag, event.TS, eventID, event.Samplerate))
 		for dimension, value := range event.Data {
-			indexEntries = append(indexEntries, createEventIndexEntry(event.Tag, dimension, value, event.TS, eventID))
+			indexEntries = append(indexEntries, createEventIndexEntry(event.Tag, dimension, value, event.TS, eventID, event.Samplerate))
 		}
-		if err != nil {
-			return err
+		for dimension, number := range event.Numbers {
+			text, ok := event.Data[dimension]
+			if !ok {
+				text = formatNumber(number)
+				indexEntries = append(indexEntries, createEventIndexEntry(event.Tag, dimension, text, event.TS, eventID, event.Samplerate))
+			}
+			indexEntries = append(indexEntries, createNumericIndexEntry(event.Tag, dimension, number, text, event.TS, eventID, event.Samplerate))
+		}
+		if _, ok := buckets[event.Tag]; !ok {
+			buckets[event.Tag] = make(map[uint64]struct{})
+		}
+		buckets[event.Tag][getEventIndexBucket(event.TS)] = struct{}{}
+		stats.addEvent(event)
+	}
+	for tag, tagBuckets := range buckets {
+		for bucket := range tagBuckets {
+			indexEntries = append(indexEntries, createEventIndexBucketEntry(tag, bucket))
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := s.DB.SetKeyValues(indexEntries)
+	if err != nil {
+		return err
+	}
 	eventsCounter.Add(float64(len(events)))
+	s.addStats(stats)
+
+	return nil
+}
 
-	return s.DB.SetKeyValues(indexEntries)
+// DropAll deletes every event and marks the empty database with the current format version
+func (s *Store) DropAll() error {
+	// A running flush would write the counts it read before the drop
+	s.stats.flushMu.Lock()
+	defer s.stats.flushMu.Unlock()
+	err := s.DB.DropAll()
+	if err != nil {
+		return err
+	}
+	s.resetStats()
+	return writeFormatVersion(s.DB)
 }
 
 // M ...
@@ -64,7 +118,10 @@ type M map[string]interface{}
 
 // QueryResult contains data result
 type QueryResult struct {
-	Data []QueryResultData `json:"data"`
+	Data     []QueryResultData      `json:"data"`
+	Funnel   *FunnelResult          `json:"funnel,omitempty"`
+	Formulas map[string]interface{} `json:"formulas,omitempty"` // the result of each formula by name
+	Query    string                 `json:"query,omitempty"`    // a text query as it was understood
 }
 
 // QueryResultData ...
@@ -72,14 +129,16 @@ type QueryResultData struct {
 	Name   string                 `json:"name"`
 	Result []DecodedEvent         `json:"result"`
 	Meta   map[string]interface{} `json:"meta"`
+	Cursor string                 `json:"cursor,omitempty"` // set when there is a next page
 }
 
 // DecodedEvent ...
 type DecodedEvent struct {
-	ID   uint64             `json:"id"`
-	TS   uint64             `json:"ts"`
-	Tag  string             `json:"tag"`
-	Data []DecodedEventData `json:"data"`
+	ID         uint64             `json:"id"`
+	TS         uint64             `json:"ts"`
+	Tag        string             `json:"tag"`
+	Samplerate int                `json:"-"`
+	Data       []DecodedEventData `json:"data"`
 }
 
 // DecodedEventData ...
@@ -88,97 +147,268 @@ type DecodedEventData struct {
 	Value string `json:"value"`
 }
 
-// QueryEvents takes a query and returns events
-func (s *Store) QueryEvents(query Query) QueryResult {
-	result := []QueryResultData{}
-
-	for _, data := range query.Data {
-		// Final list of events
-		var finalEvents []DecodedEvent
+// QueryEvents takes a query and returns events. An *InvalidQueryError is returned if the
+// query can not be run as written.
+func (s *Store) QueryEvents(ctx context.Context, query Query) (QueryResult, error) {
+	data := []QueryResultData{}
+	result, err := s.StreamQueryEvents(ctx, query, nil, func(dataResult QueryResultData) error {
+		data = append(data, dataResult)
+		return nil
+	})
+	if err != nil {
+		return QueryResult{}, err
+	}
+	result.Data = data
+	return result, nil
+}
 
-		// Store keys we have fetched (will be a small map)
-		fetchedKeysMap := make(map[string]struct{})
+// StreamQueryEvents runs a query like QueryEvents, calling fn with the result of each data
+// block as soon as it is resolved instead of keeping every result until the end. Only the
+// events and meta of the blocks which the funnel, the formulas and the in_result filters
+// read are kept, and the funnel and formula results are returned at the end without the
+// data. An error returned by event or fn stops the query.
+//
+// When event is not nil it is called with each event of a block before fn is called with
+// the result of the block, which then has no events. The events of blocks without
+// operations, time series, ts order or readers are passed to event as they are read, so
+// that they are never all kept.
+//
+// The query stops when the context is done or the query timeout passes. A
+// *QueryTimeoutError with the progress of the query is returned when it runs out of time.
+func (s *Store) StreamQueryEvents(ctx context.Context, query Query, event func(dataName string, event DecodedEvent) error, fn func(data QueryResultData) error) (QueryResult, error) {
+	if query.Timeout != "" {
+		timeout, err := time.ParseDuration(query.Timeout)
+		if err != nil || timeout <= 0 {
+			return QueryResult{}, invalidQueryf("invalid timeout %q", query.Timeout)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		for i, filter := range data.Filters {
+	ctx, progress := withQueryProgress(ctx)
+	result, err := s.streamQueryEvents(ctx, query, progress, event, fn)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return QueryResult{}, &QueryTimeoutError{Progress: progress.snapshot(), Err: err}
+	}
+	return result, err
+}
 
-			if filter.Type == "eq" {
-				finalEvents, _ = equalFilter(data.Tag, filter.Key, filter.Value, s, finalEvents, i == 0)
-			} else if filter.Type == "regex" {
-				finalEvents, _ = regexFilter(data.Tag, filter.Key, filter.Value, s, finalEvents, i == 0)
-			} else {
-				fmt.Println("Unsupported filter")
-			}
+func (s *Store) streamQueryEvents(ctx context.Context, query Query, progress *queryProgress, event func(dataName string, event DecodedEvent) error, fn func(data QueryResultData) error) (QueryResult, error) {
+	if query.Funnel != nil {
+		err := query.Funnel.validate(query)
+		if err != nil {
+			return QueryResult{}, err
+		}
+	}
+	formulas, err := compileFormulas(query)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	formulaNames := formulaData(formulas)
+	order, err := query.dataOrder()
+	if err != nil {
+		return QueryResult{}, err
+	}
 
-			// Record we fetched the key
-			fetchedKeysMap[filter.Key] = struct{}{}
-		}
-
-		// Get the remaining key values if they were not included in the filter
-		for _, dataKey := range data.Keys {
-			if _, ok := fetchedKeysMap[dataKey]; !ok {
-				// Not yet fetched this key, so fetch it and save the values
-				keyItr := func(key []byte) error {
-					// Benchmark: 0.33 seconds for 3.3m keys
-					// TODO: Find faster decoding
-					_, _, eventValue, _, eventID := decodeEventIndexKey(key)
-
-					// Intersect by searching the events list from previous combined filters and only
-					// adding the event from this filter if it is also in the previous combined filters.
-					idx := sort.Search(len(finalEvents), func(i int) bool {
-						return eventID <= finalEvents[i].ID
-					})
-					if idx < len(finalEvents) && finalEvents[idx].ID == eventID {
-						finalEvents[idx].Data = append(finalEvents[idx].Data, DecodedEventData{dataKey, eventValue})
+	// Blocks run in the order of their in_result filters, and their results are returned in
+	// the order of the query as soon as every block before them is done. A block which
+	// streams is streamed when it is the next to be returned.
+	dataEvents := make(map[string][]DecodedEvent)
+	dataMetas := make(map[string]map[string]interface{})
+	results := make([]*QueryResultData, len(query.Data))
+	returned := 0
+	for _, i := range order {
+		data := query.Data[i]
+		var result QueryResultData
+		var events []DecodedEvent
+		if event != nil && i == returned && data.streams(query) {
+			result, err = s.streamData(ctx, query, data, dataEvents, func(e DecodedEvent) error {
+				return event(data.Name, e)
+			})
+		} else {
+			result, events, err = s.queryData(ctx, query, data, dataEvents)
+		}
+		if err != nil {
+			return QueryResult{}, err
+		}
+		if len(query.resultKeys(data.Name)) > 0 {
+			dataEvents[data.Name] = events
+		}
+		if _, ok := formulaNames[data.Name]; ok {
+			dataMetas[data.Name] = result.Meta
+		}
+		atomic.AddInt64(&progress.dataCompleted, 1)
+
+		results[i] = &result
+		for ; returned < len(results) && results[returned] != nil; returned++ {
+			result := *results[returned]
+			results[returned] = nil
+			if event != nil {
+				for _, e := range result.Result {
+					if err := event(result.Name, e); err != nil {
+						return QueryResult{}, err
 					}
-					return nil
 				}
-				s.DB.RangeKeys(getPartialEventIndexDimensionRangeKey(data.Tag, dataKey), keyItr)
-
-				// Record we fetched the key
-				fetchedKeysMap[dataKey] = struct{}{}
+				result.Result = []DecodedEvent{}
+			}
+			err = fn(result)
+			if err != nil {
+				return QueryResult{}, err
 			}
 		}
+	}
+	if err := ctx.Err(); err != nil {
+		return QueryResult{}, err
+	}
 
-		// Apply operations
-		meta := make(map[string]interface{})
-		for _, operation := range data.Operations {
-			if operation.Type == "count" {
-				count := len(finalEvents)
-				meta["count"] = count
-			}
-			if operation.Type == "uniqueCount" {
-				var uniqueCount uint64
-				uniqueMap := make(map[string]struct{})
-
-				var keyIndex int
-				if len(finalEvents) > 0 {
-					for i, kv := range finalEvents[0].Data {
-						if kv.Key == operation.Key {
-							keyIndex = i
-							break
-						}
-					}
-				}
+	// The meta of an explained block is its plan
+	var result QueryResult
+	if query.Explain {
+		return result, nil
+	}
+	if query.Funnel != nil {
+		funnel, err := applyFunnel(ctx, query.Funnel, dataEvents)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		result.Funnel = &funnel
+	}
+	if len(formulas) > 0 {
+		result.Formulas, err = evaluateFormulas(formulas, dataMetas)
+		if err != nil {
+			return QueryResult{}, err
+		}
+	}
+	return result, nil
+}
 
-				for _, event := range finalEvents {
-					if _, ok := uniqueMap[event.Data[keyIndex].Value]; !ok {
-						uniqueCount++
-						uniqueMap[event.Data[keyIndex].Value] = struct{}{}
-					}
-				}
-				meta["uniqueCount"] = uniqueCount
-			}
+// compileData checks the pagination of the data block and compiles its filters, where the
+// in_result filters read the events of their blocks in dataEvents
+func compileData(query Query, data Data, dataEvents map[string][]DecodedEvent) (Data, *eventCursor, error) {
+	cursor, err := data.validatePagination()
+	if err != nil {
+		return Data{}, nil, err
+	}
+	filters := make([]Filter, len(data.Filters))
+	for i, filter := range data.Filters {
+		// The blocks an explained query reads are not run, so their results are unknown
+		if !query.Explain {
+			filter = filter.resolveResults(dataEvents)
 		}
+		filters[i], err = filter.compile(data.Name)
+		if err != nil {
+			return Data{}, nil, err
+		}
+	}
+	data.Filters = filters
+	return data, cursor, nil
+}
+
+// queryData runs the data block, returning its result and every event it matched before
+// the page was taken. dataEvents holds the events of the blocks its in_result filters read.
+func (s *Store) queryData(ctx context.Context, query Query, data Data, dataEvents map[string][]DecodedEvent) (QueryResultData, []DecodedEvent, error) {
+	r := data.timeRange(query)
+	data, cursor, err := compileData(query, data, dataEvents)
+	if err != nil {
+		return QueryResultData{}, nil, err
+	}
+
+	if query.Explain {
+		steps, err := s.explainData(query, data)
+		if err != nil {
+			return QueryResultData{}, nil, err
+		}
+		return QueryResultData{Name: data.Name, Result: []DecodedEvent{}, Meta: map[string]interface{}{"plan": steps}}, nil, nil
+	}
+	var profile *queryProfile
+	if query.Profile {
+		profile = &queryProfile{steps: []QueryStep{}}
+	}
 
-		// Hide the event data is HideData is true
+	// Pages of events in ts order stop scanning as soon as the page is full
+	inOrder, err := s.scansInOrder(query, data)
+	if err != nil {
+		return QueryResultData{}, nil, err
+	}
+	if inOrder {
+		stepCtx, step := profile.step(ctx, QueryStep{Step: stepScanInOrder})
+		events, next, err := s.scanEventsInOrder(stepCtx, data, r, cursor)
+		if err != nil {
+			return QueryResultData{}, nil, err
+		}
+		step.done(len(events))
+		allEvents := events
 		if data.HideData {
-			finalEvents = []DecodedEvent{}
+			events = []DecodedEvent{}
+		}
+		meta := map[string]interface{}{}
+		if profile != nil {
+			meta["profile"] = profile.steps
+		}
+		return QueryResultData{Name: data.Name, Result: events, Meta: meta, Cursor: next}, allEvents, nil
+	}
+
+	// Final list of events, with the keys the filters have fetched
+	finalEvents, fetchedKeysMap, err := s.applyFilters(ctx, data, r, profile)
+	if err != nil {
+		return QueryResultData{}, nil, err
+	}
+
+	// Without filters every event of the tag is returned
+	if len(data.Filters) == 0 {
+		stepCtx, step := profile.step(ctx, QueryStep{Step: stepTagScan})
+		finalEvents, err = s.tagEvents(stepCtx, data.Tag, r)
+		if err != nil {
+			return QueryResultData{}, nil, err
 		}
+		step.done(len(finalEvents))
+	}
+
+	// Get the remaining key values if they were not included in the filter
+	keys := append(data.requiredKeys(), query.resultKeys(data.Name)...)
+	var step *profiledStep
+	stepCtx := ctx
+	if profile != nil {
+		if missing := backfillKeys(data, keys, fetchedKeysMap); len(missing) > 0 {
+			stepCtx, step = profile.step(ctx, QueryStep{Step: stepFetchKeys, Keys: missing})
+		}
+	}
+	err = s.fetchKeys(stepCtx, data, keys, r, finalEvents, fetchedKeysMap)
+	if err != nil {
+		return QueryResultData{}, nil, err
+	}
+	step.done(len(finalEvents))
 
-		result = append(result, QueryResultData{Name: data.Name, Result: finalEvents, Meta: meta})
+	// Apply operations
+	step = nil
+	if len(data.Operations) > 0 || data.Granularity != "" {
+		_, step = profile.step(ctx, QueryStep{Step: stepOperations})
 	}
+	var meta map[string]interface{}
+	if data.Granularity != "" {
+		meta, err = applyTimeSeriesOperations(ctx, data, r, finalEvents, time.Now())
+	} else {
+		meta, err = applyOperations(ctx, data.Name, data.Operations, finalEvents)
+	}
+	if err != nil {
+		return QueryResultData{}, nil, err
+	}
+	step.done(len(finalEvents))
+	if profile != nil {
+		meta["profile"] = profile.steps
+	}
+
+	allEvents := finalEvents
+	finalEvents, next := pageEvents(data, cursor, finalEvents)
 
-	return QueryResult{Data: result}
+	// Hide the event data is HideData is true
+	if data.HideData {
+		finalEvents = []DecodedEvent{}
+	} else {
+		finalEvents = data.resultEvents(finalEvents, keys)
+	}
+	return QueryResultData{Name: data.Name, Result: finalEvents, Meta: meta, Cursor: next}, allEvents, nil
 }
 
 func intersect(smallerList []uint64, largerListMap map[uint64]struct{}) ([]uint64, map[uint64]struct{}) {
@@ -1,10 +1,381 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aaron7/eventstore/pkg/db"
 )
 
+func newTestStore(t *testing.T, events []Event) *Store {
+	d, err := db.New("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.IngestEvents(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore_QueryEvents(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"dim1": "foo", "dim2": "bar2"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"dim1": "foo", "dim2": "bar2", "dim3": "oof"}},
+		{Tag: "tag1", TS: 1003, Data: map[string]string{"dim1": "foo1"}},
+		{Tag: "tag2", TS: 1004, Data: map[string]string{"dim1": "foo"}},
+	})
+
+	result, err := s.QueryEvents(context.Background(), Query{Data: []Data{{
+		Name:       "test",
+		Tag:        "tag1",
+		Keys:       []string{"dim2"},
+		Filters:    []Filter{{Type: "eq", Key: "dim1", Value: "foo"}},
+		Operations: []Operation{{Type: "count"}, {Type: "uniqueCount", Key: "dim1"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DecodedEvent{
+		{ID: 1, TS: 1001, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"dim1", "foo"}, {"dim2", "bar2"}}},
+		{ID: 2, TS: 1002, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"dim1", "foo"}, {"dim2", "bar2"}}},
+	}
+	if !reflect.DeepEqual(result.Data[0].Result, want) {
+		t.Errorf("QueryEvents() result = %v, want %v", result.Data[0].Result, want)
+	}
+	wantMeta := map[string]interface{}{
+		"count": 2, "countSamples": 2, "countError": 0.0,
+		"uniqueCount": uint64(1), "uniqueCountSamples": 1, "uniqueCountError": 0.0,
+	}
+	if !reflect.DeepEqual(result.Data[0].Meta, wantMeta) {
+		t.Errorf("QueryEvents() meta = %v, want %v", result.Data[0].Meta, wantMeta)
+	}
+
+	result, err = s.QueryEvents(context.Background(), Query{Start: 1002, End: 1004, Data: []Data{{
+		Name:    "test",
+		Tag:     "tag1",
+		Filters: []Filter{{Type: "regex", Key: "dim1", Value: "^foo"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Data[0].Result) != 2 || result.Data[0].Result[0].TS != 1002 || result.Data[0].Result[1].TS != 1003 {
+		t.Errorf("QueryEvents() with time range result = %v", result.Data[0].Result)
+	}
+
+	// Keys only read by the operations are not returned
+	result, err = s.QueryEvents(context.Background(), Query{Data: []Data{{
+		Tag:        "tag1",
+		Keys:       []string{"dim2"},
+		Operations: []Operation{{Type: "uniqueCount", Key: "dim3"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []DecodedEvent{
+		{ID: 1, TS: 1001, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"dim2", "bar2"}}},
+		{ID: 2, TS: 1002, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"dim2", "bar2"}}},
+		{ID: 3, TS: 1003, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{}},
+	}
+	if !reflect.DeepEqual(result.Data[0].Result, want) || result.Data[0].Meta["uniqueCount"] != uint64(1) {
+		t.Errorf("QueryEvents() with operation keys result = %v, meta %v", result.Data[0].Result, result.Data[0].Meta)
+	}
+}
+
+func TestStore_QueryEvents_samplerate(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Samplerate: 10, Data: map[string]string{"dim1": "foo", "user": "a"}},
+		{Tag: "tag1", TS: 1002, Samplerate: 10, Data: map[string]string{"dim1": "foo", "user": "a"}},
+		{Tag: "tag1", TS: 1003, Samplerate: 1, Data: map[string]string{"dim1": "foo", "user": "b"}},
+	})
+
+	result, err := s.QueryEvents(context.Background(), Query{Data: []Data{{
+		Tag:        "tag1",
+		Keys:       []string{"user"},
+		Filters:    []Filter{{Type: "eq", Key: "dim1", Value: "foo"}},
+		Operations: []Operation{{Type: "count"}, {Type: "uniqueCount", Key: "user"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := result.Data[0].Meta
+	if meta["count"] != 21 || meta["countSamples"] != 3 || math.Abs(meta["countError"].(float64)-math.Sqrt(180)) > 1e-9 {
+		t.Errorf("QueryEvents() count meta = %v", meta)
+	}
+	// "a" was sampled twice in an estimated 20 events, so it had a 1-0.9^20 chance to be seen
+	pSampled := 1 - math.Pow(0.9, 20)
+	if meta["uniqueCount"] != uint64(2) || meta["uniqueCountSamples"] != 2 || math.Abs(meta["uniqueCountError"].(float64)-math.Sqrt(1-pSampled)/pSampled) > 1e-9 {
+		t.Errorf("QueryEvents() uniqueCount meta = %v", meta)
+	}
+}
+
+func TestStore_QueryEvents_allKeys(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"dim1": "foo", "dim3": "c", "dim2": "b"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"dim1": "bar"}},
+	})
+
+	result, err := s.QueryEvents(context.Background(), Query{Data: []Data{{
+		Tag:     "tag1",
+		Keys:    []string{"*"},
+		Filters: []Filter{{Type: "eq", Key: "dim1", Value: "foo"}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DecodedEvent{
+		{ID: 1, TS: 1001, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"dim1", "foo"}, {"dim2", "b"}, {"dim3", "c"}}},
+	}
+	if !reflect.DeepEqual(result.Data[0].Result, want) {
+		t.Errorf("QueryEvents() result = %v, want %v", result.Data[0].Result, want)
+	}
+}
+
+func TestStore_QueryEvents_invalid(t *testing.T) {
+	s := newTestStore(t, []Event{{Tag: "tag1", TS: 1001, Data: map[string]string{"dim1": "foo"}}})
+
+	tests := []struct {
+		name string
+		data Data
+		want string
+	}{
+		{"Invalid number", Data{Tag: "tag1", Filters: []Filter{{Type: "gt", Key: "dim1", Value: "foo"}}}, `has invalid number "foo"`},
+		{"between with one value", Data{Tag: "tag1", Filters: []Filter{{Type: "between", Key: "dim1", Values: []string{"1"}}}}, `must have two values`},
+		{"Unsupported filter", Data{Tag: "tag1", Filters: []Filter{{Type: "unknown", Key: "dim1"}}}, `unsupported filter type "unknown"`},
+		{"Empty or filter", Data{Tag: "tag1", Filters: []Filter{{Type: "or"}}}, `or filter in "" has no filters`},
+		{"Not filter with two filters", Data{Tag: "tag1", Filters: []Filter{{Type: "not", Filters: []Filter{{Type: "exists", Key: "a"}, {Type: "exists", Key: "b"}}}}}, `must have exactly one filter`},
+		{"Invalid regex", Data{Tag: "tag1", Filters: []Filter{{Type: "regex", Key: "dim1", Value: "(foo"}}}, "missing closing ): `(foo`"},
+		{"Invalid regex in or filter", Data{Tag: "tag1", Filters: []Filter{{Type: "or", Filters: []Filter{{Type: "regex", Key: "dim1", Value: "a**"}}}}}, "invalid nested repetition operator: `**`"},
+		{"Unsupported operation", Data{Tag: "tag1", Filters: []Filter{{Type: "eq", Key: "dim1", Value: "foo"}}, Operations: []Operation{{Type: "unknown"}}}, `unsupported operation type "unknown"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.QueryEvents(context.Background(), Query{Data: []Data{tt.data}})
+			if _, ok := err.(*InvalidQueryError); !ok || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("QueryEvents() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+
+	_, err := s.QueryEvents(context.Background(), Query{Timeout: "soon", Data: []Data{{Tag: "tag1"}}})
+	if _, ok := err.(*InvalidQueryError); !ok || !strings.Contains(err.Error(), `invalid timeout "soon"`) {
+		t.Errorf("QueryEvents() with invalid timeout error = %v, want *InvalidQueryError", err)
+	}
+}
+
+func TestStore_QueryEvents_timeout(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"dim1": "foo"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"dim1": "bar"}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	_, err := s.QueryEvents(ctx, Query{Data: []Data{{Tag: "tag1", Keys: []string{"dim1"}}}})
+	timeoutErr, ok := err.(*QueryTimeoutError)
+	if !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("QueryEvents() error = %v, want *QueryTimeoutError", err)
+	}
+	if timeoutErr.Progress.DataCompleted != 0 || timeoutErr.Progress.KeysScanned != 1 {
+		t.Errorf("QueryEvents() progress = %+v", timeoutErr.Progress)
+	}
+
+	// A cancelled query returns the error of the context
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = s.QueryEvents(ctx, Query{Data: []Data{{Tag: "tag1"}}})
+	if err != context.Canceled {
+		t.Errorf("QueryEvents() of cancelled query error = %v, want %v", err, context.Canceled)
+	}
+	if err := s.IngestEvents(ctx, []Event{{Tag: "tag1", TS: 1003}}); err != context.Canceled {
+		t.Errorf("IngestEvents() of cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func Test_scanCounters(t *testing.T) {
+	ctx, progress := withQueryProgress(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
+	counters := newScanCounters(ctx)
+	if err := counters.scannedKey(); err != nil {
+		t.Fatalf("scannedKey() error = %v", err)
+	}
+
+	// The context is checked again after contextCheckInterval keys
+	cancel()
+	for i := 1; i < contextCheckInterval; i++ {
+		if err := counters.scannedKey(); err != nil {
+			t.Fatalf("scannedKey() of key %d error = %v", i, err)
+		}
+	}
+	if got := progress.snapshot().KeysScanned; got != 1 {
+		t.Errorf("KeysScanned before the check = %d, want 1", got)
+	}
+	if err := counters.scannedKey(); err != context.Canceled {
+		t.Errorf("scannedKey() error = %v, want %v", err, context.Canceled)
+	}
+	counters.scannedKey()
+	counters.flush()
+	if got := progress.snapshot().KeysScanned; got != contextCheckInterval+2 {
+		t.Errorf("KeysScanned = %d, want %d", got, contextCheckInterval+2)
+	}
+
+	// The CPU-bound phases stop with the context too
+	events := []DecodedEvent{testEvent(1, 1, "path", "/a")}
+	if _, err := applyOperations(ctx, "test", []Operation{{Type: "count"}}, events); err != context.Canceled {
+		t.Errorf("applyOperations() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := groupBy(ctx, "test", Operation{Type: "group_by", Keys: []string{"path"}}, events); err != context.Canceled {
+		t.Errorf("groupBy() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := applyFunnel(ctx, &Funnel{Order: []string{"a"}, Match: []string{"path"}}, map[string][]DecodedEvent{"a": events}); err != context.Canceled {
+		t.Errorf("applyFunnel() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := intersectEvents(ctx, events, events); err != context.Canceled {
+		t.Errorf("intersectEvents() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestStore_QueryEvents_filters(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Data: map[string]string{"path": "/home", "user": "a"}},
+		{Tag: "tag1", TS: 1002, Data: map[string]string{"path": "/home/settings", "user": "b"}},
+		{Tag: "tag1", TS: 1003, Data: map[string]string{"path": "/about"}},
+		{Tag: "tag1", TS: 1004, Data: map[string]string{"referrer": "/home"}},
+		{Tag: "tag2", TS: 1005, Data: map[string]string{"path": "/home"}},
+	})
+
+	tests := []struct {
+		name    string
+		filters []Filter
+		want    []uint64
+	}{
+		{"No filters", nil, []uint64{1, 2, 3, 4}},
+		{"eq", []Filter{{Type: "eq", Key: "path", Value: "/home"}}, []uint64{1}},
+		{"neq", []Filter{{Type: "neq", Key: "path", Value: "/home"}}, []uint64{2, 3, 4}},
+		{"in", []Filter{{Type: "in", Key: "path", Values: []string{"/home", "/about", "/home"}}}, []uint64{1, 3}},
+		{"not_in", []Filter{{Type: "not_in", Key: "path", Values: []string{"/home", "/about"}}}, []uint64{2, 4}},
+		{"prefix", []Filter{{Type: "prefix", Key: "path", Value: "/home"}}, []uint64{1, 2}},
+		{"contains", []Filter{{Type: "contains", Key: "path", Value: "o"}}, []uint64{1, 2, 3}},
+		{"regex", []Filter{{Type: "regex", Key: "path", Value: "e$"}}, []uint64{1}},
+		{"regex with literal prefix", []Filter{{Type: "regex", Key: "path", Value: "^/home/s.*s$"}}, []uint64{2}},
+		{"regex with alternation", []Filter{{Type: "regex", Key: "path", Value: "^/(about|home)$"}}, []uint64{1, 3}},
+		{"exists", []Filter{{Type: "exists", Key: "user"}}, []uint64{1, 2}},
+		{"not_exists", []Filter{{Type: "not_exists", Key: "user"}}, []uint64{3, 4}},
+		{"Negation after filter", []Filter{{Type: "prefix", Key: "path", Value: "/"}, {Type: "neq", Key: "user", Value: "a"}}, []uint64{2, 3}},
+		{"Filter after negation", []Filter{{Type: "not_exists", Key: "user"}, {Type: "exists", Key: "path"}}, []uint64{3}},
+		{"or", []Filter{{Type: "or", Filters: []Filter{
+			{Type: "eq", Key: "path", Value: "/about"},
+			{Type: "eq", Key: "user", Value: "a"},
+		}}}, []uint64{1, 3}},
+		{"and", []Filter{{Type: "and", Filters: []Filter{
+			{Type: "prefix", Key: "path", Value: "/home"},
+			{Type: "eq", Key: "user", Value: "b"},
+		}}}, []uint64{2}},
+		{"not", []Filter{{Type: "not", Filters: []Filter{{Type: "prefix", Key: "path", Value: "/home"}}}}, []uint64{3, 4}},
+		{"Nested", []Filter{
+			{Type: "exists", Key: "path"},
+			{Type: "or", Filters: []Filter{
+				{Type: "eq", Key: "path", Value: "/about"},
+				{Type: "not", Filters: []Filter{{Type: "eq", Key: "user", Value: "a"}}},
+			}},
+		}, []uint64{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pages in ts order check the filters against the event records
+			for _, data := range []Data{{Tag: "tag1", Filters: tt.filters}, {Tag: "tag1", Filters: tt.filters, Limit: 10, Order: "asc"}} {
+				result, err := s.QueryEvents(context.Background(), Query{Data: []Data{data}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []uint64{}
+				for _, event := range result.Data[0].Result {
+					got = append(got, event.ID)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("QueryEvents() ids with limit %d = %v, want %v", data.Limit, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStore_QueryEvents_numericFilters(t *testing.T) {
+	s := newTestStore(t, []Event{
+		{Tag: "tag1", TS: 1001, Numbers: map[string]float64{"duration_ms": 9}},
+		{Tag: "tag1", TS: 1002, Numbers: map[string]float64{"duration_ms": 10}},
+		{Tag: "tag1", TS: 1003, Numbers: map[string]float64{"duration_ms": -2.5}},
+		{Tag: "tag1", TS: 1004, Numbers: map[string]float64{"duration_ms": 500}},
+		{Tag: "tag1", TS: 1005, Data: map[string]string{"duration_ms": "600"}},
+		{Tag: "tag1", TS: 1006, Data: map[string]string{"id": "9007199254740993"}, Numbers: map[string]float64{"id": 9007199254740993}},
+	})
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []uint64
+	}{
+		{"gt", Filter{Type: "gt", Key: "duration_ms", Value: "9"}, []uint64{2, 4}},
+		{"gte", Filter{Type: "gte", Key: "duration_ms", Value: "9"}, []uint64{1, 2, 4}},
+		{"lt", Filter{Type: "lt", Key: "duration_ms", Value: "10"}, []uint64{1, 3}},
+		{"lte", Filter{Type: "lte", Key: "duration_ms", Value: "10"}, []uint64{1, 2, 3}},
+		{"between", Filter{Type: "between", Key: "duration_ms", Values: []string{"-3", "9"}}, []uint64{1, 3}},
+		{"Empty between", Filter{Type: "between", Key: "duration_ms", Values: []string{"10", "9"}}, []uint64{}},
+		{"eq on decimal form", Filter{Type: "eq", Key: "duration_ms", Value: "-2.5"}, []uint64{3}},
+		{"eq on JSON form", Filter{Type: "eq", Key: "id", Value: "9007199254740993"}, []uint64{6}},
+		{"eq on rounded form", Filter{Type: "eq", Key: "id", Value: "9007199254740992"}, []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.QueryEvents(context.Background(), Query{Data: []Data{{Tag: "tag1", Filters: []Filter{tt.filter}}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []uint64{}
+			for _, event := range result.Data[0].Result {
+				got = append(got, event.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryEvents() ids = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	result, err := s.QueryEvents(context.Background(), Query{Data: []Data{{Tag: "tag1", Filters: []Filter{{Type: "gte", Key: "duration_ms", Value: "500"}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DecodedEvent{{ID: 4, TS: 1004, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"duration_ms", "500"}}}}
+	if !reflect.DeepEqual(result.Data[0].Result, want) {
+		t.Errorf("QueryEvents() result = %v, want %v", result.Data[0].Result, want)
+	}
+
+	// Numbers are returned in the JSON form they were ingested in
+	result, err = s.QueryEvents(context.Background(), Query{Data: []Data{{Tag: "tag1", Filters: []Filter{{Type: "gt", Key: "id", Value: "0"}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []DecodedEvent{{ID: 6, TS: 1006, Tag: "tag1", Samplerate: 1, Data: []DecodedEventData{{"id", "9007199254740993"}}}}
+	if !reflect.DeepEqual(result.Data[0].Result, want) {
+		t.Errorf("QueryEvents() result = %v, want %v", result.Data[0].Result, want)
+	}
+
+	var filter Filter
+	if err := json.Unmarshal([]byte(`{"type": "between", "key": "duration_ms", "values": [1, "2.5"]}`), &filter); err != nil || !reflect.DeepEqual(filter.Values, []string{"1", "2.5"}) {
+		t.Errorf("json.Unmarshal() filter = %v, %v", filter, err)
+	}
+}
+
 func Test_intersect(t *testing.T) {
 	type args struct {
 		smallerList   []uint64
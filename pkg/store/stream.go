@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"sort"
+)
+
+// streams reports whether the events of the data block can be streamed as they are read
+// instead of being collected first. The events of a block are needed together for its
+// operations, time series, ts order and the blocks which read its results.
+func (d Data) streams(query Query) bool {
+	return len(d.Operations) == 0 && d.Granularity == "" && d.Order == "" && !d.HideData &&
+		!query.Explain && !query.Profile && len(query.resultKeys(d.Name)) == 0
+}
+
+// streamData runs a data block which streams, calling fn with each event of the page in ID
+// order as soon as its keys are read. Only the IDs and the data added by the filters are
+// kept for the events which have not been returned yet. The result has no events.
+func (s *Store) streamData(ctx context.Context, query Query, data Data, dataEvents map[string][]DecodedEvent, fn func(event DecodedEvent) error) (QueryResultData, error) {
+	r := data.timeRange(query)
+	data, cursor, err := compileData(query, data, dataEvents)
+	if err != nil {
+		return QueryResultData{}, err
+	}
+
+	var events []DecodedEvent
+	fetchedKeysMap := make(map[string]struct{})
+	if len(data.Filters) > 0 {
+		events, fetchedKeysMap, err = s.applyFilters(ctx, data, r, nil)
+	} else {
+		events, err = s.tagEvents(ctx, data.Tag, r)
+	}
+	if err != nil {
+		return QueryResultData{}, err
+	}
+	events, next := pageEvents(data, cursor, events)
+	result := QueryResultData{Name: data.Name, Result: []DecodedEvent{}, Meta: map[string]interface{}{}, Cursor: next}
+
+	// The remaining keys are read from the record of each event, in the order fetchKeys
+	// adds them
+	keys := backfillKeys(data, data.requiredKeys(), fetchedKeysMap)
+	i := 0
+	emit := func() error {
+		event := events[i]
+		events[i] = DecodedEvent{}
+		i++
+		return fn(event)
+	}
+	if len(keys) > 0 {
+		eventIDs := make([]uint64, len(events))
+		for j, event := range events {
+			eventIDs[j] = event.ID
+		}
+		err = s.rangeEventRecords(ctx, eventIDs, func(eventID uint64, record Event) error {
+			// Events without a record are returned with the data of the filters
+			for events[i].ID != eventID {
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+			values := record.values()
+			if data.allKeys() {
+				keys = keys[:0]
+				for key := range values {
+					if _, ok := fetchedKeysMap[key]; !ok {
+						keys = append(keys, key)
+					}
+				}
+				sort.Strings(keys)
+			}
+			for _, key := range keys {
+				if value, ok := values[key]; ok {
+					events[i].Data = append(events[i].Data, DecodedEventData{key, value})
+				}
+			}
+			return emit()
+		})
+		if err != nil {
+			return QueryResultData{}, err
+		}
+	}
+	for i < len(events) {
+		if err := emit(); err != nil {
+			return QueryResultData{}, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestStore_StreamQueryEvents(t *testing.T) {
+	var events []Event
+	for i := 0; i < 20; i++ {
+		data := map[string]string{"path": fmt.Sprintf("/%d", i%3), "user": fmt.Sprintf("u%d", i%4)}
+		if i%5 == 0 {
+			delete(data, "user")
+		}
+		events = append(events, Event{Tag: "tag1", TS: uint64(1020 - i), Data: data})
+	}
+	s := newTestStore(t, events)
+
+	tests := []struct {
+		name string
+		data Data
+	}{
+		{"Tag", Data{Tag: "tag1", Keys: []string{"user", "path"}}},
+		{"Filters", Data{Tag: "tag1", Keys: []string{"user"}, Filters: []Filter{{Type: "eq", Key: "path", Value: "/1"}}}},
+		{"Every key", Data{Tag: "tag1", Keys: []string{"*"}, Filters: []Filter{{Type: "exists", Key: "user"}}}},
+		{"Page", Data{Tag: "tag1", Keys: []string{"path"}, Limit: 3, Cursor: encodeCursor("", DecodedEvent{ID: 4})}},
+		{"In order", Data{Tag: "tag1", Keys: []string{"path"}, Order: orderAsc}},
+		{"Operations", Data{Tag: "tag1", Keys: []string{"path"}, Operations: []Operation{{Type: "count"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data.Name = "test"
+			query := Query{Data: []Data{tt.data}}
+			want, err := s.QueryEvents(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []DecodedEvent{}
+			var results []QueryResultData
+			_, err = s.StreamQueryEvents(context.Background(), query, func(dataName string, event DecodedEvent) error {
+				if dataName != "test" || len(results) > 0 {
+					t.Errorf("StreamQueryEvents() event of %q after %d results", dataName, len(results))
+				}
+				got = append(got, event)
+				return nil
+			}, func(data QueryResultData) error {
+				results = append(results, data)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want.Data[0].Result) {
+				t.Errorf("StreamQueryEvents() events = %v, want %v", got, want.Data[0].Result)
+			}
+			if len(results) != 1 || len(results[0].Result) != 0 || !reflect.DeepEqual(results[0].Meta, want.Data[0].Meta) || results[0].Cursor != want.Data[0].Cursor {
+				t.Errorf("StreamQueryEvents() results = %+v, want %+v", results, want.Data)
+			}
+		})
+	}
+
+	// A streamed block stops as soon as event returns an error
+	errStop := errors.New("stop")
+	streamed := 0
+	_, err := s.StreamQueryEvents(context.Background(), Query{Data: []Data{{Tag: "tag1", Keys: []string{"user"}}}}, func(dataName string, event DecodedEvent) error {
+		streamed++
+		return errStop
+	}, func(data QueryResultData) error {
+		return nil
+	})
+	if err != errStop || streamed != 1 {
+		t.Errorf("StreamQueryEvents() error = %v after %d events, want %v after 1", err, streamed, errStop)
+	}
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"strings"
+)
+
+// dataReferences appends the names of the data blocks the in_result filters read
+func dataReferences(filters []Filter, names []string) []string {
+	for _, filter := range filters {
+		if filter.Type == "in_result" {
+			names = append(names, filter.Data)
+		}
+		names = dataReferences(filter.Filters, names)
+	}
+	return names
+}
+
+// dataOrder returns the indexes of the data blocks in the order they run, where every
+// block runs after the blocks its in_result filters read and otherwise in query order.
+// References to unknown blocks and blocks which depend on each other are rejected.
+func (q Query) dataOrder() ([]int, error) {
+	indexes := make(map[string]int)
+	duplicates := make(map[string]struct{})
+	for i, data := range q.Data {
+		if _, ok := indexes[data.Name]; ok {
+			duplicates[data.Name] = struct{}{}
+		}
+		indexes[data.Name] = i
+	}
+
+	dependencies := make([][]int, len(q.Data))
+	for i, data := range q.Data {
+		for _, name := range dataReferences(data.Filters, nil) {
+			j, ok := indexes[name]
+			_, duplicate := duplicates[name]
+			switch {
+			case name == "":
+				return nil, invalidQueryf("in_result filter in %q has no data block", data.Name)
+			case !ok:
+				return nil, invalidQueryf("in_result filter in %q reads %q, which is not a data block", data.Name, name)
+			case duplicate:
+				return nil, invalidQueryf("in_result filter in %q reads %q, which names more than one data block", data.Name, name)
+			}
+			dependencies[i] = append(dependencies[i], j)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	order := make([]int, 0, len(q.Data))
+	states := make([]int, len(q.Data))
+	var path []int
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch states[i] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for j := len(path) - 1; j >= 0; j-- {
+				cycle = append([]string{q.Data[path[j]].Name}, cycle...)
+				if path[j] == i {
+					break
+				}
+			}
+			cycle = append(cycle, q.Data[i].Name)
+			return invalidQueryf("in_result filters of data blocks %s form a cycle", strings.Join(cycle, " -> "))
+		}
+		states[i] = visiting
+		path = append(path, i)
+		for _, j := range dependencies[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		states[i] = visited
+		order = append(order, i)
+		return nil
+	}
+	for i := range q.Data {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// resultKeys returns the keys the funnel and the in_result filters of other blocks read
+// from the events of the data block
+func (q Query) resultKeys(dataName string) []string {
+	keys := q.Funnel.funnelKeys(dataName)
+	var appendKeys func(filters []Filter)
+	appendKeys = func(filters []Filter) {
+		for _, filter := range filters {
+			if filter.Type == "in_result" && filter.Data == dataName {
+				keys = append(keys, filter.resultKey())
+			}
+			appendKeys(filter.Filters)
+		}
+	}
+	for _, data := range q.Data {
+		appendKeys(data.Filters)
+	}
+	return keys
+}
+
+// resultKey returns the key an in_result filter reads from the events of its data block
+func (f Filter) resultKey() string {
+	if f.DataKey != "" {
+		return f.DataKey
+	}
+	return f.Key
+}
+
+// resultSetValues is the number of values above which an in_result filter scans the
+// dimension once and looks each value up in a set, instead of reading the index of every
+// value
+const resultSetValues = 1000
+
+// resolveResults returns a copy of the filter where every in_result filter is replaced by
+// an in filter of the values it reads from the events of its data block, so that it is
+// planned and scanned like any other in filter
+func (f Filter) resolveResults(dataEvents map[string][]DecodedEvent) Filter {
+	if f.Type == "in_result" {
+		events := dataEvents[f.Data]
+		in := Filter{Type: "in", Key: f.Key, Values: resultValues(events, f.resultKey())}
+		if len(in.Values) > resultSetValues {
+			in.valueSet = make(map[string]struct{}, len(in.Values))
+			for _, value := range in.Values {
+				in.valueSet[value] = struct{}{}
+			}
+			in.resultEvents = len(events)
+		}
+		return in
+	}
+	if len(f.Filters) > 0 {
+		filters := make([]Filter, len(f.Filters))
+		for i, filter := range f.Filters {
+			filters[i] = filter.resolveResults(dataEvents)
+		}
+		f.Filters = filters
+	}
+	return f
+}
+
+// resultValues returns the distinct values of the key in the events
+func resultValues(events []DecodedEvent, key string) []string {
+	values := []string{}
+	seen := make(map[string]struct{})
+	for _, event := range events {
+		for _, data := range event.Data {
+			if _, ok := seen[data.Value]; !ok && data.Key == key {
+				seen[data.Value] = struct{}{}
+				values = append(values, data.Value)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newSubqueryTestStore(t *testing.T) *Store {
+	return newTestStore(t, []Event{
+		{Tag: "product_view", TS: 1001, Data: map[string]string{"user_id": "u1", "product": "x"}},
+		{Tag: "product_view", TS: 1002, Data: map[string]string{"user_id": "u2", "product": "y"}},
+		{Tag: "product_view", TS: 1003, Data: map[string]string{"user_id": "u3", "product": "x"}},
+		{Tag: "purchase", TS: 1004, Data: map[string]string{"buyer": "u1", "user_id": "u1", "price": "10"}},
+		{Tag: "purchase", TS: 1005, Data: map[string]string{"buyer": "u2", "user_id": "u2", "price": "20"}},
+		{Tag: "purchase", TS: 1006, Data: map[string]string{"buyer": "u3", "user_id": "u3", "price": "30"}},
+		{Tag: "purchase", TS: 1007, Data: map[string]string{"buyer": "u4", "user_id": "u4", "price": "40"}},
+	})
+}
+
+func TestStore_QueryEvents_inResult(t *testing.T) {
+	s := newSubqueryTestStore(t)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"Same key", Filter{Type: "in_result", Key: "user_id", Data: "viewed"}, []string{"10", "30"}},
+		{"Other key", Filter{Type: "in_result", Key: "buyer", Data: "viewed", DataKey: "user_id"}, []string{"10", "30"}},
+		{"Negated", Filter{Type: "not", Filters: []Filter{{Type: "in_result", Key: "user_id", Data: "viewed"}}}, []string{"20", "40"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The purchases come first, so they have to wait for the views
+			result, err := s.QueryEvents(context.Background(), Query{Data: []Data{
+				{Name: "purchases", Tag: "purchase", Keys: []string{"price"}, Filters: []Filter{tt.filter}, Operations: []Operation{{Type: "count"}}},
+				{Name: "viewed", Tag: "product_view", Filters: []Filter{{Type: "eq", Key: "product", Value: "x"}}, HideData: true, Limit: 1, Order: orderAsc},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Data[0].Name != "purchases" || result.Data[1].Name != "viewed" {
+				t.Fatalf("QueryEvents() data = %v, %v, want purchases, viewed", result.Data[0].Name, result.Data[1].Name)
+			}
+			var prices []string
+			for _, event := range result.Data[0].Result {
+				for _, data := range event.Data {
+					if data.Key == "price" {
+						prices = append(prices, data.Value)
+					}
+				}
+			}
+			if !reflect.DeepEqual(prices, tt.want) || result.Data[0].Meta["count"] != len(tt.want) {
+				t.Errorf("QueryEvents() prices = %v, count %v, want %v", prices, result.Data[0].Meta["count"], tt.want)
+			}
+		})
+	}
+}
+
+func TestQuery_dataOrder(t *testing.T) {
+	inResult := func(name string) []Filter {
+		return []Filter{{Type: "in_result", Key: "user_id", Data: name}}
+	}
+
+	tests := []struct {
+		name    string
+		data    []Data
+		want    []int
+		wantErr string
+	}{
+		{"Query order", []Data{{Name: "a"}, {Name: "b"}}, []int{0, 1}, ""},
+		{"Dependencies first", []Data{{Name: "a", Filters: inResult("c")}, {Name: "b"}, {Name: "c", Filters: inResult("b")}}, []int{1, 2, 0}, ""},
+		{"Nested filter", []Data{{Name: "a", Filters: []Filter{{Type: "or", Filters: inResult("b")}}}, {Name: "b"}}, []int{1, 0}, ""},
+		{"Unknown block", []Data{{Name: "a", Filters: inResult("b")}}, nil, `reads "b", which is not a data block`},
+		{"Unnamed block", []Data{{Name: "a", Filters: inResult("")}, {}}, nil, `has no data block`},
+		{"Duplicate names", []Data{{Name: "a", Filters: inResult("b")}, {Name: "b"}, {Name: "b"}}, nil, `names more than one data block`},
+		{"Self", []Data{{Name: "a", Filters: inResult("a")}}, nil, `a -> a form a cycle`},
+		{"Cycle", []Data{{Name: "x"}, {Name: "a", Filters: inResult("b")}, {Name: "b", Filters: inResult("c")}, {Name: "c", Filters: inResult("a")}}, nil, `a -> b -> c -> a form a cycle`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Query{Data: tt.data}.dataOrder()
+			if tt.wantErr != "" {
+				if _, ok := err.(*InvalidQueryError); !ok || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("dataOrder() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dataOrder() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStore_QueryEvents_largeResult(t *testing.T) {
+	var events []Event
+	for i := 0; i < 2*resultSetValues; i++ {
+		user := fmt.Sprintf("u%d", i)
+		events = append(events, Event{Tag: "page", TS: 1000, Data: map[string]string{"user_id": user}})
+		if i%2 == 0 {
+			events = append(events, Event{Tag: "signup", TS: 1000, Data: map[string]string{"user_id": user}})
+		}
+	}
+	s := newTestStore(t, events)
+
+	// More values than resultSetValues are matched with a set while scanning the dimension
+	dataEvents := map[string][]DecodedEvent{"signups": make([]DecodedEvent, resultSetValues+1)}
+	for i := range dataEvents["signups"] {
+		dataEvents["signups"][i] = testEvent(uint64(i), 1, "user_id", fmt.Sprintf("u%d", i))
+	}
+	filter := Filter{Type: "in_result", Key: "user_id", Data: "signups"}.resolveResults(dataEvents)
+	if len(filter.valueSet) != resultSetValues+1 || filter.resultEvents != resultSetValues+1 {
+		t.Errorf("resolveResults() set of %d values from %d events, want %d", len(filter.valueSet), filter.resultEvents, resultSetValues+1)
+	}
+	if estimate, err := s.estimateFilter("page", filter, 2*resultSetValues); err != nil || estimate != resultSetValues+1 {
+		t.Errorf("estimateFilter() = %v, %v, want %d", estimate, err, resultSetValues+1)
+	}
+
+	for _, filters := range [][]Filter{
+		{{Type: "in_result", Key: "user_id", Data: "signups"}},
+		{{Type: "exists", Key: "user_id"}, {Type: "in_result", Key: "user_id", Data: "signups"}},
+		{{Type: "not", Filters: []Filter{{Type: "in_result", Key: "user_id", Data: "signups"}}}},
+	} {
+		result, err := s.QueryEvents(context.Background(), Query{Data: []Data{
+			{Name: "signups", Tag: "signup", Keys: []string{"user_id"}, HideData: true},
+			{Name: "pages", Tag: "page", Filters: filters, Operations: []Operation{{Type: "count"}}, HideData: true},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := result.Data[1].Meta["count"]; got != resultSetValues {
+			t.Errorf("QueryEvents() with filters %v count = %v, want %d", filters, got, resultSetValues)
+		}
+	}
+}
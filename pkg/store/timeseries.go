@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTimeSeriesBuckets limits the number of buckets a time series query can return
+const maxTimeSeriesBuckets = 100000
+
+// TimeSeriesPoint is the result of an operation for the time bucket starting at TS
+type TimeSeriesPoint struct {
+	TS    uint64      `json:"ts"`
+	Value interface{} `json:"value"`
+}
+
+// parseGranularity parses a granularity such as 30s, 1m, 1h or 1d into ms
+func parseGranularity(granularity string) (uint64, error) {
+	var d time.Duration
+	if unit := granularity[len(granularity)-1:]; unit == "d" || unit == "w" {
+		n, err := strconv.ParseUint(strings.TrimSuffix(granularity, unit), 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		day := 24 * time.Hour
+		if unit == "w" {
+			day *= 7
+		}
+		if n > math.MaxInt64/uint64(day) {
+			return 0, fmt.Errorf("granularity %q is too large", granularity)
+		}
+		d = time.Duration(n) * day
+	} else {
+		var err error
+		d, err = time.ParseDuration(granularity)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d < time.Millisecond {
+		return 0, fmt.Errorf("granularity %q is less than 1ms", granularity)
+	}
+	return uint64(d / time.Millisecond), nil
+}
+
+// applyTimeSeriesOperations applies the operations of the data to the events in each time
+// bucket of the granularity. Every result in the meta becomes a series of points, with
+// buckets without events filled by applying the operations to no events. Without a start
+// the series starts at the first event, or the end without events. Without an end it ends
+// at the last event, or now without events.
+func applyTimeSeriesOperations(ctx context.Context, data Data, r timeRange, events []DecodedEvent, now time.Time) (map[string]interface{}, error) {
+	granularity, err := parseGranularity(data.Granularity)
+	if err != nil {
+		return nil, invalidQueryf("invalid granularity %q in %q", data.Granularity, data.Name)
+	}
+
+	// Every result has a series, even when no bucket is in the time range
+	emptyMeta, err := applyOperations(ctx, data.Name, data.Operations, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]interface{}, len(emptyMeta))
+	for name := range emptyMeta {
+		meta[name] = []TimeSeriesPoint{}
+	}
+
+	start, end := r.start, r.end
+	if len(events) > 0 && (start == 0 || end == 0) {
+		first, last := events[0].TS, events[0].TS
+		for _, event := range events {
+			if event.TS < first {
+				first = event.TS
+			}
+			if event.TS > last {
+				last = event.TS
+			}
+		}
+		if start == 0 {
+			start = first
+		}
+		if end == 0 {
+			end = last + 1
+		}
+	}
+	if end == 0 {
+		end = uint64(now.UnixNano() / int64(time.Millisecond))
+	}
+	if start == 0 {
+		start = end
+	}
+	if end <= start {
+		return meta, nil
+	}
+
+	firstBucket := start / granularity
+	buckets := (end-1)/granularity - firstBucket + 1
+	if buckets > maxTimeSeriesBuckets {
+		return nil, invalidQueryf("granularity %q in %q gives more than %d buckets", data.Granularity, data.Name, maxTimeSeriesBuckets)
+	}
+
+	bucketEvents := make([][]DecodedEvent, buckets)
+	for _, event := range events {
+		i := event.TS/granularity - firstBucket
+		bucketEvents[i] = append(bucketEvents[i], event)
+	}
+
+	for i, events := range bucketEvents {
+		bucketMeta, err := applyOperations(ctx, data.Name, data.Operations, events)
+		if err != nil {
+			return nil, err
+		}
+		ts := (firstBucket + uint64(i)) * granularity
+		for name, value := range bucketMeta {
+			series, _ := meta[name].([]TimeSeriesPoint)
+			meta[name] = append(series, TimeSeriesPoint{TS: ts, Value: value})
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseGranularity(t *testing.T) {
+	tests := []struct {
+		granularity string
+		want        uint64
+		wantErr     bool
+	}{
+		{"500ms", 500, false},
+		{"1m", 60 * 1000, false},
+		{"1h", 60 * 60 * 1000, false},
+		{"2d", 2 * 24 * 60 * 60 * 1000, false},
+		{"1w", 7 * 24 * 60 * 60 * 1000, false},
+		{"d", 0, true},
+		{"1x", 0, true},
+		{"-1m", 0, true},
+		{"0d", 0, true},
+		{"100us", 0, true},
+		{"106751d", 106751 * 24 * 60 * 60 * 1000, false},
+		{"106752d", 0, true},
+		{"200000d", 0, true},
+		{"300000d", 0, true},
+		{"15250w", 15250 * 7 * 24 * 60 * 60 * 1000, false},
+		{"15251w", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granularity, func(t *testing.T) {
+			got, err := parseGranularity(tt.granularity)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGranularity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseGranularity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseGranularity("200000d"); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("parseGranularity() error = %v, want too large", err)
+	}
+}
+
+func Test_applyTimeSeriesOperations(t *testing.T) {
+	data := Data{Name: "test", Granularity: "10ms", Operations: []Operation{{Type: "count"}}}
+	events := []DecodedEvent{testEvent(12, 1), testEvent(15, 1), testEvent(31, 2)}
+
+	got, err := applyTimeSeriesOperations(context.Background(), data, timeRange{start: 5, end: 45}, events, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TimeSeriesPoint{{0, 0}, {10, 2}, {20, 0}, {30, 2}, {40, 0}}
+	if !reflect.DeepEqual(got["count"], want) {
+		t.Errorf("applyTimeSeriesOperations() count = %v, want %v", got["count"], want)
+	}
+	wantSamples := []TimeSeriesPoint{{0, 0}, {10, 2}, {20, 0}, {30, 1}, {40, 0}}
+	if !reflect.DeepEqual(got["countSamples"], wantSamples) {
+		t.Errorf("applyTimeSeriesOperations() countSamples = %v, want %v", got["countSamples"], wantSamples)
+	}
+
+	// Without a time range the series covers the events
+	got, err = applyTimeSeriesOperations(context.Background(), data, timeRange{}, events, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []TimeSeriesPoint{{10, 2}, {20, 0}, {30, 2}}
+	if !reflect.DeepEqual(got["count"], want) {
+		t.Errorf("applyTimeSeriesOperations() count = %v, want %v", got["count"], want)
+	}
+
+	// Without events the series covers the bound which is set, up to now
+	got, err = applyTimeSeriesOperations(context.Background(), data, timeRange{end: 100000000}, nil, time.Time{})
+	if err != nil || !reflect.DeepEqual(got["count"], []TimeSeriesPoint{}) {
+		t.Errorf("applyTimeSeriesOperations() with an end count = %v, %v, want []", got["count"], err)
+	}
+	got, err = applyTimeSeriesOperations(context.Background(), data, timeRange{start: 15}, nil, time.Unix(0, 35*int64(time.Millisecond)))
+	want = []TimeSeriesPoint{{10, 0}, {20, 0}, {30, 0}}
+	if err != nil || !reflect.DeepEqual(got["count"], want) {
+		t.Errorf("applyTimeSeriesOperations() with a start count = %v, %v, want %v", got["count"], err, want)
+	}
+
+	data.Granularity = "1ms"
+	if _, err := applyTimeSeriesOperations(context.Background(), data, timeRange{start: 1, end: maxTimeSeriesBuckets + 2}, events, time.Time{}); err == nil {
+		t.Errorf("applyTimeSeriesOperations() with too many buckets error = nil")
+	}
+}